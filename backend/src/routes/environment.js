@@ -7,11 +7,24 @@ const { checkPermission } = require('../utils/auth');
 // 添加环境记录
 router.post('/', checkPermission('addEnvironmentalData'), async (req, res) => {
     try {
+        // 读数须由设备签名，读数ID、采集时间和签名均由设备生成，服务端原样转发
+        const { deviceId, signature, recordTime } = req.body;
+        if (!deviceId || !signature || !recordTime) {
+            return res.status(400).json({
+                error: '环境记录须包含设备ID、采集时间和设备签名',
+                type: 'UNSIGNED_ENVIRONMENT_DATA'
+            });
+        }
+
         const recordData = {
             id: req.body.id,
             productId: req.body.productId,
             temperature: req.body.temperature,
             humidity: req.body.humidity,
+            metrics: req.body.metrics,
+            deviceId,
+            signature,
+            recordTime,
             operatorId: req.user.id
         };
 
@@ -26,10 +39,10 @@ router.post('/', checkPermission('addEnvironmentalData'), async (req, res) => {
         });
     } catch (error) {
         // 处理特定的错误情况
-        if (error.message.includes('温度异常警报') || error.message.includes('湿度异常警报')) {
+        if (error.message.includes('数据无效') || error.message.includes('签名') || error.message.includes('已存在')) {
             return res.status(400).json({
                 error: error.message,
-                type: 'ENVIRONMENT_ALERT'
+                type: 'INVALID_ENVIRONMENT_DATA'
             });
         }
 
@@ -15,59 +15,41 @@ router.post('/environment/batch', checkApiKey, async (req, res) => {
             });
         }
 
-        const results = [];
-        const alerts = [];
-
-        // 批量处理环境记录
-        for (const record of records) {
-            try {
-                const recordData = {
-                    id: `env_${deviceId}_${Date.now()}_${Math.random().toString(36).substr(2, 9)}`,
-                    productId: productId,
-                    temperature: record.temperature,
-                    humidity: record.humidity,
-                    operatorId: 'IOT_DEVICE_' + deviceId,
-                    recordTime: record.timestamp || new Date().toISOString()
-                };
-
-                await fabricClient.submitTransaction(
-                    'AddEnvironmentRecord',
-                    JSON.stringify(recordData)
-                );
-
-                results.push({
-                    success: true,
-                    data: recordData
-                });
-
-                // 检查是否需要发出警报
-                if (record.temperature > 35 || record.temperature < 0) {
-                    alerts.push({
-                        type: 'TEMPERATURE_ALERT',
-                        message: `温度异常: ${record.temperature}°C`,
-                        timestamp: recordData.recordTime,
-                        deviceId: deviceId,
-                        productId: productId
-                    });
-                }
-
-                if (record.humidity < 0 || record.humidity > 100) {
-                    alerts.push({
-                        type: 'HUMIDITY_ALERT',
-                        message: `湿度异常: ${record.humidity}%`,
-                        timestamp: recordData.recordTime,
-                        deviceId: deviceId,
-                        productId: productId
-                    });
-                }
-
-            } catch (error) {
-                results.push({
-                    success: false,
-                    error: error.message
-                });
-            }
-        }
+        // 整批读数在一笔交易中提交，链码校验设备签名并逐条返回接收结果
+        // 读数ID、采集时间和签名均由设备生成，不能在服务端补齐
+        const readings = records.map(record => ({
+            id: record.id,
+            productId: record.productId || productId,
+            temperature: record.temperature,
+            humidity: record.humidity,
+            metrics: record.metrics,
+            deviceId,
+            signature: record.signature,
+            operatorId: 'IOT_DEVICE_' + deviceId,
+            recordTime: record.timestamp
+        }));
+
+        const result = await fabricClient.submitTransaction(
+            'AddEnvironmentBatch',
+            JSON.stringify({ batchId: `batch_${deviceId}_${Date.now()}`, readings })
+        );
+        const batchResult = JSON.parse(result.toString());
+
+        const results = batchResult.results.map(r => ({
+            success: r.accepted,
+            readingId: r.readingId,
+            error: r.error
+        }));
+
+        const alerts = batchResult.results
+            .filter(r => r.alerts && r.alerts.length > 0)
+            .flatMap(r => r.alerts.map(alert => ({
+                type: `${alert.metric.toUpperCase()}_ALERT`,
+                message: `${alert.metric}异常: ${alert.value}${alert.unit}`,
+                readingId: r.readingId,
+                deviceId: deviceId,
+                productId: r.productId
+            })));
 
         res.status(200).json({
             message: '环境数据批量上传完成',
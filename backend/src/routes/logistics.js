@@ -63,7 +63,8 @@ router.post('/', [auth, checkPermission('addLogisticsInfo')], async (req, res) =
       id: req.body.id,
       productId: req.body.productId,
       location: req.body.location,
-      status: req.body.status,
+      // 新建物流记录从 CREATED 开始，后续状态通过更新接口流转
+      status: req.body.status || 'CREATED',
       description: req.body.description,
       operatorId: req.user.id,
     };
@@ -105,12 +106,26 @@ router.get('/:id', auth, async (req, res) => {
 // 更新物流记录
 router.put('/:id', [auth, checkPermission('addLogisticsInfo')], async (req, res) => {
   try {
+    // 坐标可选，未上报时经纬度均按空字符串提交，上报时须同时提供，范围由链码校验
+    const hasLatitude = req.body.latitude !== undefined && req.body.latitude !== null && req.body.latitude !== '';
+    const hasLongitude = req.body.longitude !== undefined && req.body.longitude !== null && req.body.longitude !== '';
+    if (hasLatitude !== hasLongitude) {
+      return res.status(400).json({ error: '纬度和经度须同时提供' });
+    }
+    const latitude = hasLatitude ? Number(req.body.latitude) : null;
+    const longitude = hasLongitude ? Number(req.body.longitude) : null;
+    if (hasLatitude && (!Number.isFinite(latitude) || !Number.isFinite(longitude))) {
+      return res.status(400).json({ error: '无效的坐标' });
+    }
+
     await fabricClient.submitTransaction(
       'UpdateLogisticsRecord',
       req.params.id,
       req.body.status,
       req.body.location,
-      req.body.description
+      req.body.description,
+      hasLatitude ? String(latitude) : '',
+      hasLongitude ? String(longitude) : ''
     );
 
     res.json({
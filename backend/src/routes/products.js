@@ -79,6 +79,14 @@ router.post('/:productId/production-records', [auth, checkPermission('updateProd
             description: req.body.description,
             operatorId: req.user.id
         };
+        // 收获记录须填写收获数量，计入农户持有数量
+        if (req.body.type === 'HARVESTING') {
+            const quantity = Number(req.body.quantity);
+            if (!Number.isInteger(quantity) || quantity <= 0) {
+                return res.status(400).json({ error: '收获记录的收获数量必须为正整数' });
+            }
+            recordData.quantity = quantity;
+        }
 
         const result = await fabricClient.submitTransaction(
             'AddProductionRecord',
@@ -95,6 +103,38 @@ router.post('/:productId/production-records', [auth, checkPermission('updateProd
     }
 });
 
+// 为记录收获数量之前已收获的批次补录收获数量
+router.put('/:productId/harvest-quantity', [auth, checkPermission('updateProductionInfo')], async (req, res) => {
+    try {
+        const quantity = Number(req.body.quantity);
+        if (!req.body.id || !Number.isInteger(quantity) || quantity <= 0) {
+            return res.status(400).json({ error: '补录须提供记录ID，收获数量必须为正整数' });
+        }
+
+        const recordData = {
+            id: req.body.id,
+            productId: req.params.productId,
+            date: req.body.date,
+            description: req.body.description,
+            operatorId: req.user.id,
+            quantity
+        };
+
+        await fabricClient.submitTransaction(
+            'SetHarvestQuantity',
+            JSON.stringify(recordData)
+        );
+
+        res.json({
+            message: '收获数量补录成功',
+            data: recordData
+        });
+    } catch (error) {
+        logger.error('补录收获数量失败:', error);
+        res.status(500).json({ error: error.message || '服务器内部错误' });
+    }
+});
+
 // 获取生产记录
 router.get('/:productId/production-records', auth, async (req, res) => {
     try {
@@ -231,11 +271,17 @@ router.post('/:id/logistics', [auth, checkPermission('addLogisticsInfo')], async
 // 添加质量检测信息
 router.post('/:id/quality', [auth, checkPermission('addQualityInspection')], async (req, res) => {
     try {
+        // 检测记录须引用已由实验室接收的样品
+        if (!req.body.sampleId) {
+            return res.status(400).json({ error: '请填写检测样品编号' });
+        }
+
         const result = await fabricClient.submitTransaction(
             'AddQualityRecord',
             JSON.stringify({
                 ...req.body,
                 productId: req.params.id,
+                sampleId: req.body.sampleId,
                 inspectorId: req.user.id
             })
         );
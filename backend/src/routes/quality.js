@@ -23,6 +23,10 @@ router.post('/', [auth, checkPermission('addQualityInspection')], async (req, re
             return res.status(400).json({ error: '只能对已收获的产品进行质量检测' });
         }
 
+        if (!req.body.sampleId) {
+            return res.status(400).json({ error: '请填写检测样品编号' });
+        }
+
         const recordData = {
             id: req.body.id,
             productId: req.body.productId,
@@ -30,6 +34,7 @@ router.post('/', [auth, checkPermission('addQualityInspection')], async (req, re
             testType: req.body.testType,
             result: req.body.result,
             isQualified: req.body.isQualified,
+            sampleId: req.body.sampleId,
             inspectorId: req.user.id
         };
 
@@ -51,6 +56,76 @@ router.post('/', [auth, checkPermission('addQualityInspection')], async (req, re
     }
 });
 
+// 登记采样，当前用户为采样人和初始保管人
+router.post('/samples', [auth, checkPermission('addQualityInspection')], async (req, res) => {
+    try {
+        const sampleData = {
+            id: req.body.id,
+            productId: req.body.productId,
+            samplerId: req.user.id,
+            sampledAt: req.body.sampledAt,
+            location: req.body.location,
+            sampleSize: req.body.sampleSize,
+            sampleUnit: req.body.sampleUnit,
+            sealNumber: req.body.sealNumber
+        };
+
+        await fabricClient.submitTransaction(
+            'RegisterSample',
+            JSON.stringify(sampleData)
+        );
+
+        res.status(201).json({
+            message: '样品登记成功',
+            data: sampleData
+        });
+    } catch (error) {
+        logger.error('登记样品失败:', error);
+        res.status(500).json({ error: error.message || '服务器内部错误' });
+    }
+});
+
+// 样品保管交接，当前用户须为样品当前保管人
+router.post('/samples/:sampleId/custody', [auth, checkPermission('addQualityInspection')], async (req, res) => {
+    try {
+        if (!req.body.toId || !req.body.sealNumber) {
+            return res.status(400).json({ error: '接收人和封条编号不能为空' });
+        }
+
+        await fabricClient.submitTransaction(
+            'TransferSampleCustody',
+            req.params.sampleId,
+            req.user.id,
+            req.body.toId,
+            req.body.sealNumber,
+            String(req.body.toLab === true)
+        );
+
+        res.json({
+            message: '样品交接成功',
+            sampleId: req.params.sampleId
+        });
+    } catch (error) {
+        logger.error('样品交接失败:', error);
+        res.status(500).json({ error: error.message || '服务器内部错误' });
+    }
+});
+
+// 查询样品及其保管链
+router.get('/samples/:sampleId', auth, async (req, res) => {
+    try {
+        const result = await fabricClient.evaluateTransaction(
+            'QuerySample',
+            req.params.sampleId
+        );
+
+        res.json(JSON.parse(result.toString()));
+    } catch (error) {
+        logger.error('查询样品失败:', error);
+        res.status(500).json({ error: error.message || '服务器内部错误' });
+    }
+});
+
 // 查询产品的质量检测记录
 router.get('/product/:productId', auth, async (req, res) => {
     try {
@@ -3,6 +3,9 @@ const path = require('path');
 const fs = require('fs');
 const { logger } = require('./logger');
 
+// 链码定义的物流状态
+const LOGISTICS_STATUSES = ['CREATED', 'PICKED_UP', 'IN_TRANSIT', 'AT_HUB', 'OUT_FOR_DELIVERY', 'DELIVERED', 'REJECTED', 'LOST'];
+
 class FabricClient {
     constructor() {
         this.channelName = process.env.FABRIC_CHANNEL_NAME;
@@ -147,7 +150,8 @@ class FabricClient {
                        // 检查是否是生产记录类型
                        (record.type === 'PLANTING' || 
                         record.type === 'FERTILIZING' || 
-                        record.type === 'HARVESTING');
+                        record.type === 'HARVESTING' ||
+                        record.type === 'HARVEST_QUANTITY');
                 
                 if (!isProduction) {
                     logger.debug(`Filtered out non-production record: ${JSON.stringify(record)}`);
@@ -193,7 +197,7 @@ class FabricClient {
                        'description' in record &&
                        'recordTime' in record &&
                        // 检查物流状态字段
-                       (record.status === 'IN_TRANSIT' || record.status === 'DELIVERED');
+                       LOGISTICS_STATUSES.includes(record.status);
                 
                 if (!isLogistics) {
                     logger.debug(`Filtered out non-logistics record: ${JSON.stringify(record)}`);
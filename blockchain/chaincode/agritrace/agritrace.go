@@ -1,9 +1,20 @@
 package main
 
 import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/pem"
+	"errors"
 	"fmt"
+	"math"
 	"sort"
+	"strconv"
 	"strings"
 	"time"
 
@@ -27,27 +38,244 @@ type Product struct {
 	Location     string    `json:"location"`     // 种植地点
 	CreatedAt    time.Time `json:"createdAt"`    // 创建时间
 	UpdatedAt    time.Time `json:"updatedAt"`    // 更新时间
+
+	QualityHold       bool   `json:"qualityHold"`       // 是否处于质量冻结（存在不合格检测或申诉未决）
+	QualityHoldReason string `json:"qualityHoldReason"` // 质量冻结原因
+
+	StorageMinTemp float64 `json:"storageMinTemp"` // 储运温度下限（°C），上下限均为0表示未设置
+	StorageMaxTemp float64 `json:"storageMaxTemp"` // 储运温度上限（°C）
+
+	RemainingShelfLifeHours float64   `json:"remainingShelfLifeHours"` // 最近一次估算的剩余保质期（小时）
+	ShelfLifeFlagged        bool      `json:"shelfLifeFlagged"`        // 剩余保质期是否低于预警阈值
+	ShelfLifeUpdatedAt      time.Time `json:"shelfLifeUpdatedAt"`      // 最近一次估算时间
+
+	ExpiryDate time.Time `json:"expiryDate"` // 批次到期时间，新建零售库存未指定到期时间时沿用
+
+	HarvestQuantity int `json:"harvestQuantity"` // 累计收获数量，收获时计入农户持有数量
+}
+
+// ShelfLifeModel 作物保质期模型（Q10 温度系数模型）
+type ShelfLifeModel struct {
+	ID                      string    `json:"id"`                      // 模型ID
+	Crop                    string    `json:"crop"`                    // 作物名称（与产品名称对应）
+	ReferenceTemp           float64   `json:"referenceTemp"`           // 参考温度（°C）
+	ReferenceShelfLifeHours float64   `json:"referenceShelfLifeHours"` // 参考温度下的保质期（小时）
+	Q10                     float64   `json:"q10"`                     // 温度每升高10°C品质劣变速率的倍数
+	FlagThresholdHours      float64   `json:"flagThresholdHours"`      // 剩余保质期预警阈值（小时）
+	UpdatedAt               time.Time `json:"updatedAt"`               // 更新时间
+}
+
+// ShelfLifeEstimate 剩余保质期估算结果
+type ShelfLifeEstimate struct {
+	ProductID         string    `json:"productId"`         // 产品ID
+	Crop              string    `json:"crop"`              // 作物名称
+	StartTime         time.Time `json:"startTime"`         // 计算起点（收获时间）
+	ConsumedHours     float64   `json:"consumedHours"`     // 已消耗的参考温度等效保质期（小时）
+	RemainingHours    float64   `json:"remainingHours"`    // 剩余保质期（按最近温度估算，小时）
+	RemainingFraction float64   `json:"remainingFraction"` // 剩余保质期占比
+	EstimatedExpiry   time.Time `json:"estimatedExpiry"`   // 预计到期时间
+	Flagged           bool      `json:"flagged"`           // 是否低于预警阈值
+	ReadingCount      int       `json:"readingCount"`      // 参与计算的温度读数条数
+	CalculatedAt      time.Time `json:"calculatedAt"`      // 计算时间
+}
+
+// FEFORecommendation 零售商先到期先出的出货建议
+type FEFORecommendation struct {
+	InventoryID     string    `json:"inventoryId"`     // 库存记录ID
+	ProductID       string    `json:"productId"`       // 产品ID
+	Quantity        int       `json:"quantity"`        // 库存数量
+	RemainingHours  float64   `json:"remainingHours"`  // 剩余保质期（小时）
+	EstimatedExpiry time.Time `json:"estimatedExpiry"` // 预计到期时间
+	Flagged         bool      `json:"flagged"`         // 是否低于预警阈值
 }
 
 // ProductionRecord 定义生产记录结构
 type ProductionRecord struct {
-	ID          string    `json:"id"`          // 记录ID
-	ProductID   string    `json:"productId"`   // 产品ID
-	Type        string    `json:"type"`        // 记录类型：PLANTING（播种）, FERTILIZING（施肥）, HARVESTING（收获）
-	Date        string    `json:"date"`        // 操作日期
-	Description string    `json:"description"` // 操作描述
-	OperatorID  string    `json:"operatorId"`  // 操作人ID
-	CreatedAt   time.Time `json:"createdAt"`   // 创建时间
+	ID          string    `json:"id"`                 // 记录ID
+	ProductID   string    `json:"productId"`          // 产品ID
+	Type        string    `json:"type"`               // 记录类型：PLANTING（播种）, FERTILIZING（施肥）, HARVESTING（收获）, HARVEST_QUANTITY（补录收获数量）
+	Date        string    `json:"date"`               // 操作日期
+	Description string    `json:"description"`        // 操作描述
+	OperatorID  string    `json:"operatorId"`         // 操作人ID
+	CreatedAt   time.Time `json:"createdAt"`          // 创建时间
+	Quantity    int       `json:"quantity,omitempty"` // 收获数量，仅收获记录填写
 }
 
 // EnvironmentRecord 环境记录结构
 type EnvironmentRecord struct {
 	ID          string    `json:"id"`          // 记录ID
 	ProductID   string    `json:"productId"`   // 产品ID
-	Temperature float64   `json:"temperature"` // 温度
-	Humidity    float64   `json:"humidity"`   // 湿度
-	RecordTime  time.Time `json:"recordTime"`  // 记录时间
-	OperatorID  string    `json:"operatorId"`  // 记录人ID
+	Temperature float64   `json:"temperature,omitempty"` // 温度，记录未采集温度时不写出
+	Humidity    float64   `json:"humidity,omitempty"`    // 湿度，记录未采集湿度时不写出
+	RecordTime  time.Time `json:"recordTime"`            // 记录时间
+	OperatorID  string    `json:"operatorId"`            // 记录人ID
+
+	Metrics   []SensorMetric     `json:"metrics,omitempty"`   // 传感器指标读数（温度、湿度同时保留在上方字段中）
+	Alerts    []EnvironmentAlert `json:"alerts,omitempty"`    // 超出阈值的告警
+	DeviceID  string             `json:"deviceId,omitempty"`  // 采集设备ID
+	Signature string             `json:"signature,omitempty"` // 设备对读数的签名（Base64）
+}
+
+// hasMetric 判断记录是否包含指定指标的读数，旧格式记录视为包含温度、湿度
+func (record *EnvironmentRecord) hasMetric(metric string) bool {
+	if len(record.Metrics) == 0 {
+		return metric == "temperature" || metric == "humidity"
+	}
+	for _, m := range record.Metrics {
+		if m.Metric == metric {
+			return true
+		}
+	}
+	return false
+}
+
+// MarshalJSON 只在记录包含温度、湿度读数时写出旧字段（读数为 0 也写出），避免旧版读取方把缺失的读数当作 0
+func (record EnvironmentRecord) MarshalJSON() ([]byte, error) {
+	type plain EnvironmentRecord
+	legacy := struct {
+		plain
+		Temperature *float64 `json:"temperature,omitempty"`
+		Humidity    *float64 `json:"humidity,omitempty"`
+	}{plain: plain(record)}
+	if record.hasMetric("temperature") {
+		legacy.Temperature = &record.Temperature
+	}
+	if record.hasMetric("humidity") {
+		legacy.Humidity = &record.Humidity
+	}
+
+	return json.Marshal(legacy)
+}
+
+// Device 传感器设备结构
+type Device struct {
+	ID           string    `json:"id"`           // 设备ID
+	PublicKey    string    `json:"publicKey"`    // 设备公钥（PEM 格式的 ECDSA/Ed25519 公钥，或 Base64 编码的 Ed25519 原始公钥）
+	OwnerID      string    `json:"ownerId"`      // 设备所有者ID
+	ProductID    string    `json:"productId"`    // 分配的产品ID
+	Plot         string    `json:"plot"`         // 分配的地块
+	Status       string    `json:"status"`       // 状态：ACTIVE（启用）, SUSPENDED（停用）, RETIRED（报废）
+	RegisteredAt time.Time `json:"registeredAt"` // 登记时间
+	UpdatedAt    time.Time `json:"updatedAt"`    // 更新时间
+}
+
+// SensorMetric 传感器指标读数
+type SensorMetric struct {
+	Metric string  `json:"metric"` // 指标名称，如 temperature, humidity, soil_moisture, soil_ph, ec, light_intensity, co2, rainfall
+	Value  float64 `json:"value"`  // 读数
+	Unit   string  `json:"unit"`   // 单位
+}
+
+// EnvironmentBucket 按产品、小时分桶存储的批量环境读数
+type EnvironmentBucket struct {
+	ID        string               `json:"id"`        // 数据桶ID：ENVBUCKET_<产品ID>_<yyyyMMddHH>
+	ProductID string               `json:"productId"` // 产品ID
+	Hour      time.Time            `json:"hour"`      // 小时起始时间（UTC）
+	Readings  []EnvironmentReading `json:"readings"`  // 读数
+	UpdatedAt time.Time            `json:"updatedAt"` // 更新时间
+}
+
+// EnvironmentReading 数据桶中的单条读数
+type EnvironmentReading struct {
+	ID         string             `json:"id"`               // 读数ID
+	RecordTime time.Time          `json:"recordTime"`       // 采集时间
+	OperatorID string             `json:"operatorId"`       // 上报人（网关）ID
+	Metrics    []SensorMetric     `json:"metrics"`          // 指标读数
+	Alerts     []EnvironmentAlert `json:"alerts,omitempty"` // 超出阈值的告警
+	DeviceID   string             `json:"deviceId"`         // 采集设备ID
+	Signature  string             `json:"signature"`        // 设备签名
+}
+
+// EnvironmentBatch 批量环境数据上报
+type EnvironmentBatch struct {
+	BatchID  string              `json:"batchId"`  // 批次ID
+	Readings []EnvironmentRecord `json:"readings"` // 读数，格式与 AddEnvironmentRecord 相同
+}
+
+// BatchIngestionResult 批量上报处理结果
+type BatchIngestionResult struct {
+	BatchID  string          `json:"batchId"`  // 批次ID
+	Accepted int             `json:"accepted"` // 接收条数
+	Rejected int             `json:"rejected"` // 拒绝条数
+	Alerts   int             `json:"alerts"`   // 告警条数
+	Results  []ReadingResult `json:"results"`  // 逐条处理结果
+}
+
+// ReadingResult 单条读数的处理结果
+type ReadingResult struct {
+	ReadingID string             `json:"readingId"`        // 读数ID
+	ProductID string             `json:"productId"`        // 产品ID
+	Accepted  bool               `json:"accepted"`         // 是否接收
+	Error     string             `json:"error,omitempty"`  // 拒绝原因
+	BucketID  string             `json:"bucketId"`         // 存储的数据桶ID
+	Alerts    []EnvironmentAlert `json:"alerts,omitempty"` // 超出阈值的告警
+}
+
+// EnvironmentDailySummary 产品每日环境指标汇总，随读数写入增量维护
+type EnvironmentDailySummary struct {
+	ID        string            `json:"id"`        // 汇总ID：ENVDAILY_<产品ID>_<yyyyMMdd>
+	ProductID string            `json:"productId"` // 产品ID
+	Date      string            `json:"date"`      // 日期（UTC，yyyy-MM-dd）
+	Metrics   []MetricAggregate `json:"metrics"`   // 各指标汇总
+	UpdatedAt time.Time         `json:"updatedAt"` // 更新时间
+}
+
+// MetricAggregate 单个指标的汇总值
+type MetricAggregate struct {
+	Metric string  `json:"metric"` // 指标名称
+	Unit   string  `json:"unit"`   // 单位
+	Count  int     `json:"count"`  // 读数条数
+	Min    float64 `json:"min"`    // 最小值
+	Max    float64 `json:"max"`    // 最大值
+	Sum    float64 `json:"sum"`    // 合计，用于合并时计算均值
+	Mean   float64 `json:"mean"`   // 均值
+}
+
+// EnvironmentSummary 按时间粒度汇总的环境指标
+type EnvironmentSummary struct {
+	ProductID   string            `json:"productId"`   // 产品ID
+	PeriodStart string            `json:"periodStart"` // 时段开始日期（yyyy-MM-dd）
+	PeriodEnd   string            `json:"periodEnd"`   // 时段结束日期（yyyy-MM-dd）
+	Metrics     []MetricAggregate `json:"metrics"`     // 各指标汇总
+}
+
+// EnvironmentAlert 环境数据超出阈值告警
+type EnvironmentAlert struct {
+	Metric string  `json:"metric"` // 指标名称
+	Value  float64 `json:"value"`  // 实测值
+	Unit   string  `json:"unit"`   // 单位
+	Min    float64 `json:"min"`    // 阈值下限
+	Max    float64 `json:"max"`    // 阈值上限
+}
+
+// MetricLimit 单个指标的阈值范围
+type MetricLimit struct {
+	Metric string  `json:"metric"` // 指标名称
+	Min    float64 `json:"min"`    // 阈值下限
+	Max    float64 `json:"max"`    // 阈值上限
+}
+
+// MetricReading 单个指标的历史读数
+type MetricReading struct {
+	RecordID   string    `json:"recordId"`   // 环境记录ID
+	Value      float64   `json:"value"`      // 读数
+	Unit       string    `json:"unit"`       // 单位
+	RecordTime time.Time `json:"recordTime"` // 记录时间
+	IsAlert    bool      `json:"isAlert"`    // 是否超出阈值
+}
+
+// EnvironmentThreshold 环境阈值配置，可按作物或单个产品设置
+type EnvironmentThreshold struct {
+	ID             string    `json:"id"`             // 阈值配置ID
+	Crop           string    `json:"crop"`           // 作物名称（与产品名称对应）
+	ProductID      string    `json:"productId"`      // 产品ID（设置时优先于作物配置）
+	MinTemperature float64   `json:"minTemperature"` // 温度下限
+	MaxTemperature float64   `json:"maxTemperature"` // 温度上限
+	MinHumidity    float64   `json:"minHumidity"`    // 湿度下限
+	MaxHumidity    float64   `json:"maxHumidity"`    // 湿度上限
+	UpdatedAt      time.Time `json:"updatedAt"`      // 更新时间
+
+	Limits []MetricLimit `json:"limits"` // 按指标设置的阈值（温度、湿度与上方字段保持一致）
 }
 
 // QualityRecord 质量检测记录
@@ -60,6 +288,11 @@ type QualityRecord struct {
 	IsQualified bool      `json:"isQualified"` // 是否合格
 	RecordTime  time.Time `json:"recordTime"`  // 记录时间
 	InspectorID string    `json:"inspectorId"` // 检测员ID
+
+	SampleID       string `json:"sampleId"`                 // 检测样品ID
+	AppealID       string `json:"appealId,omitempty"`       // 复检所属申诉ID
+	ReinspectionOf string `json:"reinspectionOf,omitempty"` // 复检针对的原检测记录ID
+	SupersededBy   string `json:"supersededBy,omitempty"`   // 申诉改判后取代本记录的复检记录ID
 }
 
 // LogisticsRecord 物流记录结构
@@ -67,10 +300,399 @@ type LogisticsRecord struct {
 	ID          string    `json:"id"`          // 记录ID
 	ProductID   string    `json:"productId"`   // 产品ID
 	Location    string    `json:"location"`    // 当前位置
-	Status      string    `json:"status"`      // 运输状态：IN_TRANSIT（运输中）, DELIVERED（已送达）
+	Status      string    `json:"status"`      // 运输状态，取值见 shipmentTransitions
 	Description string    `json:"description"` // 物流描述
 	OperatorID  string    `json:"operatorId"`  // 操作人ID
 	RecordTime  time.Time `json:"recordTime"`  // 记录时间
+
+	TemperatureReadings []TemperatureReading   `json:"temperatureReadings,omitempty"` // 温度记录仪读数
+	Excursions          []TemperatureExcursion `json:"excursions,omitempty"`          // 温度超限记录
+	History             []Checkpoint           `json:"history,omitempty"`             // 历次状态更新，只追加不修改
+	ShipperID           string                 `json:"shipperId,omitempty"`           // 发货方ID，送达时由其向收货方移交，未填写时为产品所属农户
+	ReceiverID          string                 `json:"receiverId,omitempty"`          // 收货方ID，送达时向其发起交接
+	Quantity            int                    `json:"quantity,omitempty"`            // 运输数量
+	StoreID             string                 `json:"storeId,omitempty"`             // 收货门店ID，收货方为零售商时入库到该门店
+	LotID               string                 `json:"lotId,omitempty"`               // 批次号，收货方为零售商时入库到该批次号的库存
+	Latitude            float64                `json:"latitude,omitempty"`            // 当前位置纬度，未上报坐标时不写出
+	Longitude           float64                `json:"longitude,omitempty"`           // 当前位置经度
+	Located             bool                   `json:"-"`                             // 是否上报了当前位置坐标，按数据中是否出现经纬度判断
+}
+
+// MarshalJSON 只在上报了坐标时写出经纬度（坐标为 0, 0 也写出）
+func (record LogisticsRecord) MarshalJSON() ([]byte, error) {
+	type plain LogisticsRecord
+	located := struct {
+		plain
+		Latitude  *float64 `json:"latitude,omitempty"`
+		Longitude *float64 `json:"longitude,omitempty"`
+	}{plain: plain(record)}
+	if record.Located {
+		located.Latitude = &record.Latitude
+		located.Longitude = &record.Longitude
+	}
+
+	return json.Marshal(located)
+}
+
+// UnmarshalJSON 数据中出现纬度或经度即视为上报了坐标
+func (record *LogisticsRecord) UnmarshalJSON(data []byte) error {
+	type plain LogisticsRecord
+	var located struct {
+		plain
+		Latitude  *float64 `json:"latitude"`
+		Longitude *float64 `json:"longitude"`
+	}
+	err := json.Unmarshal(data, &located)
+	if err != nil {
+		return err
+	}
+
+	*record = LogisticsRecord(located.plain)
+	record.Latitude, record.Longitude, record.Located = readCoordinates(located.Latitude, located.Longitude)
+	return nil
+}
+
+// Shipment 运输单结构
+type Shipment struct {
+	ID          string         `json:"id"`          // 运输单ID
+	Origin      string         `json:"origin"`      // 起运地
+	Destination string         `json:"destination"` // 目的地
+	CarrierID   string         `json:"carrierId"`   // 承运物流商ID
+	ShipperID   string         `json:"shipperId"`   // 发货方ID
+	ReceiverID  string         `json:"receiverId"`  // 收货方ID
+	Items       []ShipmentItem `json:"items"`       // 运输的批次及数量
+	Status      string         `json:"status"`      // 当前状态（最新节点的状态），取值见 shipmentTransitions
+	Checkpoints []Checkpoint   `json:"checkpoints"` // 运输节点，只追加不修改
+	CreatedAt   time.Time      `json:"createdAt"`   // 创建时间
+	UpdatedAt   time.Time      `json:"updatedAt"`   // 更新时间
+
+	PlannedRoute   []Waypoint `json:"plannedRoute,omitempty"` // 计划路线途经点
+	ETA            time.Time  `json:"eta"`                    // 预计送达时间
+	MaxDeviationKm float64    `json:"maxDeviationKm"`         // 允许偏离计划路线的距离（公里）
+	DistanceKm     float64    `json:"distanceKm"`             // 已行驶距离（公里），按带坐标的节点累计
+	DeviationKm    float64    `json:"deviationKm"`            // 节点偏离计划路线的最大距离（公里）
+	Deviated       bool       `json:"deviated"`               // 是否偏离计划路线
+	Delayed        bool       `json:"delayed"`                // 是否超过预计送达时间
+	StoreID        string     `json:"storeId,omitempty"`      // 收货门店ID，收货方为零售商时入库到该门店
+}
+
+// Waypoint 计划路线途经点
+type Waypoint struct {
+	Name      string  `json:"name"`      // 途经点名称
+	Latitude  float64 `json:"latitude"`  // 纬度
+	Longitude float64 `json:"longitude"` // 经度
+}
+
+// ShipmentPlan 运输计划，用于更新计划路线和预计送达时间
+type ShipmentPlan struct {
+	PlannedRoute   []Waypoint `json:"plannedRoute"`   // 计划路线途经点
+	ETA            time.Time  `json:"eta"`            // 预计送达时间
+	MaxDeviationKm float64    `json:"maxDeviationKm"` // 允许偏离计划路线的距离（公里），为0时使用默认值
+}
+
+// ShipmentItem 运输单中的批次及数量
+type ShipmentItem struct {
+	ProductID string `json:"productId"`       // 产品（批次）ID
+	Quantity  int    `json:"quantity"`        // 数量
+	LotID     string `json:"lotId,omitempty"` // 批次号，收货方为零售商时入库到该批次号的库存
+}
+
+// Checkpoint 运输节点记录
+type Checkpoint struct {
+	Sequence    int       `json:"sequence"`    // 节点序号，从1开始
+	Location    string    `json:"location"`    // 节点位置
+	Status      string    `json:"status"`      // 节点状态
+	Description string    `json:"description"` // 节点描述
+	OperatorID  string    `json:"operatorId"`  // 操作人ID
+	RecordTime  time.Time `json:"recordTime"`  // 记录时间
+
+	Latitude  float64 `json:"latitude,omitempty"`  // 纬度，未上报坐标时不写出
+	Longitude float64 `json:"longitude,omitempty"` // 经度
+	Located   bool    `json:"-"`                   // 是否上报了坐标，按数据中是否出现经纬度判断
+}
+
+// MarshalJSON 只在节点上报了坐标时写出经纬度（坐标为 0, 0 也写出）
+func (checkpoint Checkpoint) MarshalJSON() ([]byte, error) {
+	type plain Checkpoint
+	located := struct {
+		plain
+		Latitude  *float64 `json:"latitude,omitempty"`
+		Longitude *float64 `json:"longitude,omitempty"`
+	}{plain: plain(checkpoint)}
+	if checkpoint.Located {
+		located.Latitude = &checkpoint.Latitude
+		located.Longitude = &checkpoint.Longitude
+	}
+
+	return json.Marshal(located)
+}
+
+// UnmarshalJSON 数据中出现纬度或经度即视为上报了坐标
+func (checkpoint *Checkpoint) UnmarshalJSON(data []byte) error {
+	type plain Checkpoint
+	var located struct {
+		plain
+		Latitude  *float64 `json:"latitude"`
+		Longitude *float64 `json:"longitude"`
+	}
+	err := json.Unmarshal(data, &located)
+	if err != nil {
+		return err
+	}
+
+	*checkpoint = Checkpoint(located.plain)
+	checkpoint.Latitude, checkpoint.Longitude, checkpoint.Located = readCoordinates(located.Latitude, located.Longitude)
+	return nil
+}
+
+// readCoordinates 读取可选的经纬度，只出现其一时另一项按 0 处理，兼容只写出非零坐标的旧记录
+func readCoordinates(latitude *float64, longitude *float64) (float64, float64, bool) {
+	var lat, lon float64
+	if latitude != nil {
+		lat = *latitude
+	}
+	if longitude != nil {
+		lon = *longitude
+	}
+	return lat, lon, latitude != nil || longitude != nil
+}
+
+// LotTransfer 批次保管权交接单，发起后需接收方确认
+type LotTransfer struct {
+	ID          string         `json:"id"`          // 交接单ID
+	ShipmentID  string         `json:"shipmentId"`  // 关联运输单ID（可选）
+	SenderID    string         `json:"senderId"`    // 移交方ID
+	ReceiverID  string         `json:"receiverId"`  // 接收方ID
+	Items       []TransferItem `json:"items"`       // 交接的批次及数量
+	Status      string         `json:"status"`      // 状态：PENDING（待确认）, ACCEPTED（已接收）, REJECTED（已拒收）
+	Note        string         `json:"note"`        // 移交说明
+	Reason      string         `json:"reason"`      // 拒收原因
+	InitiatedAt time.Time      `json:"initiatedAt"` // 发起时间
+	RespondedAt time.Time      `json:"respondedAt"` // 确认时间
+
+	StoreID           string `json:"storeId,omitempty"`           // 收货门店ID，接收方为零售商时入库到该门店
+	LogisticsRecordID string `json:"logisticsRecordId,omitempty"` // 关联物流记录ID，物流记录送达时发起的交接填写
+}
+
+// TransferItem 交接单中的批次
+type TransferItem struct {
+	ProductID        string `json:"productId"`        // 产品（批次）ID
+	Quantity         int    `json:"quantity"`         // 移交数量
+	AcceptedQuantity int    `json:"acceptedQuantity"` // 实收数量
+	Discrepancy      string `json:"discrepancy"`      // 差异说明
+	LotID            string `json:"lotId,omitempty"`  // 批次号，接收方为零售商时入库到该批次号的库存
+}
+
+// StockMovement 零售库存变动记录
+type StockMovement struct {
+	ID          string    `json:"id"`          // 变动记录ID
+	InventoryID string    `json:"inventoryId"` // 库存记录ID
+	RetailerID  string    `json:"retailerId"`  // 零售商ID
+	ProductID   string    `json:"productId"`   // 产品（批次）ID
+	Sequence    int       `json:"sequence"`    // 同一库存记录内的变动序号，从1开始
+	Type        string    `json:"type"`        // 变动类型，取值见 stockMovementSigns
+	Quantity    int       `json:"quantity"`    // 变动数量，入库为正、出库为负
+	Balance     int       `json:"balance"`     // 变动后库存
+	Reason      string    `json:"reason"`      // 变动原因
+	ReasonCode  string    `json:"reasonCode"`  // 原因代码，取值见 adjustmentReasonCodes
+	Reference   string    `json:"reference"`   // 关联单据ID（销售记录、交接单、盘点单等）
+	TransferID  string    `json:"transferId"`  // 关联交接单ID
+	ShipmentID  string    `json:"shipmentId"`  // 关联运输单ID，物流记录送达的交接为物流记录ID
+	RecordTime  time.Time `json:"recordTime"`  // 记录时间
+}
+
+// ShipmentClaim 运输索赔，记录收货时发现的短少、损坏和变质
+type ShipmentClaim struct {
+	ID              string      `json:"id"`              // 索赔ID
+	ShipmentID      string      `json:"shipmentId"`      // 运输单ID
+	CarrierID       string      `json:"carrierId"`       // 承运物流商ID
+	ClaimantID      string      `json:"claimantId"`      // 索赔方ID
+	Type            string      `json:"type"`            // 索赔类型：SHORTAGE（短少）, DAMAGE（损坏）, SPOILAGE（变质）
+	Items           []ClaimItem `json:"items"`           // 索赔批次及数量
+	EvidenceHashes  []string    `json:"evidenceHashes"`  // 证据文件的SHA-256哈希
+	Description     string      `json:"description"`     // 索赔说明
+	Status          string      `json:"status"`          // 状态：FILED（已提交）, ACCEPTED（承运方认可）, DISPUTED（承运方异议）, SETTLED（已结案）
+	CarrierResponse string      `json:"carrierResponse"` // 承运方答复
+	Outcome         string      `json:"outcome"`         // 结案结果：COMPENSATED（全额赔付）, PARTIAL（部分赔付）, DENIED（驳回）
+	SettledAmount   float64     `json:"settledAmount"`   // 赔付金额
+	SettlementNote  string      `json:"settlementNote"`  // 结案说明
+	FiledAt         time.Time   `json:"filedAt"`         // 提交时间
+	RespondedAt     time.Time   `json:"respondedAt"`     // 答复时间
+	SettledAt       time.Time   `json:"settledAt"`       // 结案时间
+}
+
+// ClaimItem 索赔的批次及数量
+type ClaimItem struct {
+	ProductID string `json:"productId"` // 产品（批次）ID
+	Quantity  int    `json:"quantity"`  // 损失数量
+}
+
+// MassBalance 批次运输物料平衡，未解释数量为发运数量减去各去向后的差额
+type MassBalance struct {
+	ProductID      string `json:"productId"`      // 产品（批次）ID
+	Shipped        int    `json:"shipped"`        // 发运数量
+	InTransit      int    `json:"inTransit"`      // 在途数量
+	PendingReceipt int    `json:"pendingReceipt"` // 已送达待收货确认数量
+	Received       int    `json:"received"`       // 实收数量
+	Rejected       int    `json:"rejected"`       // 拒收数量
+	Lost           int    `json:"lost"`           // 承运方认可或结案赔付的索赔损失数量
+	Unaccounted    int    `json:"unaccounted"`    // 未解释数量
+}
+
+// CarrierPerformance 承运方绩效统计
+type CarrierPerformance struct {
+	CarrierID       string  `json:"carrierId"`       // 承运物流商ID
+	Shipments       int     `json:"shipments"`       // 运输单数
+	Delivered       int     `json:"delivered"`       // 送达单数
+	Rejected        int     `json:"rejected"`        // 拒收单数
+	Lost            int     `json:"lost"`            // 丢失单数
+	ShippedQuantity int     `json:"shippedQuantity"` // 承运数量
+	Claims          int     `json:"claims"`          // 索赔数
+	LostQuantity    int     `json:"lostQuantity"`    // 索赔确认的损失数量
+	LossRate        float64 `json:"lossRate"`        // 损失率（损失数量/承运数量）
+	SettledAmount   float64 `json:"settledAmount"`   // 累计赔付金额
+}
+
+// StockReservation 库存预留，下单后至付款前锁定库存
+type StockReservation struct {
+	ID          string    `json:"id"`          // 预留ID
+	InventoryID string    `json:"inventoryId"` // 库存记录ID
+	RetailerID  string    `json:"retailerId"`  // 零售商ID
+	ProductID   string    `json:"productId"`   // 产品ID
+	LotID       string    `json:"lotId"`       // 批次号
+	StoreID     string    `json:"storeId"`     // 门店ID
+	ConsumerID  string    `json:"consumerId"`  // 消费者ID
+	Quantity    int       `json:"quantity"`    // 预留数量
+	Status      string    `json:"status"`      // 状态：ACTIVE（预留中）, CONFIRMED（已成交）, RELEASED（已释放）, EXPIRED（已过期）
+	ExpiresAt   time.Time `json:"expiresAt"`   // 过期时间
+	PurchaseID  string    `json:"purchaseId"`  // 成交后的购买记录ID
+	CreatedAt   time.Time `json:"createdAt"`   // 创建时间
+	ClosedAt    time.Time `json:"closedAt"`    // 成交、释放或过期时间
+}
+
+// ReplenishmentRequest 零售商向农户或合作社发起的补货申请
+type ReplenishmentRequest struct {
+	ID                string    `json:"id"`                // 补货申请ID
+	RetailerID        string    `json:"retailerId"`        // 零售商ID
+	SupplierID        string    `json:"supplierId"`        // 供货方ID（农户、合作社或仓库）
+	ProductID         string    `json:"productId"`         // 产品ID
+	Quantity          int       `json:"quantity"`          // 申请数量
+	Status            string    `json:"status"`            // 状态：REQUESTED（已申请）, ACKNOWLEDGED（已确认）, DECLINED（已拒绝）, SHIPPED（已发货）, FULFILLED（已完成）, CANCELLED（已取消）
+	Note              string    `json:"note"`              // 申请说明
+	SupplierNote      string    `json:"supplierNote"`      // 供货方答复
+	ShipmentID        string    `json:"shipmentId"`        // 发货运输单ID
+	FulfilledQuantity int       `json:"fulfilledQuantity"` // 实收数量
+	CreatedAt         time.Time `json:"createdAt"`         // 申请时间
+	UpdatedAt         time.Time `json:"updatedAt"`         // 更新时间
+}
+
+// Stocktake 零售商盘点单
+type Stocktake struct {
+	ID          string          `json:"id"`          // 盘点单ID
+	RetailerID  string          `json:"retailerId"`  // 零售商ID
+	CountedBy   string          `json:"countedBy"`   // 盘点人
+	Lines       []StocktakeLine `json:"lines"`       // 盘点明细
+	SubmittedAt time.Time       `json:"submittedAt"` // 提交时间
+}
+
+// StocktakeLine 盘点明细，差异为实盘数量减去账面数量
+type StocktakeLine struct {
+	InventoryID     string `json:"inventoryId"`     // 库存记录ID
+	ProductID       string `json:"productId"`       // 产品ID
+	BookQuantity    int    `json:"bookQuantity"`    // 账面数量
+	CountedQuantity int    `json:"countedQuantity"` // 实盘数量
+	Variance        int    `json:"variance"`        // 差异数量
+	ReasonCode      string `json:"reasonCode"`      // 差异原因代码，有差异时必填
+	Note            string `json:"note"`            // 备注
+}
+
+// ShrinkageEntry 按产品和月份汇总的损耗
+type ShrinkageEntry struct {
+	ProductID string         `json:"productId"` // 产品ID
+	Period    string         `json:"period"`    // 月份（yyyy-MM）
+	Quantity  int            `json:"quantity"`  // 损耗数量合计
+	ByReason  map[string]int `json:"byReason"`  // 按原因代码的损耗数量
+}
+
+// Warehouse 仓储设施（合作社仓库、冷库等）
+type Warehouse struct {
+	ID             string    `json:"id"`             // 仓库ID
+	Name           string    `json:"name"`           // 仓库名称
+	Type           string    `json:"type"`           // 类型：WAREHOUSE（常温仓库）, COLD_STORE（冷库）
+	Location       string    `json:"location"`       // 地址
+	Latitude       float64   `json:"latitude"`       // 纬度
+	Longitude      float64   `json:"longitude"`      // 经度
+	OperatorID     string    `json:"operatorId"`     // 运营方ID
+	MinTemperature float64   `json:"minTemperature"` // 存储温度下限（°C）
+	MaxTemperature float64   `json:"maxTemperature"` // 存储温度上限（°C）
+	MinHumidity    float64   `json:"minHumidity"`    // 存储湿度下限（%）
+	MaxHumidity    float64   `json:"maxHumidity"`    // 存储湿度上限（%）
+	CreatedAt      time.Time `json:"createdAt"`      // 登记时间
+}
+
+// WarehouseMovement 仓库出入库记录，由保管权交接确认时自动生成
+type WarehouseMovement struct {
+	ID               string    `json:"id"`               // 出入库记录ID
+	WarehouseID      string    `json:"warehouseId"`      // 仓库ID
+	ProductID        string    `json:"productId"`        // 产品（批次）ID
+	Direction        string    `json:"direction"`        // 方向：INBOUND（入库）, OUTBOUND（出库）
+	Quantity         int       `json:"quantity"`         // 数量
+	Balance          int       `json:"balance"`          // 出入库后该批次在库数量
+	TransferID       string    `json:"transferId"`       // 关联交接单ID
+	ConditionWarning string    `json:"conditionWarning"` // 仓库存储条件与产品要求不符时的提示
+	RecordTime       time.Time `json:"recordTime"`       // 记录时间
+}
+
+// WarehouseStay 批次在仓库的一次停留，从在库数量由0变为正数开始，到再次清零结束
+type WarehouseStay struct {
+	WarehouseID   string    `json:"warehouseId"`   // 仓库ID
+	ProductID     string    `json:"productId"`     // 产品（批次）ID
+	InboundAt     time.Time `json:"inboundAt"`     // 首次入库时间
+	OutboundAt    time.Time `json:"outboundAt"`    // 最后出库时间，仍在库时为空
+	InQuantity    int       `json:"inQuantity"`    // 入库数量
+	OutQuantity   int       `json:"outQuantity"`   // 出库数量
+	DurationHours float64   `json:"durationHours"` // 存储时长（小时），仍在库时计算到当前时间
+	InStorage     bool      `json:"inStorage"`     // 是否仍在库
+}
+
+// CustodyHolding 非零售方持有的批次数量（零售商以零售库存计，农户的持有数量来自收获记录）
+type CustodyHolding struct {
+	ID        string    `json:"id"`        // 持有记录ID
+	ProductID string    `json:"productId"` // 产品（批次）ID
+	HolderID  string    `json:"holderId"`  // 持有方ID
+	Quantity  int       `json:"quantity"`  // 持有数量
+	UpdatedAt time.Time `json:"updatedAt"` // 更新时间
+}
+
+// RouteHop 追溯信息中按时间排列的运输节点
+type RouteHop struct {
+	Source      string    `json:"source"`      // 来源：SHIPMENT（运输单）, LOGISTICS（物流记录）
+	RefID       string    `json:"refId"`       // 运输单或物流记录ID
+	Sequence    int       `json:"sequence"`    // 节点序号
+	Location    string    `json:"location"`    // 节点位置
+	Status      string    `json:"status"`      // 节点状态
+	Description string    `json:"description"` // 节点描述
+	OperatorID  string    `json:"operatorId"`  // 操作人ID
+	RecordTime  time.Time `json:"recordTime"`  // 记录时间
+}
+
+// TemperatureReading 运输途中的温度记录仪读数
+type TemperatureReading struct {
+	LoggerID    string    `json:"loggerId"`    // 温度记录仪ID
+	Time        time.Time `json:"time"`        // 读数时间
+	Temperature float64   `json:"temperature"` // 温度（°C）
+}
+
+// TemperatureExcursion 温度超出储运范围的时段
+type TemperatureExcursion struct {
+	RecordID        string    `json:"recordId"`        // 物流记录ID
+	Type            string    `json:"type"`            // 类型：ABOVE（高于上限）, BELOW（低于下限）
+	Limit           float64   `json:"limit"`           // 超出的限值
+	StartTime       time.Time `json:"startTime"`       // 开始时间
+	EndTime         time.Time `json:"endTime"`         // 结束时间（恢复正常的读数时间，未恢复时为最后一次读数时间）
+	DurationMinutes float64   `json:"durationMinutes"` // 持续时长（分钟）
+	PeakTemperature float64   `json:"peakTemperature"` // 峰值温度
+	Resolved        bool      `json:"resolved"`        // 是否已恢复到范围内
 }
 
 // RetailInventory 零售库存结构
@@ -81,6 +703,14 @@ type RetailInventory struct {
 	Quantity    int       `json:"quantity"`    // 库存数量
 	MinQuantity int       `json:"minQuantity"` // 最小库存预警
 	UpdatedAt   time.Time `json:"updatedAt"`   // 更新时间
+
+	MovementSeq int    `json:"movementSeq"` // 最近一次库存变动的序号，库存数量由变动记录累计得出
+	LotID       string `json:"lotId"`       // 批次号（可选），同一零售商、门店、产品、批次号只有一条库存记录
+	StoreID     string `json:"storeId"`     // 门店ID，空表示零售商本部
+
+	LowStock      bool      `json:"lowStock"`      // 是否处于低库存预警
+	LowStockSince time.Time `json:"lowStockSince"` // 进入低库存预警的时间
+	ExpiryDate    time.Time `json:"expiryDate"`    // 到期时间，为空表示未设置，到期后不可销售
 }
 
 // SalesRecord 销售记录结构
@@ -95,6 +725,19 @@ type SalesRecord struct {
 	SaleTime     time.Time `json:"saleTime"`     // 销售时间
 	PaymentType  string    `json:"paymentType"`  // 支付方式
 	PurchaseCode string    `json:"purchaseCode"` // 购买凭证码
+
+	LotID   string `json:"lotId,omitempty"`   // 销售的库存批次号（可选）
+	StoreID string `json:"storeId,omitempty"` // 销售门店ID（可选）
+
+	Allocations []SaleAllocation `json:"allocations,omitempty"` // 按先到期先出扣减的库存明细
+}
+
+// SaleAllocation 销售扣减的库存明细
+type SaleAllocation struct {
+	InventoryID string    `json:"inventoryId"` // 库存记录ID
+	LotID       string    `json:"lotId"`       // 批次号
+	Quantity    int       `json:"quantity"`    // 扣减数量
+	ExpiryDate  time.Time `json:"expiryDate"`  // 到期时间
 }
 
 // ConsumerPurchase 消费者购买记录结构
@@ -110,6 +753,9 @@ type ConsumerPurchase struct {
 	PurchaseTime time.Time `json:"purchaseTime"` // 购买时间
 	PaymentType  string    `json:"paymentType"`  // 支付方式
 	PurchaseCode string    `json:"purchaseCode"` // 购买凭证码
+
+	LotID   string `json:"lotId,omitempty"`   // 购买的库存批次号（可选）
+	StoreID string `json:"storeId,omitempty"` // 购买门店ID（可选）
 }
 
 // PriceRecord 价格记录结构
@@ -148,6 +794,99 @@ type Retailer struct {
 	Address   string    `json:"address"`   // 地址
 	Phone     string    `json:"phone"`     // 联系电话
 	CreatedAt time.Time `json:"createdAt"` // 注册时间
+
+	Stores []Store `json:"stores,omitempty"` // 门店，库存未指定门店时归属零售商本部
+}
+
+// Store 零售商门店
+type Store struct {
+	ID        string    `json:"id"`        // 门店ID，在零售商内唯一
+	Name      string    `json:"name"`      // 门店名称
+	Address   string    `json:"address"`   // 门店地址
+	Latitude  float64   `json:"latitude"`  // 纬度
+	Longitude float64   `json:"longitude"` // 经度
+	CreatedAt time.Time `json:"createdAt"` // 开设时间
+}
+
+// StockTransfer 零售商门店间的库存调拨
+type StockTransfer struct {
+	ID              string    `json:"id"`              // 调拨单ID
+	RetailerID      string    `json:"retailerId"`      // 零售商ID
+	FromStoreID     string    `json:"fromStoreId"`     // 调出门店ID，空表示本部
+	ToStoreID       string    `json:"toStoreId"`       // 调入门店ID，空表示本部
+	ProductID       string    `json:"productId"`       // 产品ID
+	LotID           string    `json:"lotId"`           // 批次号，调入库存沿用调出库存的批次号
+	Quantity        int       `json:"quantity"`        // 调拨数量
+	Reason          string    `json:"reason"`          // 调拨原因
+	FromInventoryID string    `json:"fromInventoryId"` // 调出库存记录ID
+	ToInventoryID   string    `json:"toInventoryId"`   // 调入库存记录ID
+	TransferTime    time.Time `json:"transferTime"`    // 调拨时间
+}
+
+// QualityCertificate 质量证书结构
+type QualityCertificate struct {
+	ID          string    `json:"id"`          // 证书ID
+	ProductID   string    `json:"productId"`   // 产品（批次）ID
+	RecordIDs   []string  `json:"recordIds"`   // 证书包含的合格检测记录ID
+	Hash        string    `json:"hash"`        // 检测记录规范化哈希（SHA-256，十六进制）
+	InspectorID string    `json:"inspectorId"` // 签发检测员ID
+	Signature   string    `json:"signature"`   // 检测员对哈希的签名（Base64）
+	IssuedAt    time.Time `json:"issuedAt"`    // 签发时间
+}
+
+// Sample 检测样品结构
+type Sample struct {
+	ID          string            `json:"id"`          // 样品ID
+	ProductID   string            `json:"productId"`   // 产品ID
+	SamplerID   string            `json:"samplerId"`   // 采样人ID
+	SampledAt   time.Time         `json:"sampledAt"`   // 采样时间
+	Location    string            `json:"location"`    // 采样地点
+	SampleSize  float64           `json:"sampleSize"`  // 样品数量
+	SampleUnit  string            `json:"sampleUnit"`  // 样品数量单位
+	SealNumber  string            `json:"sealNumber"`  // 封条编号
+	CustodianID string            `json:"custodianId"` // 当前保管人ID
+	LabID       string            `json:"labId"`       // 接收实验室ID
+	Status      string            `json:"status"`      // 状态：COLLECTED（已采样）, IN_CUSTODY（流转中）, RECEIVED_BY_LAB（实验室已接收）, COMPROMISED（封条异常）
+	Custody     []CustodyTransfer `json:"custody"`     // 保管交接记录
+	CreatedAt   time.Time         `json:"createdAt"`   // 创建时间
+}
+
+// CustodyTransfer 样品保管交接记录
+type CustodyTransfer struct {
+	FromID       string    `json:"fromId"`       // 移交人ID
+	ToID         string    `json:"toId"`         // 接收人ID
+	SealNumber   string    `json:"sealNumber"`   // 交接时核对的封条编号
+	SealIntact   bool      `json:"sealIntact"`   // 封条是否完好
+	ToLab        bool      `json:"toLab"`        // 是否移交实验室
+	TransferTime time.Time `json:"transferTime"` // 交接时间
+}
+
+// QualityAppeal 质量检测申诉结构
+type QualityAppeal struct {
+	ID                   string    `json:"id"`                   // 申诉ID
+	ProductID            string    `json:"productId"`            // 产品ID
+	OriginalRecordID     string    `json:"originalRecordId"`     // 被申诉的检测记录ID
+	FarmerID             string    `json:"farmerId"`             // 申诉农户ID
+	Reason               string    `json:"reason"`               // 申诉理由
+	Status               string    `json:"status"`               // 状态：OPEN（已提交）, REINSPECTING（复检中）, RESOLVED（已裁决）
+	ReinspectorID        string    `json:"reinspectorId"`        // 复检检测员ID
+	ReinspectionRecordID string    `json:"reinspectionRecordId"` // 复检记录ID
+	Decision             string    `json:"decision"`             // 裁决结果：OVERTURNED（改判合格）, UPHELD（维持不合格）
+	DecisionNote         string    `json:"decisionNote"`         // 裁决说明
+	OpenedAt             time.Time `json:"openedAt"`             // 申诉时间
+	UpdatedAt            time.Time `json:"updatedAt"`            // 更新时间
+	ResolvedAt           time.Time `json:"resolvedAt"`           // 裁决时间
+}
+
+// CertificateVerification 质量证书校验结果
+type CertificateVerification struct {
+	CertificateID  string    `json:"certificateId"`  // 证书ID
+	Valid          bool      `json:"valid"`          // 证书是否有效
+	SignatureValid bool      `json:"signatureValid"` // 签名是否有效
+	HashValid      bool      `json:"hashValid"`      // 哈希是否与链上记录一致
+	Superseded     bool      `json:"superseded"`     // 是否有检测记录已被新记录取代
+	Issues         []string  `json:"issues"`         // 校验发现的问题
+	VerifiedAt     time.Time `json:"verifiedAt"`     // 校验时间
 }
 
 // InitLedger 初始化账本
@@ -174,6 +913,9 @@ func (t *AgriTrace) CreateProduct(ctx contractapi.TransactionContextInterface, p
 
 	// 设置初始状态和时间
 	product.Status = "PLANTING"
+	product.QualityHold = false
+	product.QualityHoldReason = ""
+	product.HarvestQuantity = 0
 	product.CreatedAt = time.Now()
 	product.UpdatedAt = time.Now()
 
@@ -205,14 +947,28 @@ func (t *AgriTrace) AddProductionRecord(ctx contractapi.TransactionContextInterf
 	// 设置创建时间
 	record.CreatedAt = time.Now()
 
-	// 如果是收获记录，更新产品状态
+	if record.Quantity < 0 {
+		return fmt.Errorf("收获数量不能为负数")
+	}
+	if record.Type == "HARVEST_QUANTITY" {
+		return fmt.Errorf("补录收获数量须通过 SetHarvestQuantity 提交")
+	}
+	if record.Type != "HARVESTING" {
+		record.Quantity = 0
+	}
+
+	// 如果是收获记录，更新产品状态，收获数量计入农户持有数量
 	if record.Type == "HARVESTING" {
+		if record.Quantity == 0 {
+			return fmt.Errorf("收获记录的收获数量必须大于0")
+		}
 		product, err := t.QueryProduct(ctx, record.ProductID)
 		if err != nil {
 			return err
 		}
 		product.Status = "HARVESTED"
 		product.HarvestDate = record.Date
+		product.HarvestQuantity += record.Quantity
 		product.UpdatedAt = time.Now()
 
 		productJSON, err := json.Marshal(product)
@@ -223,6 +979,77 @@ func (t *AgriTrace) AddProductionRecord(ctx contractapi.TransactionContextInterf
 		if err != nil {
 			return err
 		}
+		err = t.adjustCustody(ctx, product, product.FarmerID, record.Quantity, nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	recordJSON, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	return ctx.GetStub().PutState(record.ID, recordJSON)
+}
+
+// SetHarvestQuantity 为记录收获数量之前已收获的批次补录收获数量，计入农户持有数量；
+// 补录以 HARVEST_QUANTITY 类型的生产记录留痕，每个批次只能补录一次
+func (t *AgriTrace) SetHarvestQuantity(ctx contractapi.TransactionContextInterface, recordData string) error {
+	var record ProductionRecord
+	err := json.Unmarshal([]byte(recordData), &record)
+	if err != nil {
+		return fmt.Errorf("解析记录数据失败: %v", err)
+	}
+
+	if len(record.ID) == 0 {
+		return fmt.Errorf("生产记录ID不能为空")
+	}
+	existing, err := ctx.GetStub().GetState(record.ID)
+	if err != nil {
+		return fmt.Errorf("查询生产记录失败: %v", err)
+	}
+	if existing != nil {
+		return fmt.Errorf("生产记录ID已被占用: %s", record.ID)
+	}
+	if len(record.OperatorID) == 0 {
+		return fmt.Errorf("操作人ID不能为空")
+	}
+	if record.Quantity <= 0 {
+		return fmt.Errorf("收获数量必须大于0")
+	}
+
+	product, err := t.QueryProduct(ctx, record.ProductID)
+	if err != nil {
+		return err
+	}
+	if product.Status != "HARVESTED" && product.HarvestDate == "" {
+		return fmt.Errorf("产品尚未收获: %s", product.ID)
+	}
+	if product.HarvestQuantity > 0 {
+		return fmt.Errorf("产品已记录收获数量 %d，不能补录: %s", product.HarvestQuantity, product.ID)
+	}
+
+	record.Type = "HARVEST_QUANTITY"
+	if record.Date == "" {
+		record.Date = product.HarvestDate
+	}
+	record.CreatedAt = time.Now()
+
+	product.HarvestQuantity = record.Quantity
+	product.UpdatedAt = record.CreatedAt
+
+	productJSON, err := json.Marshal(product)
+	if err != nil {
+		return err
+	}
+	err = ctx.GetStub().PutState(product.ID, productJSON)
+	if err != nil {
+		return err
+	}
+	err = t.adjustCustody(ctx, product, product.FarmerID, record.Quantity, nil)
+	if err != nil {
+		return err
 	}
 
 	recordJSON, err := json.Marshal(record)
@@ -286,6 +1113,11 @@ func (t *AgriTrace) QueryProductsByFarmer(ctx contractapi.TransactionContextInte
 			return "", err
 		}
 
+		// 跳过带前缀存储的实体记录
+		if isEntityKey(queryResult.Key) {
+			continue
+		}
+
 		var product Product
 		err = json.Unmarshal(queryResult.Value, &product)
 		if err != nil {
@@ -328,6 +1160,11 @@ func (t *AgriTrace) AddEnvironmentRecord(ctx contractapi.TransactionContextInter
 	if err != nil {
 		return fmt.Errorf("解析环境记录数据失败: %v", err)
 	}
+
+	// 设备ID与 RegisterDevice 一致，统一以DEVICE_开头，设备按带前缀的ID签名
+	if len(record.DeviceID) > 0 && !strings.HasPrefix(record.DeviceID, "DEVICE_") {
+		record.DeviceID = fmt.Sprintf("DEVICE_%s", record.DeviceID)
+	}
 	
 	// 检查产品是否存在
 	exists, err := t.ProductExists(ctx, record.ProductID)
@@ -338,56 +1175,158 @@ func (t *AgriTrace) AddEnvironmentRecord(ctx contractapi.TransactionContextInter
 		return fmt.Errorf("产品不存在: %s", record.ProductID)
 	}
 	
-	// 设置记录时间
-	record.RecordTime = time.Now()
-	
-	// 检查是否有异常
-	if record.Temperature > 35 || record.Temperature < 0 {
-		// 触发温度异常警报
-		return fmt.Errorf("温度异常警报: %f", record.Temperature)
+	// 采集时间由设备提供并参与签名
+	if record.RecordTime.IsZero() {
+		return fmt.Errorf("采集时间不能为空")
 	}
-	
-	if record.Humidity < 0 || record.Humidity > 100 {
-		// 触发湿度异常警报
-		return fmt.Errorf("湿度异常警报: %f", record.Humidity)
+	if record.RecordTime.After(time.Now().Add(maxReadingClockSkew)) {
+		return fmt.Errorf("采集时间晚于当前时间: %s", record.RecordTime.Format(time.RFC3339))
 	}
 	
-	recordJSON, err := json.Marshal(record)
+	// 同一读数只能写入一次，防止重放已签名的读数
+	if len(record.ID) == 0 {
+		return fmt.Errorf("环境记录ID不能为空")
+	}
+	exists, err = environmentReadingExists(ctx, &record)
 	if err != nil {
 		return err
 	}
-	
-	return ctx.GetStub().PutState(record.ID, recordJSON)
-}
+	if exists {
+		return fmt.Errorf("环境记录已存在: %s", record.ID)
+	}
 
-// AddQualityRecord 添加质量检测记录
-func (t *AgriTrace) AddQualityRecord(ctx contractapi.TransactionContextInterface, recordData string) error {
-	var record QualityRecord
-	err := json.Unmarshal([]byte(recordData), &record)
+	// 校验设备对原始读数的签名
+	device, err := t.QueryDevice(ctx, record.DeviceID)
 	if err != nil {
-		return fmt.Errorf("解析质量检测记录数据失败: %v", err)
+		return err
 	}
-	
-	// 检查产品是否存在
-	exists, err := t.ProductExists(ctx, record.ProductID)
+	err = verifyDeviceReading(device, &record)
 	if err != nil {
 		return err
 	}
-	if !exists {
-		return fmt.Errorf("产品不存在: %s", record.ProductID)
+
+	// 统一为指标读数并检查数据有效性
+	err = normalizeEnvironmentMetrics(&record)
+	if err != nil {
+		return err
 	}
-	
-	// 设置记录时间
-	record.RecordTime = time.Now()
+
+	// 按阈值配置检查异常，超出阈值的读数照常保存并标记告警
+	threshold, err := t.QueryEffectiveThreshold(ctx, record.ProductID)
+	if err != nil {
+		return err
+	}
+	record.Alerts = checkEnvironmentThreshold(&record, threshold)
 	
 	recordJSON, err := json.Marshal(record)
 	if err != nil {
 		return err
 	}
 	
-	return ctx.GetStub().PutState(record.ID, recordJSON)
-}
-
+	err = ctx.GetStub().PutState(record.ID, recordJSON)
+	if err != nil {
+		return err
+	}
+
+	// 更新每日汇总
+	err = t.updateEnvironmentDailySummaries(ctx, []*EnvironmentRecord{&record})
+	if err != nil {
+		return err
+	}
+
+	// 触发环境异常事件
+	if len(record.Alerts) > 0 {
+		return ctx.GetStub().SetEvent("EnvironmentAlert", recordJSON)
+	}
+
+	return nil
+}
+
+// AddQualityRecord 添加质量检测记录
+func (t *AgriTrace) AddQualityRecord(ctx contractapi.TransactionContextInterface, recordData string) error {
+	var record QualityRecord
+	err := json.Unmarshal([]byte(recordData), &record)
+	if err != nil {
+		return fmt.Errorf("解析质量检测记录数据失败: %v", err)
+	}
+
+	// 证书引用检测记录ID，已存在的记录不能被覆盖
+	if len(record.ID) == 0 {
+		return fmt.Errorf("质量检测记录ID不能为空")
+	}
+	existing, err := ctx.GetStub().GetState(record.ID)
+	if err != nil {
+		return fmt.Errorf("查询质量检测记录失败: %v", err)
+	}
+	if existing != nil {
+		return fmt.Errorf("质量检测记录ID已被占用: %s", record.ID)
+	}
+	
+	// 检查产品是否存在
+	exists, err := t.ProductExists(ctx, record.ProductID)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("产品不存在: %s", record.ProductID)
+	}
+	
+	// 检测记录必须引用保管链完整的样品
+	if len(record.SampleID) > 0 && !strings.HasPrefix(record.SampleID, "SAMPLE_") {
+		record.SampleID = fmt.Sprintf("SAMPLE_%s", record.SampleID)
+	}
+	sample, err := t.QuerySample(ctx, record.SampleID)
+	if err != nil {
+		return err
+	}
+	if sample.ProductID != record.ProductID {
+		return fmt.Errorf("样品 %s 不属于产品 %s", sample.ID, record.ProductID)
+	}
+	err = checkCustodyChain(sample)
+	if err != nil {
+		return err
+	}
+
+	// 设置记录时间
+	record.RecordTime = time.Now()
+	record.SupersededBy = ""
+	record.ReinspectionOf = ""
+
+	// 申诉复检记录须由指定的复检员针对原检测项目录入
+	if record.AppealID != "" {
+		appeal, err := t.QueryQualityAppeal(ctx, record.AppealID)
+		if err != nil {
+			return err
+		}
+		if appeal.Status != "REINSPECTING" {
+			return fmt.Errorf("申诉未处于复检状态: %s", appeal.Status)
+		}
+		if record.InspectorID != appeal.ReinspectorID {
+			return fmt.Errorf("复检记录须由指定复检员 %s 录入", appeal.ReinspectorID)
+		}
+		original, err := t.QueryQualityRecord(ctx, appeal.OriginalRecordID)
+		if err != nil {
+			return err
+		}
+		if record.ProductID != original.ProductID || record.Stage != original.Stage || record.TestType != original.TestType {
+			return fmt.Errorf("复检记录的产品、阶段或检测类型与原检测记录不一致")
+		}
+		record.ReinspectionOf = original.ID
+	}
+	
+	recordJSON, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	
+	err = ctx.GetStub().PutState(record.ID, recordJSON)
+	if err != nil {
+		return err
+	}
+
+	return t.updateQualityHold(ctx, record.ProductID, []*QualityRecord{&record}, nil)
+}
+
 // QueryEnvironmentRecords 查询产品的环境记录
 func (t *AgriTrace) QueryEnvironmentRecords(ctx contractapi.TransactionContextInterface, productID string) ([]*EnvironmentRecord, error) {
 	resultsIterator, err := ctx.GetStub().GetStateByRange("", "")
@@ -403,6 +1342,27 @@ func (t *AgriTrace) QueryEnvironmentRecords(ctx contractapi.TransactionContextIn
 			return nil, err
 		}
 
+		// 批量上报的读数按产品、小时分桶存储
+		if strings.HasPrefix(queryResult.Key, "ENVBUCKET_") {
+			var bucket EnvironmentBucket
+			err = json.Unmarshal(queryResult.Value, &bucket)
+			if err != nil || bucket.ProductID != productID {
+				continue
+			}
+			records = append(records, bucket.records()...)
+			continue
+		}
+
+		// 跳过带前缀存储的实体记录
+		if isEntityKey(queryResult.Key) {
+			continue
+		}
+
+		// 生产、质检、物流等记录同样不带前缀存储，只处理带环境读数字段的记录
+		if !isEnvironmentRecordJSON(queryResult.Value) {
+			continue
+		}
+
 		var record EnvironmentRecord
 		err = json.Unmarshal(queryResult.Value, &record)
 		if err != nil {
@@ -433,6 +1393,11 @@ func (t *AgriTrace) QueryQualityRecords(ctx contractapi.TransactionContextInterf
 			return nil, err
 		}
 
+		// 跳过带前缀存储的实体记录
+		if isEntityKey(queryResult.Key) {
+			continue
+		}
+
 		var record QualityRecord
 		err = json.Unmarshal(queryResult.Value, &record)
 		if err != nil {
@@ -478,6 +1443,11 @@ func (t *AgriTrace) QueryProductionRecords(ctx contractapi.TransactionContextInt
 			return nil, err
 		}
 
+		// 跳过带前缀存储的实体记录
+		if isEntityKey(queryResult.Key) {
+			continue
+		}
+
 		var record ProductionRecord
 		err = json.Unmarshal(queryResult.Value, &record)
 		if err != nil {
@@ -508,6 +1478,11 @@ func (t *AgriTrace) QueryProductsByStatus(ctx contractapi.TransactionContextInte
 			return nil, err
 		}
 
+		// 跳过带前缀存储的实体记录
+		if isEntityKey(queryResult.Key) {
+			continue
+		}
+
 		var product Product
 		err = json.Unmarshal(queryResult.Value, &product)
 		if err != nil {
@@ -538,6 +1513,11 @@ func (t *AgriTrace) QueryQualityRecordsByInspector(ctx contractapi.TransactionCo
 			return nil, err
 		}
 
+		// 跳过带前缀存储的实体记录
+		if isEntityKey(queryResult.Key) {
+			continue
+		}
+
 		var record QualityRecord
 		err = json.Unmarshal(queryResult.Value, &record)
 		if err != nil {
@@ -560,6 +1540,18 @@ func (t *AgriTrace) AddLogisticsRecord(ctx contractapi.TransactionContextInterfa
 	if err != nil {
 		return fmt.Errorf("解析物流记录数据失败: %v", err)
 	}
+
+	if len(record.ID) == 0 {
+		return fmt.Errorf("物流记录ID不能为空")
+	}
+	// 物流历史只追加不修改，已存在的记录不能被重新创建覆盖
+	existing, err := ctx.GetStub().GetState(record.ID)
+	if err != nil {
+		return fmt.Errorf("查询物流记录失败: %v", err)
+	}
+	if existing != nil {
+		return fmt.Errorf("物流记录ID已被占用: %s", record.ID)
+	}
 	
 	// 检查产品是否存在
 	exists, err := t.ProductExists(ctx, record.ProductID)
@@ -570,15 +1562,50 @@ func (t *AgriTrace) AddLogisticsRecord(ctx contractapi.TransactionContextInterfa
 		return fmt.Errorf("产品不存在: %s", record.ProductID)
 	}
 	
-	// 设置记录时间
+	// 新建物流记录从 CREATED 开始，后续状态只能通过 UpdateLogisticsRecord 按状态流转变更
+	if record.Status == "" {
+		record.Status = "CREATED"
+	}
+	if record.Status != "CREATED" {
+		return fmt.Errorf("新建物流记录的状态必须为 CREATED，当前: %s", record.Status)
+	}
+	err = checkCoordinates(record.Latitude, record.Longitude)
+	if err != nil {
+		return err
+	}
+	err = t.checkReceivingStore(ctx, record.ReceiverID, record.StoreID)
+	if err != nil {
+		return err
+	}
+
+	// 设置记录时间，历史节点和超限记录由合约生成，忽略调用方提交的内容
 	record.RecordTime = time.Now()
+	record.History = nil
+	record.Excursions = nil
+
+	// 评估随记录提交的温度读数
+	product, err := t.QueryProduct(ctx, record.ProductID)
+	if err != nil {
+		return err
+	}
+	newExcursions := evaluateColdChain(&record, product)
+
+	// 未指定发货方时由产品所属农户发货
+	if record.ShipperID == "" {
+		record.ShipperID = product.FarmerID
+	}
 	
 	recordJSON, err := json.Marshal(record)
 	if err != nil {
 		return err
 	}
 	
-	return ctx.GetStub().PutState(record.ID, recordJSON)
+	err = ctx.GetStub().PutState(record.ID, recordJSON)
+	if err != nil {
+		return err
+	}
+
+	return emitColdChainExcursions(ctx, newExcursions)
 }
 
 // QueryLogisticsRecordsByOperator 查询操作员的物流记录
@@ -596,6 +1623,11 @@ func (t *AgriTrace) QueryLogisticsRecordsByOperator(ctx contractapi.TransactionC
 			return "", err
 		}
 
+		// 跳过带前缀存储的实体记录
+		if isEntityKey(queryResult.Key) {
+			continue
+		}
+
 		var record LogisticsRecord
 		err = json.Unmarshal(queryResult.Value, &record)
 		if err != nil {
@@ -656,6 +1688,11 @@ func (t *AgriTrace) QueryLogisticsRecordsByProduct(ctx contractapi.TransactionCo
 			return nil, err
 		}
 
+		// 跳过带前缀存储的实体记录
+		if isEntityKey(queryResult.Key) {
+			continue
+		}
+
 		var record LogisticsRecord
 		err = json.Unmarshal(queryResult.Value, &record)
 		if err != nil {
@@ -670,25 +1707,70 @@ func (t *AgriTrace) QueryLogisticsRecordsByProduct(ctx contractapi.TransactionCo
 	return records, nil
 }
 
-// UpdateLogisticsRecord 更新物流记录状态
-func (t *AgriTrace) UpdateLogisticsRecord(ctx contractapi.TransactionContextInterface, recordID string, status string, location string, description string) error {
+// UpdateLogisticsRecord 更新物流记录状态和当前位置坐标，未上报坐标时经纬度均传空字符串
+func (t *AgriTrace) UpdateLogisticsRecord(ctx contractapi.TransactionContextInterface, recordID string, status string, location string, description string, latitude string, longitude string) error {
 	record, err := t.QueryLogisticsRecord(ctx, recordID)
 	if err != nil {
 		return err
 	}
 
+	err = checkShipmentTransition(record.Status, status)
+	if err != nil {
+		return err
+	}
+	lat, lon, located, err := parseCoordinates(latitude, longitude)
+	if err != nil {
+		return err
+	}
+
+	// 首次更新时把创建时的状态作为第一个节点保留
+	if len(record.History) == 0 {
+		record.History = append(record.History, Checkpoint{
+			Sequence:    1,
+			Location:    record.Location,
+			Status:      record.Status,
+			Description: record.Description,
+			OperatorID:  record.OperatorID,
+			RecordTime:  record.RecordTime,
+			Latitude:    record.Latitude,
+			Longitude:   record.Longitude,
+			Located:     record.Located,
+		})
+	}
+
 	// 更新记录信息
 	record.Status = status
 	record.Location = location
 	record.Description = description
 	record.RecordTime = time.Now()
+	record.Latitude = lat
+	record.Longitude = lon
+	record.Located = located
+
+	// 追加本次更新，保留完整路线历史
+	record.History = append(record.History, Checkpoint{
+		Sequence:    len(record.History) + 1,
+		Location:    location,
+		Status:      status,
+		Description: description,
+		OperatorID:  record.OperatorID,
+		RecordTime:  record.RecordTime,
+		Latitude:    lat,
+		Longitude:   lon,
+		Located:     located,
+	})
 
 	recordJSON, err := json.Marshal(record)
 	if err != nil {
 		return err
 	}
 
-	return ctx.GetStub().PutState(recordID, recordJSON)
+	err = ctx.GetStub().PutState(recordID, recordJSON)
+	if err != nil {
+		return err
+	}
+
+	return t.receiveLogisticsDelivery(ctx, record)
 }
 
 // AddRetailInventory 添加零售库存记录
@@ -708,55 +1790,85 @@ func (t *AgriTrace) AddRetailInventory(ctx contractapi.TransactionContextInterfa
 		return fmt.Errorf("产品不存在: %s", inventory.ProductID)
 	}
 
-	// 确保ID有正确的前缀
-	if !strings.HasPrefix(inventory.ID, "INV_") {
-		inventory.ID = fmt.Sprintf("INV_%s", inventory.ID)
+	if inventory.Quantity < 0 {
+		return fmt.Errorf("库存数量不能为负数")
 	}
-
-	// 设置更新时间
-	inventory.UpdatedAt = time.Now()
-
-	inventoryJSON, err := json.Marshal(inventory)
+	err = t.checkRetailerStore(ctx, inventory.RetailerID, inventory.StoreID)
 	if err != nil {
 		return err
 	}
 
-	return ctx.GetStub().PutState(inventory.ID, inventoryJSON)
-}
-
-// UpdateInventoryQuantity 更新库存数量
-func (t *AgriTrace) UpdateInventoryQuantity(ctx contractapi.TransactionContextInterface, inventoryID string, quantity int) error {
-	inventoryJSON, err := ctx.GetStub().GetState(inventoryID)
+	// 同一零售商、产品、批次号已有库存时累加数量；到期时间不同的货物须使用不同的批次号登记
+	existing, err := t.findRetailInventory(ctx, inventory.RetailerID, inventory.StoreID, inventory.ProductID, inventory.LotID)
 	if err != nil {
-		return fmt.Errorf("查询库存记录失败: %v", err)
+		return err
 	}
-	if inventoryJSON == nil {
-		return fmt.Errorf("库存记录不存在: %s", inventoryID)
+	if existing != nil {
+		if !inventory.ExpiryDate.IsZero() && !inventory.ExpiryDate.Equal(existing.ExpiryDate) {
+			return fmt.Errorf("库存记录 %s 的到期时间与登记的到期时间不一致，请使用不同的批次号登记", existing.ID)
+		}
+		if inventory.MinQuantity > 0 {
+			existing.MinQuantity = inventory.MinQuantity
+		}
+		if inventory.Quantity == 0 {
+			return putRetailInventory(ctx, existing)
+		}
+		return t.applyStockMovement(ctx, existing, &StockMovement{
+			Type:     "RECEIPT",
+			Quantity: inventory.Quantity,
+			Reason:   "重复登记库存，累加数量",
+		})
 	}
 
-	var inventory RetailInventory
-	err = json.Unmarshal(inventoryJSON, &inventory)
+	// 确保ID有正确的前缀
+	if len(inventory.ID) == 0 {
+		inventory.ID = defaultInventoryID(inventory.RetailerID, inventory.StoreID, inventory.ProductID, inventory.LotID)
+	}
+	if !strings.HasPrefix(inventory.ID, "INV_") {
+		inventory.ID = fmt.Sprintf("INV_%s", inventory.ID)
+	}
+
+	// 检查库存记录ID是否已被其他零售商或产品占用
+	err = checkInventoryIDFree(ctx, inventory.ID)
 	if err != nil {
 		return err
 	}
 
-	// 更新库存数量和时间
-	inventory.Quantity = quantity
-	inventory.UpdatedAt = time.Now()
+	// 未指定到期时间时沿用批次到期时间
+	if inventory.ExpiryDate.IsZero() {
+		product, err := t.QueryProduct(ctx, inventory.ProductID)
+		if err != nil {
+			return err
+		}
+		inventory.ExpiryDate = product.ExpiryDate
+	}
 
-	// 检查是否低于最小库存
-	if quantity <= inventory.MinQuantity {
-		// 触发库存预警
-		fmt.Printf("库存预警: 产品 %s 库存数量 %d 低于最小库存 %d\n", 
-			inventory.ProductID, quantity, inventory.MinQuantity)
+	quantity := inventory.Quantity
+	inventory.Quantity = 0
+	inventory.MovementSeq = 0
+	if quantity == 0 {
+		inventory.UpdatedAt = time.Now()
+		return putRetailInventory(ctx, &inventory)
 	}
+	return t.applyStockMovement(ctx, &inventory, &StockMovement{
+		Type:     "RECEIPT",
+		Quantity: quantity,
+		Reason:   "登记库存",
+	})
+}
 
-	inventoryJSON, err = json.Marshal(inventory)
+// UpdateInventoryQuantity 更新库存数量，按与当前库存的差额记录一条盘点调整
+func (t *AgriTrace) UpdateInventoryQuantity(ctx contractapi.TransactionContextInterface, inventoryID string, quantity int) error {
+	inventory, err := t.QueryInventory(ctx, inventoryID)
 	if err != nil {
 		return err
 	}
 
-	return ctx.GetStub().PutState(inventoryID, inventoryJSON)
+	return t.applyStockMovement(ctx, inventory, &StockMovement{
+		Type:     "ADJUSTMENT",
+		Quantity: quantity - inventory.Quantity,
+		Reason:   "手动更新库存数量",
+	})
 }
 
 // QueryInventoryByRetailer 查询零售商的库存
@@ -852,30 +1964,8 @@ func (t *AgriTrace) AddSalesRecord(ctx contractapi.TransactionContextInterface,
 	// 计算总金额
 	record.TotalAmount = record.UnitPrice * float64(record.Quantity)
 
-	// 更新库存
-	inventories, err := t.QueryInventoryByRetailer(ctx, record.RetailerID)
-	if err != nil {
-		return err
-	}
-
-	var inventory *RetailInventory
-	for _, inv := range inventories {
-		if inv.ProductID == record.ProductID {
-			inventory = inv
-			break
-		}
-	}
-
-	if inventory == nil {
-		return fmt.Errorf("未找到相关库存记录")
-	}
-
-	if inventory.Quantity < record.Quantity {
-		return fmt.Errorf("库存不足: 当前库存 %d, 需要数量 %d", inventory.Quantity, record.Quantity)
-	}
-
-	// 更新库存数量
-	err = t.UpdateInventoryQuantity(ctx, inventory.ID, inventory.Quantity-record.Quantity)
+	// 按先到期先出扣减库存
+	record.Allocations, err = t.sellStock(ctx, &record, "", "零售销售")
 	if err != nil {
 		return err
 	}
@@ -1066,6 +2156,10 @@ func (t *AgriTrace) PutProductOnSale(ctx contractapi.TransactionContextInterface
 		return fmt.Errorf("只有已收获或已下架的产品可以上架，当前状态: %s", product.Status)
 	}
 
+	if product.QualityHold {
+		return fmt.Errorf("产品处于质量冻结状态，无法上架: %s", product.QualityHoldReason)
+	}
+
 	product.Status = "ON_SALE"
 	product.UpdatedAt = time.Now()
 
@@ -1223,6 +2317,11 @@ func (t *AgriTrace) QueryProductFeedbacks(ctx contractapi.TransactionContextInte
 			return nil, err
 		}
 
+		// 跳过带前缀存储的实体记录
+		if isEntityKey(queryResult.Key) {
+			continue
+		}
+
 		var feedback ProductFeedback
 		err = json.Unmarshal(queryResult.Value, &feedback)
 		if err != nil {
@@ -1317,6 +2416,13 @@ func (t *AgriTrace) QueryProductTrace(ctx contractapi.TransactionContextInterfac
 		QualityRecords    []*QualityRecord   `json:"qualityRecords"`
 		LogisticsRecords  []*LogisticsRecord `json:"logisticsRecords"`
 		Feedbacks         []*ProductFeedback  `json:"feedbacks"`
+		QualityAppeals    []*QualityAppeal    `json:"qualityAppeals"`
+
+		ColdChainExcursions []TemperatureExcursion `json:"coldChainExcursions"`
+		Shipments           []*Shipment            `json:"shipments"`
+		Route               []RouteHop             `json:"route"`
+		Transfers           []*LotTransfer         `json:"transfers"`
+		WarehouseStays      []*WarehouseStay       `json:"warehouseStays"`
 	}
 
 	// 获取生产记录
@@ -1343,6 +2449,37 @@ func (t *AgriTrace) QueryProductTrace(ctx contractapi.TransactionContextInterfac
 		return "", err
 	}
 
+	// 获取质量申诉
+	qualityAppeals, err := t.QueryQualityAppealsByProduct(ctx, productID)
+	if err != nil {
+		return "", err
+	}
+
+	// 汇总运输途中的温度超限
+	coldChainExcursions := []TemperatureExcursion{}
+	for _, record := range logisticsRecords {
+		coldChainExcursions = append(coldChainExcursions, record.Excursions...)
+	}
+
+	// 获取运输单并按时间排列所有运输节点
+	shipments, err := t.QueryShipmentsByProduct(ctx, productID)
+	if err != nil {
+		return "", err
+	}
+	route := productRoute(shipments, logisticsRecords)
+
+	// 获取保管权交接记录
+	transfers, err := t.QueryTransfersByProduct(ctx, productID)
+	if err != nil {
+		return "", err
+	}
+
+	// 获取仓储停留记录
+	warehouseStays, err := t.QueryWarehouseStaysByProduct(ctx, productID)
+	if err != nil {
+		return "", err
+	}
+
 	// 组装追溯信息
 	traceInfo := TraceInfo{
 		Product:           product,
@@ -1350,6 +2487,13 @@ func (t *AgriTrace) QueryProductTrace(ctx contractapi.TransactionContextInterfac
 		QualityRecords:    qualityRecords,
 		LogisticsRecords:  logisticsRecords,
 		Feedbacks:         feedbacks,
+		QualityAppeals:    qualityAppeals,
+
+		ColdChainExcursions: coldChainExcursions,
+		Shipments:           shipments,
+		Route:               route,
+		Transfers:           transfers,
+		WarehouseStays:      warehouseStays,
 	}
 
 	// 序列化为JSON
@@ -1376,6 +2520,11 @@ func (t *AgriTrace) AddConsumerPurchase(ctx contractapi.TransactionContextInterf
 		return fmt.Errorf("解析购买记录数据失败: %v", err)
 	}
 
+	return t.addConsumerPurchase(ctx, &purchase, "")
+}
+
+// addConsumerPurchase 记录消费者购买，reservationID 非空时该预留的数量计入可售库存
+func (t *AgriTrace) addConsumerPurchase(ctx contractapi.TransactionContextInterface, purchase *ConsumerPurchase, reservationID string) error {
 	// 检查产品是否存在
 	exists, err := t.ProductExists(ctx, purchase.ProductID)
 	if err != nil {
@@ -1394,28 +2543,6 @@ func (t *AgriTrace) AddConsumerPurchase(ctx contractapi.TransactionContextInterf
 		return fmt.Errorf("消费者不存在: %s", purchase.ConsumerID)
 	}
 
-	// 检查零售商库存
-	inventories, err := t.QueryInventoryByRetailer(ctx, purchase.RetailerID)
-	if err != nil {
-		return err
-	}
-
-	var inventory *RetailInventory
-	for _, inv := range inventories {
-		if inv.ProductID == purchase.ProductID {
-			inventory = inv
-			break
-		}
-	}
-
-	if inventory == nil {
-		return fmt.Errorf("未找到相关库存记录")
-	}
-
-	if inventory.Quantity < purchase.Quantity {
-		return fmt.Errorf("库存不足: 当前库存 %d, 需要数量 %d", inventory.Quantity, purchase.Quantity)
-	}
-
 	// 生成购买凭证码
 	purchase.PurchaseCode = generatePurchaseCode(purchase.ProductID, purchase.ConsumerID)
 	
@@ -1437,10 +2564,12 @@ func (t *AgriTrace) AddConsumerPurchase(ctx contractapi.TransactionContextInterf
 		SaleTime:     purchase.PurchaseTime,
 		PaymentType:  purchase.PaymentType,
 		PurchaseCode: purchase.PurchaseCode,
+		LotID:        purchase.LotID,
+		StoreID:      purchase.StoreID,
 	}
 
-	// 更新库存数量
-	err = t.UpdateInventoryQuantity(ctx, inventory.ID, inventory.Quantity-purchase.Quantity)
+	// 按先到期先出扣减库存
+	salesRecord.Allocations, err = t.sellStock(ctx, &salesRecord, reservationID, "消费者购买")
 	if err != nil {
 		return err
 	}
@@ -1492,6 +2621,11 @@ func (t *AgriTrace) QueryConsumerPurchases(ctx contractapi.TransactionContextInt
 			return nil, err
 		}
 
+		// 跳过带前缀存储的实体记录
+		if isEntityKey(queryResult.Key) {
+			continue
+		}
+
 		var purchase ConsumerPurchase
 		err = json.Unmarshal(queryResult.Value, &purchase)
 		if err != nil {
@@ -1520,6 +2654,11 @@ func (t *AgriTrace) VerifyPurchase(ctx contractapi.TransactionContextInterface,
 			return nil, err
 		}
 
+		// 跳过带前缀存储的实体记录
+		if isEntityKey(queryResult.Key) {
+			continue
+		}
+
 		var purchase ConsumerPurchase
 		err = json.Unmarshal(queryResult.Value, &purchase)
 		if err != nil {
@@ -1559,6 +2698,11 @@ func (t *AgriTrace) QueryProductionRecordsByProduct(ctx contractapi.TransactionC
 			return nil, err
 		}
 
+		// 跳过带前缀存储的实体记录
+		if isEntityKey(queryResult.Key) {
+			continue
+		}
+
 		var record ProductionRecord
 		err = json.Unmarshal(queryResult.Value, &record)
 		if err != nil {
@@ -1598,6 +2742,11 @@ func (t *AgriTrace) QueryQualityRecordsByProduct(ctx contractapi.TransactionCont
 			return nil, err
 		}
 
+		// 跳过带前缀存储的实体记录
+		if isEntityKey(queryResult.Key) {
+			continue
+		}
+
 		var record QualityRecord
 		err = json.Unmarshal(queryResult.Value, &record)
 		if err != nil {
@@ -1975,11 +3124,7 @@ func (t *AgriTrace) UpdateInventorySettings(ctx contractapi.TransactionContextIn
 	inventory.UpdatedAt = time.Now()
 
 	// 检查当前库存是否低于新设置的最小库存
-	if inventory.Quantity <= minQuantity {
-		// 触发库存预警
-		fmt.Printf("库存预警: 产品 %s 库存数量 %d 低于最小库存 %d\n", 
-			inventory.ProductID, inventory.Quantity, minQuantity)
-	}
+	updateLowStockState(&inventory, inventory.UpdatedAt)
 
 	inventoryJSON, err = json.Marshal(inventory)
 	if err != nil {
@@ -2008,6 +3153,5876 @@ func (t *AgriTrace) QueryInventory(ctx contractapi.TransactionContextInterface,
 	return &inventory, nil
 }
 
+// entityKeyPrefixes 带前缀存储的实体键前缀，按结构体解析的全量扫描需跳过这些记录
+var entityKeyPrefixes = []string{
+	"CERT_",
+	"APPEAL_",
+	"SAMPLE_",
+	"THRESHOLD_",
+	"ENVBUCKET_",
+	"DEVICE_",
+	"ENVDAILY_",
+	"SHELFLIFE_",
+	"SHIPMENT_",
+	"TRANSFER_",
+	"CUSTODY_",
+	"MOVEMENT_",
+	"CLAIM_",
+	"WAREHOUSE_",
+	"WHMOVE_",
+	"RESERVE_",
+	"REPLENISH_",
+	"STOCKXFER_",
+	"STOCKTAKE_",
+}
+
+// isEntityKey 判断键是否属于带前缀存储的实体
+func isEntityKey(key string) bool {
+	for _, prefix := range entityKeyPrefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// isEnvironmentRecordJSON 判断不带前缀存储的记录是否为环境记录：须有记录时间，并带有指标读数或旧格式的温度、湿度字段
+func isEnvironmentRecordJSON(value []byte) bool {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(value, &fields); err != nil {
+		return false
+	}
+	if _, ok := fields["recordTime"]; !ok {
+		return false
+	}
+	for _, key := range []string{"metrics", "temperature", "humidity"} {
+		if _, ok := fields[key]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// parsePublicKey 解析公钥，支持 PEM 格式的 ECDSA/Ed25519 公钥以及 Base64 编码的 Ed25519 原始公钥
+func parsePublicKey(publicKey string) (crypto.PublicKey, error) {
+	if block, _ := pem.Decode([]byte(publicKey)); block != nil {
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("解析公钥失败: %v", err)
+		}
+		switch key.(type) {
+		case ed25519.PublicKey, *ecdsa.PublicKey:
+			return key, nil
+		default:
+			return nil, fmt.Errorf("不支持的公钥类型: %T", key)
+		}
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(publicKey)
+	if err != nil {
+		return nil, fmt.Errorf("解析公钥失败: %v", err)
+	}
+	if len(raw) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("Ed25519 公钥长度错误: %d", len(raw))
+	}
+	return ed25519.PublicKey(raw), nil
+}
+
+// verifySignature 校验 Base64 编码的签名，ECDSA 签名为对消息 SHA-256 摘要的 ASN.1 DER 签名
+func verifySignature(publicKey string, message []byte, signature string) error {
+	key, err := parsePublicKey(publicKey)
+	if err != nil {
+		return err
+	}
+
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return fmt.Errorf("解析签名失败: %v", err)
+	}
+
+	switch k := key.(type) {
+	case ed25519.PublicKey:
+		if !ed25519.Verify(k, message, sig) {
+			return fmt.Errorf("签名校验失败")
+		}
+	case *ecdsa.PublicKey:
+		digest := sha256.Sum256(message)
+		if !ecdsa.VerifyASN1(k, digest[:], sig) {
+			return fmt.Errorf("签名校验失败")
+		}
+	default:
+		return fmt.Errorf("不支持的公钥类型: %T", key)
+	}
+
+	return nil
+}
+
+// getInspectorPublicKey 获取检测员登记的公钥
+func (t *AgriTrace) getInspectorPublicKey(ctx contractapi.TransactionContextInterface, inspectorID string) (string, error) {
+	inspectorData, err := t.GetInspector(ctx, inspectorID)
+	if err != nil {
+		return "", err
+	}
+
+	var inspector map[string]interface{}
+	err = json.Unmarshal([]byte(inspectorData), &inspector)
+	if err != nil {
+		return "", fmt.Errorf("解析检查员数据失败: %v", err)
+	}
+
+	publicKey, ok := inspector["publicKey"].(string)
+	if !ok || len(publicKey) == 0 {
+		return "", fmt.Errorf("检查员未登记公钥: %s", inspectorID)
+	}
+
+	return publicKey, nil
+}
+
+// QueryQualityRecord 查询单个质量检测记录
+func (t *AgriTrace) QueryQualityRecord(ctx contractapi.TransactionContextInterface, recordID string) (*QualityRecord, error) {
+	recordJSON, err := ctx.GetStub().GetState(recordID)
+	if err != nil {
+		return nil, fmt.Errorf("查询质量检测记录失败: %v", err)
+	}
+	if recordJSON == nil {
+		return nil, fmt.Errorf("质量检测记录不存在: %s", recordID)
+	}
+
+	var record QualityRecord
+	err = json.Unmarshal(recordJSON, &record)
+	if err != nil {
+		return nil, err
+	}
+
+	return &record, nil
+}
+
+// isQualityRecord 判断记录是否为完整的质量检测记录（全量扫描可能混入其他类型记录）
+func isQualityRecord(record *QualityRecord) bool {
+	return record.TestType != "" && record.InspectorID != ""
+}
+
+// supersedingRecord 查找取代指定记录的检测记录：申诉改判指定的复检记录，或同一产品、阶段、检测类型下时间更晚的记录
+func supersedingRecord(records []*QualityRecord, record *QualityRecord) *QualityRecord {
+	var latest *QualityRecord
+	for _, r := range records {
+		if record.SupersededBy != "" && r.ID == record.SupersededBy {
+			return r
+		}
+	}
+	for _, r := range records {
+		if r.ID == record.ID || !isQualityRecord(r) {
+			continue
+		}
+		if r.Stage != record.Stage || r.TestType != record.TestType {
+			continue
+		}
+		if r.RecordTime.After(record.RecordTime) && (latest == nil || r.RecordTime.After(latest.RecordTime)) {
+			latest = r
+		}
+	}
+	return latest
+}
+
+// currentQualityRecords 返回每个检测阶段、检测类型下未被取代的最新检测记录
+func currentQualityRecords(records []*QualityRecord) []*QualityRecord {
+	var current []*QualityRecord
+	for _, record := range records {
+		if !isQualityRecord(record) {
+			continue
+		}
+		if supersedingRecord(records, record) == nil {
+			current = append(current, record)
+		}
+	}
+
+	return current
+}
+
+// certificateEntry 证书哈希计算使用的检测记录规范化字段
+type certificateEntry struct {
+	ID          string `json:"id"`
+	ProductID   string `json:"productId"`
+	Stage       string `json:"stage"`
+	TestType    string `json:"testType"`
+	Result      string `json:"result"`
+	IsQualified bool   `json:"isQualified"`
+	RecordTime  string `json:"recordTime"`
+	InspectorID string `json:"inspectorId"`
+}
+
+// certificateHash 计算检测记录集合的规范化哈希：按记录ID排序后序列化固定字段，再做 SHA-256
+func certificateHash(productID string, records []*QualityRecord) (string, error) {
+	sorted := make([]*QualityRecord, len(records))
+	copy(sorted, records)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].ID < sorted[j].ID
+	})
+
+	entries := make([]certificateEntry, 0, len(sorted))
+	for _, record := range sorted {
+		entries = append(entries, certificateEntry{
+			ID:          record.ID,
+			ProductID:   record.ProductID,
+			Stage:       record.Stage,
+			TestType:    record.TestType,
+			Result:      record.Result,
+			IsQualified: record.IsQualified,
+			RecordTime:  record.RecordTime.UTC().Format(time.RFC3339Nano),
+			InspectorID: record.InspectorID,
+		})
+	}
+
+	payload, err := json.Marshal(struct {
+		ProductID string             `json:"productId"`
+		Records   []certificateEntry `json:"records"`
+	}{productID, entries})
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(payload)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// certificateRecords 收集产品当前可用于签发证书的检测记录，存在不合格记录时拒绝
+func (t *AgriTrace) certificateRecords(ctx contractapi.TransactionContextInterface, productID string) ([]*QualityRecord, error) {
+	allRecords, err := t.QueryQualityRecordsByProduct(ctx, productID)
+	if err != nil {
+		return nil, err
+	}
+
+	records := currentQualityRecords(allRecords)
+	if len(records) == 0 {
+		return nil, fmt.Errorf("产品没有质量检测记录: %s", productID)
+	}
+
+	for _, record := range records {
+		if !record.IsQualified {
+			return nil, fmt.Errorf("产品存在不合格的检测记录 %s，无法签发证书", record.ID)
+		}
+	}
+
+	return records, nil
+}
+
+// QueryCertificateHash 查询产品当前合格检测记录的规范化哈希，供检测员离线签名
+func (t *AgriTrace) QueryCertificateHash(ctx contractapi.TransactionContextInterface, productID string) (string, error) {
+	records, err := t.certificateRecords(ctx, productID)
+	if err != nil {
+		return "", err
+	}
+
+	return certificateHash(productID, records)
+}
+
+// IssueQualityCertificate 签发质量证书，签名内容为 QueryCertificateHash 返回的十六进制哈希
+func (t *AgriTrace) IssueQualityCertificate(ctx contractapi.TransactionContextInterface, certificateData string) error {
+	var certificate QualityCertificate
+	err := json.Unmarshal([]byte(certificateData), &certificate)
+	if err != nil {
+		return fmt.Errorf("解析证书数据失败: %v", err)
+	}
+
+	// 确保ID有正确的前缀
+	if !strings.HasPrefix(certificate.ID, "CERT_") {
+		certificate.ID = fmt.Sprintf("CERT_%s", certificate.ID)
+	}
+
+	// 检查证书是否已存在
+	certificateJSON, err := ctx.GetStub().GetState(certificate.ID)
+	if err != nil {
+		return err
+	}
+	if certificateJSON != nil {
+		return fmt.Errorf("证书已存在: %s", certificate.ID)
+	}
+
+	// 检查产品是否存在
+	exists, err := t.ProductExists(ctx, certificate.ProductID)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("产品不存在: %s", certificate.ProductID)
+	}
+
+	// 汇总合格检测记录并计算哈希
+	records, err := t.certificateRecords(ctx, certificate.ProductID)
+	if err != nil {
+		return err
+	}
+	hash, err := certificateHash(certificate.ProductID, records)
+	if err != nil {
+		return err
+	}
+
+	// 校验检测员签名
+	publicKey, err := t.getInspectorPublicKey(ctx, certificate.InspectorID)
+	if err != nil {
+		return err
+	}
+	err = verifySignature(publicKey, []byte(hash), certificate.Signature)
+	if err != nil {
+		return err
+	}
+
+	certificate.RecordIDs = nil
+	for _, record := range records {
+		certificate.RecordIDs = append(certificate.RecordIDs, record.ID)
+	}
+	sort.Strings(certificate.RecordIDs)
+	certificate.Hash = hash
+	certificate.IssuedAt = time.Now()
+
+	certificateJSON, err = json.Marshal(certificate)
+	if err != nil {
+		return err
+	}
+
+	return ctx.GetStub().PutState(certificate.ID, certificateJSON)
+}
+
+// QueryQualityCertificate 查询质量证书
+func (t *AgriTrace) QueryQualityCertificate(ctx contractapi.TransactionContextInterface, certificateID string) (*QualityCertificate, error) {
+	certificateJSON, err := ctx.GetStub().GetState(certificateID)
+	if err != nil {
+		return nil, fmt.Errorf("查询证书失败: %v", err)
+	}
+	if certificateJSON == nil {
+		return nil, fmt.Errorf("证书不存在: %s", certificateID)
+	}
+
+	var certificate QualityCertificate
+	err = json.Unmarshal(certificateJSON, &certificate)
+	if err != nil {
+		return nil, err
+	}
+
+	return &certificate, nil
+}
+
+// VerifyCertificate 校验质量证书：签名、记录哈希以及检测记录是否已被取代
+func (t *AgriTrace) VerifyCertificate(ctx contractapi.TransactionContextInterface, certificateID string) (*CertificateVerification, error) {
+	certificate, err := t.QueryQualityCertificate(ctx, certificateID)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &CertificateVerification{
+		CertificateID: certificate.ID,
+		Issues:        []string{},
+		VerifiedAt:    time.Now(),
+	}
+
+	// 校验签名
+	publicKey, err := t.getInspectorPublicKey(ctx, certificate.InspectorID)
+	if err == nil {
+		err = verifySignature(publicKey, []byte(certificate.Hash), certificate.Signature)
+	}
+	if err != nil {
+		result.Issues = append(result.Issues, err.Error())
+	} else {
+		result.SignatureValid = true
+	}
+
+	// 重新读取证书包含的检测记录并计算哈希
+	var records []*QualityRecord
+	for _, recordID := range certificate.RecordIDs {
+		record, err := t.QueryQualityRecord(ctx, recordID)
+		if err != nil {
+			result.Issues = append(result.Issues, err.Error())
+			continue
+		}
+		records = append(records, record)
+	}
+	if len(records) == len(certificate.RecordIDs) {
+		hash, err := certificateHash(certificate.ProductID, records)
+		if err != nil {
+			return nil, err
+		}
+		if hash == certificate.Hash {
+			result.HashValid = true
+		} else {
+			result.Issues = append(result.Issues, "检测记录内容与证书哈希不一致")
+		}
+	}
+
+	// 检查检测记录是否已被新记录取代
+	allRecords, err := t.QueryQualityRecordsByProduct(ctx, certificate.ProductID)
+	if err != nil {
+		return nil, err
+	}
+	for _, record := range records {
+		if newer := supersedingRecord(allRecords, record); newer != nil {
+			result.Superseded = true
+			result.Issues = append(result.Issues, fmt.Sprintf("检测记录 %s 已被 %s 取代", record.ID, newer.ID))
+		}
+	}
+
+	result.Valid = result.SignatureValid && result.HashValid && !result.Superseded
+
+	return result, nil
+}
+
+// qualityHoldState 计算质量冻结状态：申诉未决或存在未被取代的不合格检测记录时冻结
+func qualityHoldState(records []*QualityRecord, appeals []*QualityAppeal) (bool, string) {
+	for _, appeal := range appeals {
+		if appeal.Status == "OPEN" || appeal.Status == "REINSPECTING" {
+			return true, fmt.Sprintf("质量申诉处理中: %s", appeal.ID)
+		}
+	}
+
+	for _, record := range currentQualityRecords(records) {
+		if !record.IsQualified {
+			return true, fmt.Sprintf("检测不合格: %s", record.ID)
+		}
+	}
+
+	return false, ""
+}
+
+// updateQualityHold 重新计算并保存产品的质量冻结状态，pendingRecords/pendingAppeals 为本交易内已写入的记录
+func (t *AgriTrace) updateQualityHold(ctx contractapi.TransactionContextInterface, productID string, pendingRecords []*QualityRecord, pendingAppeals []*QualityAppeal) error {
+	product, err := t.QueryProduct(ctx, productID)
+	if err != nil {
+		return err
+	}
+
+	records, err := t.QueryQualityRecordsByProduct(ctx, productID)
+	if err != nil {
+		return err
+	}
+	appeals, err := t.QueryQualityAppealsByProduct(ctx, productID)
+	if err != nil {
+		return err
+	}
+
+	// 同一交易内写入无法被读取，用本交易内写入的版本替换账本中读取的同ID记录
+	pendingIDs := make(map[string]bool)
+	for _, record := range pendingRecords {
+		pendingIDs[record.ID] = true
+	}
+	for _, appeal := range pendingAppeals {
+		pendingIDs[appeal.ID] = true
+	}
+	current := append([]*QualityRecord{}, pendingRecords...)
+	for _, record := range records {
+		if !pendingIDs[record.ID] {
+			current = append(current, record)
+		}
+	}
+	currentAppeals := append([]*QualityAppeal{}, pendingAppeals...)
+	for _, appeal := range appeals {
+		if !pendingIDs[appeal.ID] {
+			currentAppeals = append(currentAppeals, appeal)
+		}
+	}
+
+	hold, reason := qualityHoldState(current, currentAppeals)
+	if hold == product.QualityHold && reason == product.QualityHoldReason {
+		return nil
+	}
+
+	product.QualityHold = hold
+	product.QualityHoldReason = reason
+	product.UpdatedAt = time.Now()
+
+	productJSON, err := json.Marshal(product)
+	if err != nil {
+		return err
+	}
+
+	return ctx.GetStub().PutState(productID, productJSON)
+}
+
+// putQualityAppeal 保存质量申诉
+func putQualityAppeal(ctx contractapi.TransactionContextInterface, appeal *QualityAppeal) error {
+	appealJSON, err := json.Marshal(appeal)
+	if err != nil {
+		return err
+	}
+
+	return ctx.GetStub().PutState(appeal.ID, appealJSON)
+}
+
+// OpenAppeal 农户对不合格检测记录提起申诉
+func (t *AgriTrace) OpenAppeal(ctx contractapi.TransactionContextInterface, appealData string) error {
+	var appeal QualityAppeal
+	err := json.Unmarshal([]byte(appealData), &appeal)
+	if err != nil {
+		return fmt.Errorf("解析申诉数据失败: %v", err)
+	}
+
+	// 确保ID有正确的前缀
+	if !strings.HasPrefix(appeal.ID, "APPEAL_") {
+		appeal.ID = fmt.Sprintf("APPEAL_%s", appeal.ID)
+	}
+
+	// 检查申诉是否已存在
+	appealJSON, err := ctx.GetStub().GetState(appeal.ID)
+	if err != nil {
+		return err
+	}
+	if appealJSON != nil {
+		return fmt.Errorf("申诉已存在: %s", appeal.ID)
+	}
+
+	original, err := t.QueryQualityRecord(ctx, appeal.OriginalRecordID)
+	if err != nil {
+		return err
+	}
+	if original.IsQualified {
+		return fmt.Errorf("只能对不合格的检测记录提起申诉: %s", original.ID)
+	}
+
+	product, err := t.QueryProduct(ctx, original.ProductID)
+	if err != nil {
+		return err
+	}
+	if product.FarmerID != appeal.FarmerID {
+		return fmt.Errorf("只有产品所属农户可以提起申诉")
+	}
+
+	// 只能对当前有效的检测结果申诉，且同一记录只能有一个未决申诉
+	records, err := t.QueryQualityRecordsByProduct(ctx, original.ProductID)
+	if err != nil {
+		return err
+	}
+	if newer := supersedingRecord(records, original); newer != nil {
+		return fmt.Errorf("检测记录 %s 已被 %s 取代", original.ID, newer.ID)
+	}
+
+	appeals, err := t.QueryQualityAppealsByProduct(ctx, original.ProductID)
+	if err != nil {
+		return err
+	}
+	for _, existing := range appeals {
+		if existing.OriginalRecordID == original.ID && existing.Status != "RESOLVED" {
+			return fmt.Errorf("该检测记录已有未决申诉: %s", existing.ID)
+		}
+	}
+
+	appeal.ProductID = original.ProductID
+	appeal.Status = "OPEN"
+	appeal.ReinspectorID = ""
+	appeal.ReinspectionRecordID = ""
+	appeal.Decision = ""
+	appeal.DecisionNote = ""
+	appeal.OpenedAt = time.Now()
+	appeal.UpdatedAt = appeal.OpenedAt
+	appeal.ResolvedAt = time.Time{}
+
+	err = putQualityAppeal(ctx, &appeal)
+	if err != nil {
+		return err
+	}
+
+	return t.updateQualityHold(ctx, appeal.ProductID, nil, []*QualityAppeal{&appeal})
+}
+
+// AssignReinspection 为申诉指派复检员，复检员不能是原检测员
+func (t *AgriTrace) AssignReinspection(ctx contractapi.TransactionContextInterface, appealID string, inspectorID string) error {
+	appeal, err := t.QueryQualityAppeal(ctx, appealID)
+	if err != nil {
+		return err
+	}
+	if appeal.Status != "OPEN" {
+		return fmt.Errorf("只有已提交的申诉可以指派复检，当前状态: %s", appeal.Status)
+	}
+
+	exists, err := t.InspectorExists(ctx, inspectorID)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("检查员不存在: %s", inspectorID)
+	}
+
+	original, err := t.QueryQualityRecord(ctx, appeal.OriginalRecordID)
+	if err != nil {
+		return err
+	}
+	if original.InspectorID == inspectorID {
+		return fmt.Errorf("复检员不能是原检测员: %s", inspectorID)
+	}
+
+	appeal.Status = "REINSPECTING"
+	appeal.ReinspectorID = inspectorID
+	appeal.UpdatedAt = time.Now()
+
+	return putQualityAppeal(ctx, appeal)
+}
+
+// ResolveAppeal 根据复检记录裁决申诉：复检合格则改判并取代原记录，否则维持原结果
+func (t *AgriTrace) ResolveAppeal(ctx contractapi.TransactionContextInterface, appealID string, reinspectionRecordID string, note string) error {
+	appeal, err := t.QueryQualityAppeal(ctx, appealID)
+	if err != nil {
+		return err
+	}
+	if appeal.Status != "REINSPECTING" {
+		return fmt.Errorf("只有复检中的申诉可以裁决，当前状态: %s", appeal.Status)
+	}
+
+	reinspection, err := t.QueryQualityRecord(ctx, reinspectionRecordID)
+	if err != nil {
+		return err
+	}
+	if reinspection.AppealID != appeal.ID || reinspection.ReinspectionOf != appeal.OriginalRecordID {
+		return fmt.Errorf("检测记录 %s 不是该申诉的复检记录", reinspection.ID)
+	}
+
+	original, err := t.QueryQualityRecord(ctx, appeal.OriginalRecordID)
+	if err != nil {
+		return err
+	}
+
+	var pendingRecords []*QualityRecord
+	if reinspection.IsQualified {
+		appeal.Decision = "OVERTURNED"
+
+		// 改判：原记录标记为被复检记录取代
+		original.SupersededBy = reinspection.ID
+		originalJSON, err := json.Marshal(original)
+		if err != nil {
+			return err
+		}
+		err = ctx.GetStub().PutState(original.ID, originalJSON)
+		if err != nil {
+			return err
+		}
+		pendingRecords = append(pendingRecords, original)
+	} else {
+		appeal.Decision = "UPHELD"
+	}
+
+	appeal.Status = "RESOLVED"
+	appeal.ReinspectionRecordID = reinspection.ID
+	appeal.DecisionNote = note
+	appeal.UpdatedAt = time.Now()
+	appeal.ResolvedAt = appeal.UpdatedAt
+
+	err = putQualityAppeal(ctx, appeal)
+	if err != nil {
+		return err
+	}
+
+	return t.updateQualityHold(ctx, appeal.ProductID, pendingRecords, []*QualityAppeal{appeal})
+}
+
+// QueryQualityAppeal 查询单个质量申诉
+func (t *AgriTrace) QueryQualityAppeal(ctx contractapi.TransactionContextInterface, appealID string) (*QualityAppeal, error) {
+	appealJSON, err := ctx.GetStub().GetState(appealID)
+	if err != nil {
+		return nil, fmt.Errorf("查询申诉失败: %v", err)
+	}
+	if appealJSON == nil {
+		return nil, fmt.Errorf("申诉不存在: %s", appealID)
+	}
+
+	var appeal QualityAppeal
+	err = json.Unmarshal(appealJSON, &appeal)
+	if err != nil {
+		return nil, err
+	}
+
+	return &appeal, nil
+}
+
+// QueryQualityAppealsByProduct 查询产品的质量申诉
+func (t *AgriTrace) QueryQualityAppealsByProduct(ctx contractapi.TransactionContextInterface, productID string) ([]*QualityAppeal, error) {
+	resultsIterator, err := ctx.GetStub().GetStateByRange("", "")
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	var appeals []*QualityAppeal
+	for resultsIterator.HasNext() {
+		queryResult, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		// 只处理以APPEAL_开头的记录
+		if !strings.HasPrefix(queryResult.Key, "APPEAL_") {
+			continue
+		}
+
+		var appeal QualityAppeal
+		err = json.Unmarshal(queryResult.Value, &appeal)
+		if err != nil {
+			continue // 跳过非申诉记录
+		}
+
+		if appeal.ProductID == productID {
+			appeals = append(appeals, &appeal)
+		}
+	}
+
+	// 如果没有找到记录，返回空数组而不是 nil
+	if appeals == nil {
+		appeals = []*QualityAppeal{}
+	}
+
+	// 按申诉时间倒序排序
+	sort.Slice(appeals, func(i, j int) bool {
+		return appeals[i].OpenedAt.After(appeals[j].OpenedAt)
+	})
+
+	return appeals, nil
+}
+
+// checkCustodyChain 检查样品保管链是否完整：从采样人开始逐级交接、封条完好，最终由实验室接收
+func checkCustodyChain(sample *Sample) error {
+	if sample.Status != "RECEIVED_BY_LAB" {
+		return fmt.Errorf("样品 %s 尚未由实验室接收，当前状态: %s", sample.ID, sample.Status)
+	}
+	if len(sample.Custody) == 0 {
+		return fmt.Errorf("样品 %s 缺少保管交接记录", sample.ID)
+	}
+
+	holder := sample.SamplerID
+	for i, transfer := range sample.Custody {
+		if transfer.FromID != holder {
+			return fmt.Errorf("样品 %s 第 %d 次交接的移交人 %s 不是当时的保管人 %s", sample.ID, i+1, transfer.FromID, holder)
+		}
+		if !transfer.SealIntact {
+			return fmt.Errorf("样品 %s 第 %d 次交接封条异常", sample.ID, i+1)
+		}
+		holder = transfer.ToID
+	}
+
+	last := sample.Custody[len(sample.Custody)-1]
+	if !last.ToLab || last.ToID != sample.LabID {
+		return fmt.Errorf("样品 %s 的保管链未终止于实验室", sample.ID)
+	}
+
+	return nil
+}
+
+// putSample 保存样品
+func putSample(ctx contractapi.TransactionContextInterface, sample *Sample) error {
+	sampleJSON, err := json.Marshal(sample)
+	if err != nil {
+		return err
+	}
+
+	return ctx.GetStub().PutState(sample.ID, sampleJSON)
+}
+
+// RegisterSample 登记采样信息，采样人为初始保管人
+func (t *AgriTrace) RegisterSample(ctx contractapi.TransactionContextInterface, sampleData string) error {
+	var sample Sample
+	err := json.Unmarshal([]byte(sampleData), &sample)
+	if err != nil {
+		return fmt.Errorf("解析样品数据失败: %v", err)
+	}
+
+	// 确保ID有正确的前缀
+	if !strings.HasPrefix(sample.ID, "SAMPLE_") {
+		sample.ID = fmt.Sprintf("SAMPLE_%s", sample.ID)
+	}
+
+	// 检查样品是否已存在
+	sampleJSON, err := ctx.GetStub().GetState(sample.ID)
+	if err != nil {
+		return err
+	}
+	if sampleJSON != nil {
+		return fmt.Errorf("样品已存在: %s", sample.ID)
+	}
+
+	// 检查产品是否存在
+	exists, err := t.ProductExists(ctx, sample.ProductID)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("产品不存在: %s", sample.ProductID)
+	}
+
+	// 检查必要字段
+	if len(sample.SamplerID) == 0 {
+		return fmt.Errorf("采样人ID不能为空")
+	}
+	if len(sample.SealNumber) == 0 {
+		return fmt.Errorf("封条编号不能为空")
+	}
+	if sample.SampleSize <= 0 {
+		return fmt.Errorf("样品数量必须大于0")
+	}
+
+	sample.CreatedAt = time.Now()
+	if sample.SampledAt.IsZero() {
+		sample.SampledAt = sample.CreatedAt
+	}
+	sample.CustodianID = sample.SamplerID
+	sample.LabID = ""
+	sample.Status = "COLLECTED"
+	sample.Custody = []CustodyTransfer{}
+
+	return putSample(ctx, &sample)
+}
+
+// TransferSampleCustody 样品保管交接，接收方核对封条编号；toLab 为 true 表示移交实验室
+func (t *AgriTrace) TransferSampleCustody(ctx contractapi.TransactionContextInterface, sampleID string, fromID string, toID string, sealNumber string, toLab bool) error {
+	sample, err := t.QuerySample(ctx, sampleID)
+	if err != nil {
+		return err
+	}
+
+	if sample.Status != "COLLECTED" && sample.Status != "IN_CUSTODY" {
+		return fmt.Errorf("样品当前状态不允许交接: %s", sample.Status)
+	}
+	if fromID != sample.CustodianID {
+		return fmt.Errorf("移交人 %s 不是样品当前保管人 %s", fromID, sample.CustodianID)
+	}
+	if len(toID) == 0 || toID == fromID {
+		return fmt.Errorf("接收人ID无效: %s", toID)
+	}
+
+	transfer := CustodyTransfer{
+		FromID:       fromID,
+		ToID:         toID,
+		SealNumber:   sealNumber,
+		SealIntact:   sealNumber == sample.SealNumber,
+		ToLab:        toLab,
+		TransferTime: time.Now(),
+	}
+	sample.Custody = append(sample.Custody, transfer)
+	sample.CustodianID = toID
+
+	// 封条编号不符的样品不能再用于检测
+	switch {
+	case !transfer.SealIntact:
+		sample.Status = "COMPROMISED"
+	case toLab:
+		sample.Status = "RECEIVED_BY_LAB"
+		sample.LabID = toID
+	default:
+		sample.Status = "IN_CUSTODY"
+	}
+
+	return putSample(ctx, sample)
+}
+
+// QuerySample 查询样品及其保管链
+func (t *AgriTrace) QuerySample(ctx contractapi.TransactionContextInterface, sampleID string) (*Sample, error) {
+	if len(sampleID) == 0 {
+		return nil, fmt.Errorf("样品ID不能为空")
+	}
+
+	sampleJSON, err := ctx.GetStub().GetState(sampleID)
+	if err != nil {
+		return nil, fmt.Errorf("查询样品失败: %v", err)
+	}
+	if sampleJSON == nil {
+		return nil, fmt.Errorf("样品不存在: %s", sampleID)
+	}
+
+	var sample Sample
+	err = json.Unmarshal(sampleJSON, &sample)
+	if err != nil {
+		return nil, err
+	}
+
+	return &sample, nil
+}
+
+// QuerySamplesByProduct 查询产品的检测样品
+func (t *AgriTrace) QuerySamplesByProduct(ctx contractapi.TransactionContextInterface, productID string) ([]*Sample, error) {
+	resultsIterator, err := ctx.GetStub().GetStateByRange("", "")
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	var samples []*Sample
+	for resultsIterator.HasNext() {
+		queryResult, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		// 只处理以SAMPLE_开头的记录
+		if !strings.HasPrefix(queryResult.Key, "SAMPLE_") {
+			continue
+		}
+
+		var sample Sample
+		err = json.Unmarshal(queryResult.Value, &sample)
+		if err != nil {
+			continue // 跳过非样品记录
+		}
+
+		if sample.ProductID == productID {
+			samples = append(samples, &sample)
+		}
+	}
+
+	// 如果没有找到记录，返回空数组而不是 nil
+	if samples == nil {
+		samples = []*Sample{}
+	}
+
+	return samples, nil
+}
+
+// defaultEnvironmentThreshold 未配置阈值时使用的默认阈值
+var defaultEnvironmentThreshold = EnvironmentThreshold{
+	ID:             "THRESHOLD_DEFAULT",
+	MinTemperature: 0,
+	MaxTemperature: 35,
+	MinHumidity:    0,
+	MaxHumidity:    100,
+	Limits: []MetricLimit{
+		{Metric: "temperature", Min: 0, Max: 35},
+		{Metric: "humidity", Min: 0, Max: 100},
+	},
+}
+
+// sensorMetricUnits 内置指标及其标准单位
+var sensorMetricUnits = map[string]string{
+	"temperature":     "°C",
+	"humidity":        "%",
+	"soil_moisture":   "%",
+	"soil_ph":         "pH",
+	"ec":              "mS/cm",
+	"light_intensity": "lux",
+	"co2":             "ppm",
+	"rainfall":        "mm",
+}
+
+// sensorMetricRanges 内置指标的物理有效范围，超出范围说明传感器数据无效
+var sensorMetricRanges = map[string][2]float64{
+	"humidity":        {0, 100},
+	"soil_moisture":   {0, 100},
+	"soil_ph":         {0, 14},
+	"ec":              {0, math.MaxFloat64},
+	"light_intensity": {0, math.MaxFloat64},
+	"co2":             {0, math.MaxFloat64},
+	"rainfall":        {0, math.MaxFloat64},
+}
+
+// normalizeEnvironmentMetrics 统一环境记录的指标读数：
+// 只提交温度、湿度字段的旧格式记录转换为指标读数，提交指标读数的记录回填温度、湿度字段
+func normalizeEnvironmentMetrics(record *EnvironmentRecord) error {
+	if len(record.Metrics) == 0 {
+		record.Metrics = []SensorMetric{
+			{Metric: "temperature", Value: record.Temperature, Unit: sensorMetricUnits["temperature"]},
+			{Metric: "humidity", Value: record.Humidity, Unit: sensorMetricUnits["humidity"]},
+		}
+	}
+
+	// 旧字段只由指标读数回填，未采集的指标保持为 0 且不写出
+	record.Temperature = 0
+	record.Humidity = 0
+
+	seen := make(map[string]bool)
+	for i := range record.Metrics {
+		metric := &record.Metrics[i]
+		if metric.Metric == "" {
+			return fmt.Errorf("指标名称不能为空")
+		}
+		if seen[metric.Metric] {
+			return fmt.Errorf("指标重复: %s", metric.Metric)
+		}
+		seen[metric.Metric] = true
+
+		// 内置指标使用标准单位，自定义指标必须提供单位
+		if unit, ok := sensorMetricUnits[metric.Metric]; ok {
+			if metric.Unit == "" {
+				metric.Unit = unit
+			} else if metric.Unit != unit {
+				return fmt.Errorf("指标 %s 的单位应为 %s: %s", metric.Metric, unit, metric.Unit)
+			}
+		} else if metric.Unit == "" {
+			return fmt.Errorf("自定义指标 %s 必须提供单位", metric.Metric)
+		}
+
+		if valid, ok := sensorMetricRanges[metric.Metric]; ok && (metric.Value < valid[0] || metric.Value > valid[1]) {
+			return fmt.Errorf("%s数据无效: %f", metricDisplayName(metric.Metric), metric.Value)
+		}
+
+		switch metric.Metric {
+		case "temperature":
+			record.Temperature = metric.Value
+		case "humidity":
+			record.Humidity = metric.Value
+		}
+	}
+
+	return nil
+}
+
+// metricDisplayName 指标的中文名称，用于错误信息
+func metricDisplayName(metric string) string {
+	names := map[string]string{
+		"temperature":     "温度",
+		"humidity":        "湿度",
+		"soil_moisture":   "土壤含水量",
+		"soil_ph":         "土壤pH",
+		"ec":              "电导率",
+		"light_intensity": "光照强度",
+		"co2":             "二氧化碳浓度",
+		"rainfall":        "降雨量",
+	}
+	if name, ok := names[metric]; ok {
+		return name
+	}
+	return metric
+}
+
+// normalizeThreshold 统一阈值配置：旧格式转换为按指标阈值（上下限均为0的指标视为未设置），按指标阈值回填温度、湿度字段
+func normalizeThreshold(threshold *EnvironmentThreshold) {
+	if len(threshold.Limits) == 0 {
+		threshold.Limits = []MetricLimit{}
+		if threshold.MinTemperature != 0 || threshold.MaxTemperature != 0 {
+			threshold.Limits = append(threshold.Limits, MetricLimit{Metric: "temperature", Min: threshold.MinTemperature, Max: threshold.MaxTemperature})
+		}
+		if threshold.MinHumidity != 0 || threshold.MaxHumidity != 0 {
+			threshold.Limits = append(threshold.Limits, MetricLimit{Metric: "humidity", Min: threshold.MinHumidity, Max: threshold.MaxHumidity})
+		}
+		return
+	}
+
+	for _, limit := range threshold.Limits {
+		switch limit.Metric {
+		case "temperature":
+			threshold.MinTemperature, threshold.MaxTemperature = limit.Min, limit.Max
+		case "humidity":
+			threshold.MinHumidity, threshold.MaxHumidity = limit.Min, limit.Max
+		}
+	}
+}
+
+// thresholdKey 生成阈值配置的存储键
+func thresholdKey(crop string, productID string) string {
+	if productID != "" {
+		return fmt.Sprintf("THRESHOLD_PRODUCT_%s", productID)
+	}
+	return fmt.Sprintf("THRESHOLD_CROP_%s", crop)
+}
+
+// checkEnvironmentThreshold 按指标检查环境记录是否超出阈值，返回告警列表
+func checkEnvironmentThreshold(record *EnvironmentRecord, threshold *EnvironmentThreshold) []EnvironmentAlert {
+	var alerts []EnvironmentAlert
+	for _, metric := range record.Metrics {
+		for _, limit := range threshold.Limits {
+			if limit.Metric != metric.Metric {
+				continue
+			}
+			if metric.Value < limit.Min || metric.Value > limit.Max {
+				alerts = append(alerts, EnvironmentAlert{
+					Metric: metric.Metric,
+					Value:  metric.Value,
+					Unit:   metric.Unit,
+					Min:    limit.Min,
+					Max:    limit.Max,
+				})
+			}
+		}
+	}
+	return alerts
+}
+
+// SetEnvironmentThreshold 设置作物或产品的环境阈值，已存在的配置将被覆盖
+func (t *AgriTrace) SetEnvironmentThreshold(ctx contractapi.TransactionContextInterface, thresholdData string) error {
+	var threshold EnvironmentThreshold
+	err := json.Unmarshal([]byte(thresholdData), &threshold)
+	if err != nil {
+		return fmt.Errorf("解析阈值数据失败: %v", err)
+	}
+
+	if threshold.ProductID != "" {
+		exists, err := t.ProductExists(ctx, threshold.ProductID)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return fmt.Errorf("产品不存在: %s", threshold.ProductID)
+		}
+	} else if threshold.Crop == "" {
+		return fmt.Errorf("作物名称和产品ID不能同时为空")
+	}
+
+	normalizeThreshold(&threshold)
+	if len(threshold.Limits) == 0 {
+		return fmt.Errorf("至少需要设置一个指标的阈值")
+	}
+	seen := make(map[string]bool)
+	for _, limit := range threshold.Limits {
+		if limit.Metric == "" {
+			return fmt.Errorf("指标名称不能为空")
+		}
+		if seen[limit.Metric] {
+			return fmt.Errorf("指标阈值重复: %s", limit.Metric)
+		}
+		seen[limit.Metric] = true
+		if limit.Min > limit.Max {
+			return fmt.Errorf("%s下限不能高于上限", metricDisplayName(limit.Metric))
+		}
+	}
+
+	threshold.ID = thresholdKey(threshold.Crop, threshold.ProductID)
+	threshold.UpdatedAt = time.Now()
+
+	thresholdJSON, err := json.Marshal(threshold)
+	if err != nil {
+		return err
+	}
+
+	return ctx.GetStub().PutState(threshold.ID, thresholdJSON)
+}
+
+// QueryEnvironmentThreshold 根据ID查询阈值配置
+func (t *AgriTrace) QueryEnvironmentThreshold(ctx contractapi.TransactionContextInterface, thresholdID string) (*EnvironmentThreshold, error) {
+	thresholdJSON, err := ctx.GetStub().GetState(thresholdID)
+	if err != nil {
+		return nil, fmt.Errorf("查询阈值配置失败: %v", err)
+	}
+	if thresholdJSON == nil {
+		return nil, fmt.Errorf("阈值配置不存在: %s", thresholdID)
+	}
+
+	var threshold EnvironmentThreshold
+	err = json.Unmarshal(thresholdJSON, &threshold)
+	if err != nil {
+		return nil, err
+	}
+	normalizeThreshold(&threshold)
+
+	return &threshold, nil
+}
+
+// QueryEffectiveThreshold 查询产品生效的阈值：产品配置优先，其次为作物配置，最后为默认阈值
+func (t *AgriTrace) QueryEffectiveThreshold(ctx contractapi.TransactionContextInterface, productID string) (*EnvironmentThreshold, error) {
+	product, err := t.QueryProduct(ctx, productID)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, key := range []string{thresholdKey("", product.ID), thresholdKey(product.Name, "")} {
+		thresholdJSON, err := ctx.GetStub().GetState(key)
+		if err != nil {
+			return nil, fmt.Errorf("查询阈值配置失败: %v", err)
+		}
+		if thresholdJSON == nil {
+			continue
+		}
+
+		var threshold EnvironmentThreshold
+		err = json.Unmarshal(thresholdJSON, &threshold)
+		if err != nil {
+			return nil, err
+		}
+		normalizeThreshold(&threshold)
+		return &threshold, nil
+	}
+
+	threshold := defaultEnvironmentThreshold
+	threshold.Limits = append([]MetricLimit(nil), defaultEnvironmentThreshold.Limits...)
+	return &threshold, nil
+}
+
+// QueryEnvironmentAlerts 查询产品超出阈值的环境记录
+func (t *AgriTrace) QueryEnvironmentAlerts(ctx contractapi.TransactionContextInterface, productID string) ([]*EnvironmentRecord, error) {
+	records, err := t.QueryEnvironmentRecords(ctx, productID)
+	if err != nil {
+		return nil, err
+	}
+
+	alerts := []*EnvironmentRecord{}
+	for _, record := range records {
+		if len(record.Alerts) > 0 {
+			alerts = append(alerts, record)
+		}
+	}
+
+	// 按记录时间倒序排序
+	sort.Slice(alerts, func(i, j int) bool {
+		return alerts[i].RecordTime.After(alerts[j].RecordTime)
+	})
+
+	return alerts, nil
+}
+
+// QueryEnvironmentMetric 查询产品某一指标的历史读数，按记录时间升序排列
+func (t *AgriTrace) QueryEnvironmentMetric(ctx contractapi.TransactionContextInterface, productID string, metric string) ([]*MetricReading, error) {
+	records, err := t.QueryEnvironmentRecords(ctx, productID)
+	if err != nil {
+		return nil, err
+	}
+
+	readings := []*MetricReading{}
+	for _, record := range records {
+		// 旧格式记录只有温度、湿度字段
+		if len(record.Metrics) == 0 && normalizeEnvironmentMetrics(record) != nil {
+			continue
+		}
+
+		for _, m := range record.Metrics {
+			if m.Metric != metric {
+				continue
+			}
+
+			isAlert := false
+			for _, alert := range record.Alerts {
+				if alert.Metric == metric {
+					isAlert = true
+					break
+				}
+			}
+
+			readings = append(readings, &MetricReading{
+				RecordID:   record.ID,
+				Value:      m.Value,
+				Unit:       m.Unit,
+				RecordTime: record.RecordTime,
+				IsAlert:    isAlert,
+			})
+		}
+	}
+
+	sort.Slice(readings, func(i, j int) bool {
+		return readings[i].RecordTime.Before(readings[j].RecordTime)
+	})
+
+	return readings, nil
+}
+
+// maxBatchReadings 单次批量上报的最大读数条数
+const maxBatchReadings = 1000
+
+// maxReadingClockSkew 读数采集时间允许超前于当前时间的范围
+const maxReadingClockSkew = 5 * time.Minute
+
+// environmentBucketKey 生成产品某小时的数据桶键
+func environmentBucketKey(productID string, recordTime time.Time) string {
+	return fmt.Sprintf("ENVBUCKET_%s_%s", productID, recordTime.UTC().Format("2006010215"))
+}
+
+// environmentReadingExists 判断读数是否已作为单条环境记录或批量读数写入。
+// 产品和采集时间参与设备签名，重放的读数必然落在同一数据桶，因此只在该数据桶内查重
+func environmentReadingExists(ctx contractapi.TransactionContextInterface, record *EnvironmentRecord) (bool, error) {
+	recordJSON, err := ctx.GetStub().GetState(record.ID)
+	if err != nil {
+		return false, fmt.Errorf("查询环境记录失败: %v", err)
+	}
+	if recordJSON != nil {
+		return true, nil
+	}
+
+	bucketJSON, err := ctx.GetStub().GetState(environmentBucketKey(record.ProductID, record.RecordTime))
+	if err != nil {
+		return false, fmt.Errorf("查询数据桶失败: %v", err)
+	}
+	if bucketJSON == nil {
+		return false, nil
+	}
+	var bucket EnvironmentBucket
+	err = json.Unmarshal(bucketJSON, &bucket)
+	if err != nil {
+		return false, err
+	}
+
+	return bucket.hasReading(record.ID), nil
+}
+
+// hasReading 判断数据桶中是否已有指定ID的读数
+func (b *EnvironmentBucket) hasReading(readingID string) bool {
+	for _, reading := range b.Readings {
+		if reading.ID == readingID {
+			return true
+		}
+	}
+	return false
+}
+
+// records 将数据桶中的读数展开为环境记录
+func (b *EnvironmentBucket) records() []*EnvironmentRecord {
+	records := make([]*EnvironmentRecord, 0, len(b.Readings))
+	for _, reading := range b.Readings {
+		record := &EnvironmentRecord{
+			ID:         reading.ID,
+			ProductID:  b.ProductID,
+			RecordTime: reading.RecordTime,
+			OperatorID: reading.OperatorID,
+			Metrics:    reading.Metrics,
+			Alerts:     reading.Alerts,
+			DeviceID:   reading.DeviceID,
+			Signature:  reading.Signature,
+		}
+		for _, metric := range reading.Metrics {
+			switch metric.Metric {
+			case "temperature":
+				record.Temperature = metric.Value
+			case "humidity":
+				record.Humidity = metric.Value
+			}
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+// AddEnvironmentBatch 批量写入环境读数，按产品、小时分桶存储，逐条返回接收或拒绝结果
+func (t *AgriTrace) AddEnvironmentBatch(ctx contractapi.TransactionContextInterface, batchData string) (*BatchIngestionResult, error) {
+	var batch EnvironmentBatch
+	err := json.Unmarshal([]byte(batchData), &batch)
+	if err != nil {
+		return nil, fmt.Errorf("解析批量环境数据失败: %v", err)
+	}
+
+	if len(batch.Readings) == 0 {
+		return nil, fmt.Errorf("批量环境数据不能为空")
+	}
+	if len(batch.Readings) > maxBatchReadings {
+		return nil, fmt.Errorf("单次最多上报 %d 条读数，当前 %d 条", maxBatchReadings, len(batch.Readings))
+	}
+
+	result := &BatchIngestionResult{
+		BatchID: batch.BatchID,
+		Results: make([]ReadingResult, 0, len(batch.Readings)),
+	}
+
+	now := time.Now()
+	devices := make(map[string]*Device)
+	thresholds := make(map[string]*EnvironmentThreshold)
+	buckets := make(map[string]*EnvironmentBucket)
+	var bucketKeys []string
+	var accepted []*EnvironmentRecord
+	seen := make(map[string]bool)
+
+	for i := range batch.Readings {
+		record := &batch.Readings[i]
+		readingResult := ReadingResult{
+			ReadingID: record.ID,
+			ProductID: record.ProductID,
+		}
+
+		reject := func(reason string) {
+			readingResult.Error = reason
+			result.Rejected++
+			result.Results = append(result.Results, readingResult)
+		}
+
+		if record.ID == "" {
+			reject("读数ID不能为空")
+			continue
+		}
+
+		// 同一批次内以及以单条记录上报过的读数ID不能再次写入
+		exists := seen[record.ID]
+		if !exists {
+			recordJSON, err := ctx.GetStub().GetState(record.ID)
+			if err != nil {
+				return nil, fmt.Errorf("查询环境记录失败: %v", err)
+			}
+			exists = recordJSON != nil
+		}
+		if exists {
+			reject(fmt.Sprintf("读数已存在: %s", record.ID))
+			continue
+		}
+
+		// 每个产品只查询一次阈值，产品不存在时同时得到错误
+		threshold, ok := thresholds[record.ProductID]
+		if !ok {
+			threshold, err = t.QueryEffectiveThreshold(ctx, record.ProductID)
+			if err != nil {
+				reject(err.Error())
+				continue
+			}
+			thresholds[record.ProductID] = threshold
+		}
+
+		if record.RecordTime.IsZero() {
+			reject("采集时间不能为空")
+			continue
+		}
+		if record.RecordTime.After(now.Add(maxReadingClockSkew)) {
+			reject(fmt.Sprintf("采集时间晚于当前时间: %s", record.RecordTime.Format(time.RFC3339)))
+			continue
+		}
+
+		// 校验设备对原始读数的签名，每个设备只查询一次
+		if len(record.DeviceID) > 0 && !strings.HasPrefix(record.DeviceID, "DEVICE_") {
+			record.DeviceID = fmt.Sprintf("DEVICE_%s", record.DeviceID)
+		}
+		device, ok := devices[record.DeviceID]
+		if !ok {
+			device, err = t.QueryDevice(ctx, record.DeviceID)
+			if err != nil {
+				reject(err.Error())
+				continue
+			}
+			devices[record.DeviceID] = device
+		}
+		err = verifyDeviceReading(device, record)
+		if err != nil {
+			reject(err.Error())
+			continue
+		}
+
+		err = normalizeEnvironmentMetrics(record)
+		if err != nil {
+			reject(err.Error())
+			continue
+		}
+
+		// 读取数据桶，同一交易内的写入无法再次读取，因此缓存在内存中
+		key := environmentBucketKey(record.ProductID, record.RecordTime)
+		bucket, ok := buckets[key]
+		if !ok {
+			bucketJSON, err := ctx.GetStub().GetState(key)
+			if err != nil {
+				return nil, fmt.Errorf("查询数据桶失败: %v", err)
+			}
+			bucket = &EnvironmentBucket{
+				ID:        key,
+				ProductID: record.ProductID,
+				Hour:      record.RecordTime.UTC().Truncate(time.Hour),
+			}
+			if bucketJSON != nil {
+				err = json.Unmarshal(bucketJSON, bucket)
+				if err != nil {
+					return nil, err
+				}
+			}
+			buckets[key] = bucket
+			bucketKeys = append(bucketKeys, key)
+		}
+
+		// 产品和采集时间参与签名，重放的读数必然落在同一数据桶，在数据桶内查重
+		if bucket.hasReading(record.ID) {
+			reject(fmt.Sprintf("读数已存在: %s", record.ID))
+			continue
+		}
+
+		record.Alerts = checkEnvironmentThreshold(record, threshold)
+		bucket.Readings = append(bucket.Readings, EnvironmentReading{
+			ID:         record.ID,
+			RecordTime: record.RecordTime,
+			OperatorID: record.OperatorID,
+			Metrics:    record.Metrics,
+			Alerts:     record.Alerts,
+			DeviceID:   record.DeviceID,
+			Signature:  record.Signature,
+		})
+		seen[record.ID] = true
+
+		accepted = append(accepted, record)
+		readingResult.Accepted = true
+		readingResult.BucketID = key
+		readingResult.Alerts = record.Alerts
+		result.Accepted++
+		if len(record.Alerts) > 0 {
+			result.Alerts++
+		}
+		result.Results = append(result.Results, readingResult)
+	}
+
+	// 按键顺序写入数据桶，保证各背书节点写集一致
+	sort.Strings(bucketKeys)
+	for _, key := range bucketKeys {
+		bucket := buckets[key]
+		sort.SliceStable(bucket.Readings, func(i, j int) bool {
+			return bucket.Readings[i].RecordTime.Before(bucket.Readings[j].RecordTime)
+		})
+		bucket.UpdatedAt = now
+
+		bucketJSON, err := json.Marshal(bucket)
+		if err != nil {
+			return nil, err
+		}
+		err = ctx.GetStub().PutState(key, bucketJSON)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// 更新每日汇总
+	err = t.updateEnvironmentDailySummaries(ctx, accepted)
+	if err != nil {
+		return nil, err
+	}
+
+	// 触发批量环境异常事件，事件内容为批次中的告警读数（[]ReadingResult），
+	// 与单条记录的 EnvironmentAlert 事件（EnvironmentRecord）区分
+	if result.Alerts > 0 {
+		var alerted []ReadingResult
+		for _, r := range result.Results {
+			if len(r.Alerts) > 0 {
+				alerted = append(alerted, r)
+			}
+		}
+		eventJSON, err := json.Marshal(alerted)
+		if err != nil {
+			return nil, err
+		}
+		err = ctx.GetStub().SetEvent("EnvironmentBatchAlert", eventJSON)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return result, nil
+}
+
+// environmentReadingPayload 生成设备签名的规范化内容，签名覆盖设备上报的原始读数（单位补全等处理之前）：
+// 对读数ID、设备ID、产品ID、采集时间（UTC，RFC3339Nano）和按名称排序的指标读数做 JSON 序列化，
+// 只上报温度、湿度字段的旧格式读数按单位为空的 temperature、humidity 指标参与签名
+func environmentReadingPayload(record *EnvironmentRecord) ([]byte, error) {
+	metrics := make([]SensorMetric, len(record.Metrics))
+	copy(metrics, record.Metrics)
+	if len(metrics) == 0 {
+		metrics = []SensorMetric{
+			{Metric: "temperature", Value: record.Temperature},
+			{Metric: "humidity", Value: record.Humidity},
+		}
+	}
+	sort.Slice(metrics, func(i, j int) bool {
+		return metrics[i].Metric < metrics[j].Metric
+	})
+
+	return json.Marshal(struct {
+		ID         string         `json:"id"`
+		DeviceID   string         `json:"deviceId"`
+		ProductID  string         `json:"productId"`
+		RecordTime string         `json:"recordTime"`
+		Metrics    []SensorMetric `json:"metrics"`
+	}{
+		ID:         record.ID,
+		DeviceID:   record.DeviceID,
+		ProductID:  record.ProductID,
+		RecordTime: record.RecordTime.UTC().Format(time.RFC3339Nano),
+		Metrics:    metrics,
+	})
+}
+
+// verifyDeviceReading 校验读数来自已启用且分配到该产品的设备，并验证设备签名
+func verifyDeviceReading(device *Device, record *EnvironmentRecord) error {
+	if device.Status != "ACTIVE" {
+		return fmt.Errorf("设备未启用: %s", device.ID)
+	}
+	if device.ProductID != record.ProductID {
+		return fmt.Errorf("设备 %s 未分配给产品 %s", device.ID, record.ProductID)
+	}
+	if len(record.Signature) == 0 {
+		return fmt.Errorf("读数缺少设备签名: %s", record.ID)
+	}
+
+	payload, err := environmentReadingPayload(record)
+	if err != nil {
+		return err
+	}
+	err = verifySignature(device.PublicKey, payload, record.Signature)
+	if err != nil {
+		return fmt.Errorf("设备 %s 的读数 %s %v", device.ID, record.ID, err)
+	}
+
+	// 读数归属于设备所有者
+	if record.OperatorID == "" {
+		record.OperatorID = device.OwnerID
+	}
+
+	return nil
+}
+
+// putDevice 保存设备
+func putDevice(ctx contractapi.TransactionContextInterface, device *Device) error {
+	deviceJSON, err := json.Marshal(device)
+	if err != nil {
+		return err
+	}
+
+	return ctx.GetStub().PutState(device.ID, deviceJSON)
+}
+
+// RegisterDevice 登记传感器设备及其公钥
+func (t *AgriTrace) RegisterDevice(ctx contractapi.TransactionContextInterface, deviceData string) error {
+	var device Device
+	err := json.Unmarshal([]byte(deviceData), &device)
+	if err != nil {
+		return fmt.Errorf("解析设备数据失败: %v", err)
+	}
+
+	// 确保ID有正确的前缀
+	if !strings.HasPrefix(device.ID, "DEVICE_") {
+		device.ID = fmt.Sprintf("DEVICE_%s", device.ID)
+	}
+
+	// 检查设备是否已存在
+	deviceJSON, err := ctx.GetStub().GetState(device.ID)
+	if err != nil {
+		return err
+	}
+	if deviceJSON != nil {
+		return fmt.Errorf("设备已存在: %s", device.ID)
+	}
+
+	if len(device.OwnerID) == 0 {
+		return fmt.Errorf("设备所有者ID不能为空")
+	}
+	_, err = parsePublicKey(device.PublicKey)
+	if err != nil {
+		return err
+	}
+
+	if device.ProductID != "" {
+		exists, err := t.ProductExists(ctx, device.ProductID)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return fmt.Errorf("产品不存在: %s", device.ProductID)
+		}
+	}
+
+	device.Status = "ACTIVE"
+	device.RegisteredAt = time.Now()
+	device.UpdatedAt = device.RegisteredAt
+
+	return putDevice(ctx, &device)
+}
+
+// AssignDevice 将设备分配到产品和地块
+func (t *AgriTrace) AssignDevice(ctx contractapi.TransactionContextInterface, deviceID string, productID string, plot string) error {
+	device, err := t.QueryDevice(ctx, deviceID)
+	if err != nil {
+		return err
+	}
+	if device.Status == "RETIRED" {
+		return fmt.Errorf("设备已报废: %s", device.ID)
+	}
+
+	exists, err := t.ProductExists(ctx, productID)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("产品不存在: %s", productID)
+	}
+
+	device.ProductID = productID
+	device.Plot = plot
+	device.UpdatedAt = time.Now()
+
+	return putDevice(ctx, device)
+}
+
+// UpdateDeviceStatus 更新设备状态，报废的设备不能重新启用
+func (t *AgriTrace) UpdateDeviceStatus(ctx contractapi.TransactionContextInterface, deviceID string, status string) error {
+	device, err := t.QueryDevice(ctx, deviceID)
+	if err != nil {
+		return err
+	}
+
+	if status != "ACTIVE" && status != "SUSPENDED" && status != "RETIRED" {
+		return fmt.Errorf("无效的设备状态: %s", status)
+	}
+	if device.Status == "RETIRED" {
+		return fmt.Errorf("设备已报废: %s", device.ID)
+	}
+
+	device.Status = status
+	device.UpdatedAt = time.Now()
+
+	return putDevice(ctx, device)
+}
+
+// QueryDevice 查询设备信息
+func (t *AgriTrace) QueryDevice(ctx contractapi.TransactionContextInterface, deviceID string) (*Device, error) {
+	if len(deviceID) == 0 {
+		return nil, fmt.Errorf("设备ID不能为空")
+	}
+
+	deviceJSON, err := ctx.GetStub().GetState(deviceID)
+	if err != nil {
+		return nil, fmt.Errorf("查询设备失败: %v", err)
+	}
+	if deviceJSON == nil {
+		return nil, fmt.Errorf("设备不存在: %s", deviceID)
+	}
+
+	var device Device
+	err = json.Unmarshal(deviceJSON, &device)
+	if err != nil {
+		return nil, err
+	}
+
+	return &device, nil
+}
+
+// QueryDevicesByOwner 查询所有者的设备
+func (t *AgriTrace) QueryDevicesByOwner(ctx contractapi.TransactionContextInterface, ownerID string) ([]*Device, error) {
+	resultsIterator, err := ctx.GetStub().GetStateByRange("", "")
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	var devices []*Device
+	for resultsIterator.HasNext() {
+		queryResult, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		// 只处理以DEVICE_开头的记录
+		if !strings.HasPrefix(queryResult.Key, "DEVICE_") {
+			continue
+		}
+
+		var device Device
+		err = json.Unmarshal(queryResult.Value, &device)
+		if err != nil {
+			continue // 跳过非设备记录
+		}
+
+		if device.OwnerID == ownerID {
+			devices = append(devices, &device)
+		}
+	}
+
+	// 如果没有找到记录，返回空数组而不是 nil
+	if devices == nil {
+		devices = []*Device{}
+	}
+
+	return devices, nil
+}
+
+// environmentDailyKey 生成产品某日的汇总键
+func environmentDailyKey(productID string, day time.Time) string {
+	return fmt.Sprintf("ENVDAILY_%s_%s", productID, day.UTC().Format("20060102"))
+}
+
+// addMetricValue 将一个读数计入指标汇总
+func addMetricValue(aggregates []MetricAggregate, metric SensorMetric) []MetricAggregate {
+	for i := range aggregates {
+		if aggregates[i].Metric != metric.Metric {
+			continue
+		}
+		aggregate := &aggregates[i]
+		aggregate.Count++
+		aggregate.Sum += metric.Value
+		aggregate.Min = math.Min(aggregate.Min, metric.Value)
+		aggregate.Max = math.Max(aggregate.Max, metric.Value)
+		aggregate.Mean = aggregate.Sum / float64(aggregate.Count)
+		return aggregates
+	}
+
+	return append(aggregates, MetricAggregate{
+		Metric: metric.Metric,
+		Unit:   metric.Unit,
+		Count:  1,
+		Min:    metric.Value,
+		Max:    metric.Value,
+		Sum:    metric.Value,
+		Mean:   metric.Value,
+	})
+}
+
+// mergeMetricAggregates 合并两组指标汇总
+func mergeMetricAggregates(aggregates []MetricAggregate, other []MetricAggregate) []MetricAggregate {
+	for _, o := range other {
+		merged := false
+		for i := range aggregates {
+			if aggregates[i].Metric != o.Metric {
+				continue
+			}
+			aggregate := &aggregates[i]
+			aggregate.Count += o.Count
+			aggregate.Sum += o.Sum
+			aggregate.Min = math.Min(aggregate.Min, o.Min)
+			aggregate.Max = math.Max(aggregate.Max, o.Max)
+			aggregate.Mean = aggregate.Sum / float64(aggregate.Count)
+			merged = true
+			break
+		}
+		if !merged {
+			aggregates = append(aggregates, o)
+		}
+	}
+	return aggregates
+}
+
+// updateEnvironmentDailySummaries 将新写入的读数计入每日汇总，每个汇总只读写一次
+func (t *AgriTrace) updateEnvironmentDailySummaries(ctx contractapi.TransactionContextInterface, records []*EnvironmentRecord) error {
+	summaries := make(map[string]*EnvironmentDailySummary)
+	var keys []string
+
+	for _, record := range records {
+		key := environmentDailyKey(record.ProductID, record.RecordTime)
+		summary, ok := summaries[key]
+		if !ok {
+			summaryJSON, err := ctx.GetStub().GetState(key)
+			if err != nil {
+				return fmt.Errorf("查询环境汇总失败: %v", err)
+			}
+			summary = &EnvironmentDailySummary{
+				ID:        key,
+				ProductID: record.ProductID,
+				Date:      record.RecordTime.UTC().Format("2006-01-02"),
+			}
+			if summaryJSON != nil {
+				err = json.Unmarshal(summaryJSON, summary)
+				if err != nil {
+					return err
+				}
+			}
+			summaries[key] = summary
+			keys = append(keys, key)
+		}
+
+		for _, metric := range record.Metrics {
+			summary.Metrics = addMetricValue(summary.Metrics, metric)
+		}
+	}
+
+	sort.Strings(keys)
+	now := time.Now()
+	for _, key := range keys {
+		summary := summaries[key]
+		summary.UpdatedAt = now
+
+		summaryJSON, err := json.Marshal(summary)
+		if err != nil {
+			return err
+		}
+		err = ctx.GetStub().PutState(key, summaryJSON)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// RebuildEnvironmentSummary 根据原始读数重建产品的每日汇总，用于汇总功能上线前已有的数据
+func (t *AgriTrace) RebuildEnvironmentSummary(ctx contractapi.TransactionContextInterface, productID string) error {
+	records, err := t.QueryEnvironmentRecords(ctx, productID)
+	if err != nil {
+		return err
+	}
+
+	summaries := make(map[string]*EnvironmentDailySummary)
+	var keys []string
+	for _, record := range records {
+		if len(record.Metrics) == 0 && normalizeEnvironmentMetrics(record) != nil {
+			continue
+		}
+
+		key := environmentDailyKey(productID, record.RecordTime)
+		summary, ok := summaries[key]
+		if !ok {
+			summary = &EnvironmentDailySummary{
+				ID:        key,
+				ProductID: productID,
+				Date:      record.RecordTime.UTC().Format("2006-01-02"),
+			}
+			summaries[key] = summary
+			keys = append(keys, key)
+		}
+
+		for _, metric := range record.Metrics {
+			summary.Metrics = addMetricValue(summary.Metrics, metric)
+		}
+	}
+
+	sort.Strings(keys)
+	now := time.Now()
+	for _, key := range keys {
+		summary := summaries[key]
+		summary.UpdatedAt = now
+
+		summaryJSON, err := json.Marshal(summary)
+		if err != nil {
+			return err
+		}
+		err = ctx.GetStub().PutState(key, summaryJSON)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// summaryPeriodStart 计算日期所属时段的开始日期
+func summaryPeriodStart(day time.Time, granularity string) time.Time {
+	switch granularity {
+	case "WEEK":
+		// 以周一为一周的开始
+		offset := (int(day.Weekday()) + 6) % 7
+		return day.AddDate(0, 0, -offset)
+	case "MONTH":
+		return time.Date(day.Year(), day.Month(), 1, 0, 0, 0, 0, time.UTC)
+	default:
+		return day
+	}
+}
+
+// summaryPeriodEnd 计算时段的结束日期
+func summaryPeriodEnd(start time.Time, granularity string) time.Time {
+	switch granularity {
+	case "WEEK":
+		return start.AddDate(0, 0, 6)
+	case "MONTH":
+		return start.AddDate(0, 1, -1)
+	default:
+		return start
+	}
+}
+
+// QueryEnvironmentSummary 查询产品在日期范围内的环境指标汇总
+// startDate、endDate 格式为 yyyy-MM-dd（UTC，包含首尾），granularity 可选 DAY、WEEK、MONTH、ALL
+func (t *AgriTrace) QueryEnvironmentSummary(ctx contractapi.TransactionContextInterface, productID string, startDate string, endDate string, granularity string) ([]*EnvironmentSummary, error) {
+	start, err := time.Parse("2006-01-02", startDate)
+	if err != nil {
+		return nil, fmt.Errorf("开始日期格式错误: %v", err)
+	}
+	end, err := time.Parse("2006-01-02", endDate)
+	if err != nil {
+		return nil, fmt.Errorf("结束日期格式错误: %v", err)
+	}
+	if end.Before(start) {
+		return nil, fmt.Errorf("结束日期不能早于开始日期")
+	}
+	if granularity == "" {
+		granularity = "DAY"
+	}
+	if granularity != "DAY" && granularity != "WEEK" && granularity != "MONTH" && granularity != "ALL" {
+		return nil, fmt.Errorf("无效的汇总粒度: %s", granularity)
+	}
+
+	// 汇总键按日期排序，可直接按范围查询
+	resultsIterator, err := ctx.GetStub().GetStateByRange(environmentDailyKey(productID, start), environmentDailyKey(productID, end.AddDate(0, 0, 1)))
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	periods := make(map[string]*EnvironmentSummary)
+	var periodKeys []string
+	for resultsIterator.HasNext() {
+		queryResult, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		var daily EnvironmentDailySummary
+		err = json.Unmarshal(queryResult.Value, &daily)
+		if err != nil {
+			continue // 跳过非汇总记录
+		}
+		if daily.ProductID != productID {
+			continue
+		}
+		day, err := time.Parse("2006-01-02", daily.Date)
+		if err != nil {
+			continue
+		}
+
+		periodStart, periodEnd := start, end
+		if granularity != "ALL" {
+			periodStart = summaryPeriodStart(day, granularity)
+			periodEnd = summaryPeriodEnd(periodStart, granularity)
+		}
+		key := periodStart.Format("2006-01-02")
+
+		summary, ok := periods[key]
+		if !ok {
+			summary = &EnvironmentSummary{
+				ProductID:   productID,
+				PeriodStart: key,
+				PeriodEnd:   periodEnd.Format("2006-01-02"),
+			}
+			periods[key] = summary
+			periodKeys = append(periodKeys, key)
+		}
+
+		summary.Metrics = mergeMetricAggregates(summary.Metrics, daily.Metrics)
+	}
+
+	sort.Strings(periodKeys)
+	summaries := make([]*EnvironmentSummary, 0, len(periodKeys))
+	for _, key := range periodKeys {
+		summaries = append(summaries, periods[key])
+	}
+
+	return summaries, nil
+}
+
+// maxColdChainReadings 单次提交的最大温度读数条数
+const maxColdChainReadings = 2000
+
+// hasStorageRange 判断产品是否设置了储运温度范围
+func hasStorageRange(product *Product) bool {
+	return product.StorageMinTemp != 0 || product.StorageMaxTemp != 0
+}
+
+// detectExcursions 按时间顺序扫描温度读数，找出连续超出范围的时段
+func detectExcursions(recordID string, readings []TemperatureReading, min float64, max float64) []TemperatureExcursion {
+	sorted := make([]TemperatureReading, len(readings))
+	copy(sorted, readings)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Time.Before(sorted[j].Time)
+	})
+
+	var excursions []TemperatureExcursion
+	var current *TemperatureExcursion
+	for _, reading := range sorted {
+		excursionType, limit := "", 0.0
+		if reading.Temperature > max {
+			excursionType, limit = "ABOVE", max
+		} else if reading.Temperature < min {
+			excursionType, limit = "BELOW", min
+		}
+
+		// 恢复到范围内或超限方向改变时结束当前时段
+		if current != nil && current.Type != excursionType {
+			current.EndTime = reading.Time
+			current.Resolved = true
+			current.DurationMinutes = current.EndTime.Sub(current.StartTime).Minutes()
+			excursions = append(excursions, *current)
+			current = nil
+		}
+		if excursionType == "" {
+			continue
+		}
+
+		if current == nil {
+			current = &TemperatureExcursion{
+				RecordID:        recordID,
+				Type:            excursionType,
+				Limit:           limit,
+				StartTime:       reading.Time,
+				PeakTemperature: reading.Temperature,
+			}
+		}
+		if (excursionType == "ABOVE" && reading.Temperature > current.PeakTemperature) ||
+			(excursionType == "BELOW" && reading.Temperature < current.PeakTemperature) {
+			current.PeakTemperature = reading.Temperature
+		}
+		current.EndTime = reading.Time
+	}
+
+	if current != nil {
+		current.DurationMinutes = current.EndTime.Sub(current.StartTime).Minutes()
+		excursions = append(excursions, *current)
+	}
+
+	return excursions
+}
+
+// evaluateColdChain 重新评估物流记录的温度超限，返回本次新出现的超限时段
+func evaluateColdChain(record *LogisticsRecord, product *Product) []TemperatureExcursion {
+	if !hasStorageRange(product) || len(record.TemperatureReadings) == 0 {
+		record.Excursions = nil
+		return nil
+	}
+
+	previous := make(map[time.Time]bool)
+	for _, excursion := range record.Excursions {
+		previous[excursion.StartTime] = true
+	}
+
+	record.Excursions = detectExcursions(record.ID, record.TemperatureReadings, product.StorageMinTemp, product.StorageMaxTemp)
+
+	var newExcursions []TemperatureExcursion
+	for _, excursion := range record.Excursions {
+		if !previous[excursion.StartTime] {
+			newExcursions = append(newExcursions, excursion)
+		}
+	}
+	return newExcursions
+}
+
+// emitColdChainExcursions 有新的温度超限时触发事件
+func emitColdChainExcursions(ctx contractapi.TransactionContextInterface, excursions []TemperatureExcursion) error {
+	if len(excursions) == 0 {
+		return nil
+	}
+
+	eventJSON, err := json.Marshal(excursions)
+	if err != nil {
+		return err
+	}
+
+	return ctx.GetStub().SetEvent("ColdChainExcursion", eventJSON)
+}
+
+// SetProductStorageRange 设置产品的储运温度范围
+func (t *AgriTrace) SetProductStorageRange(ctx contractapi.TransactionContextInterface, productID string, minTemp float64, maxTemp float64) error {
+	product, err := t.QueryProduct(ctx, productID)
+	if err != nil {
+		return err
+	}
+
+	if minTemp >= maxTemp {
+		return fmt.Errorf("储运温度下限必须低于上限")
+	}
+
+	product.StorageMinTemp = minTemp
+	product.StorageMaxTemp = maxTemp
+	product.UpdatedAt = time.Now()
+
+	productJSON, err := json.Marshal(product)
+	if err != nil {
+		return err
+	}
+
+	return ctx.GetStub().PutState(productID, productJSON)
+}
+
+// AddColdChainReadings 为物流记录追加温度记录仪读数并评估温度超限
+func (t *AgriTrace) AddColdChainReadings(ctx contractapi.TransactionContextInterface, recordID string, readingsData string) error {
+	var readings []TemperatureReading
+	err := json.Unmarshal([]byte(readingsData), &readings)
+	if err != nil {
+		return fmt.Errorf("解析温度读数失败: %v", err)
+	}
+	if len(readings) == 0 {
+		return fmt.Errorf("温度读数不能为空")
+	}
+	if len(readings) > maxColdChainReadings {
+		return fmt.Errorf("单次最多提交 %d 条温度读数，当前 %d 条", maxColdChainReadings, len(readings))
+	}
+	for _, reading := range readings {
+		if reading.Time.IsZero() {
+			return fmt.Errorf("温度读数时间不能为空")
+		}
+	}
+
+	record, err := t.QueryLogisticsRecord(ctx, recordID)
+	if err != nil {
+		return err
+	}
+	product, err := t.QueryProduct(ctx, record.ProductID)
+	if err != nil {
+		return err
+	}
+
+	// 重新提交的记录仪导出数据按记录仪和读数时间去重，避免重复计入超限时长
+	recorded := make(map[string]bool, len(record.TemperatureReadings))
+	for _, reading := range record.TemperatureReadings {
+		recorded[temperatureReadingKey(reading)] = true
+	}
+	added := 0
+	for _, reading := range readings {
+		key := temperatureReadingKey(reading)
+		if recorded[key] {
+			continue
+		}
+		recorded[key] = true
+		record.TemperatureReadings = append(record.TemperatureReadings, reading)
+		added++
+	}
+	if added == 0 {
+		return nil
+	}
+	newExcursions := evaluateColdChain(record, product)
+
+	recordJSON, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	err = ctx.GetStub().PutState(recordID, recordJSON)
+	if err != nil {
+		return err
+	}
+
+	// 根据新的温度历史更新剩余保质期；未配置保质期模型的作物跳过
+	newlyFlagged, err := t.refreshShelfLife(ctx, product, record)
+	if err != nil && !errors.Is(err, errNoShelfLifeModel) {
+		return err
+	}
+
+	// 每笔交易只能触发一个事件：新触发保质期预警时优先通知，超限明细仍保存在物流记录中
+	if newlyFlagged {
+		productJSON, err := json.Marshal(product)
+		if err != nil {
+			return err
+		}
+		return ctx.GetStub().SetEvent("ShelfLifeLow", productJSON)
+	}
+
+	return emitColdChainExcursions(ctx, newExcursions)
+}
+
+// temperatureReadingKey 温度读数的去重键：同一记录仪同一时间只有一条读数
+func temperatureReadingKey(reading TemperatureReading) string {
+	return reading.LoggerID + "|" + reading.Time.UTC().Format(time.RFC3339Nano)
+}
+
+// errNoShelfLifeModel 作物未配置保质期模型
+var errNoShelfLifeModel = errors.New("未配置保质期模型")
+
+// parseHarvestTime 解析收获日期，支持 yyyy-MM-dd 和 RFC3339 格式
+func parseHarvestTime(harvestDate string) (time.Time, bool) {
+	for _, layout := range []string{time.RFC3339, "2006-01-02"} {
+		if harvestTime, err := time.Parse(layout, harvestDate); err == nil {
+			return harvestTime, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// estimateShelfLife 按 Q10 模型估算剩余保质期：
+// 每段时间按该段开始时的温度计算劣变速率 Q10^((T-Tref)/10)，收获到首次读数之间按参考温度计算，
+// 最后一次读数之后按最后读数温度计算；剩余时长同样按最后读数温度折算
+func estimateShelfLife(product *Product, model *ShelfLifeModel, readings []TemperatureReading, now time.Time) (*ShelfLifeEstimate, error) {
+	sorted := make([]TemperatureReading, len(readings))
+	copy(sorted, readings)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Time.Before(sorted[j].Time)
+	})
+
+	start, ok := parseHarvestTime(product.HarvestDate)
+	if !ok {
+		if len(sorted) == 0 {
+			return nil, fmt.Errorf("产品尚未收获且没有温度读数: %s", product.ID)
+		}
+		start = sorted[0].Time
+	}
+
+	rate := func(temperature float64) float64 {
+		return math.Pow(model.Q10, (temperature-model.ReferenceTemp)/10)
+	}
+
+	consumed := 0.0
+	cursor := start
+	currentRate := 1.0
+	for _, reading := range sorted {
+		if reading.Time.After(cursor) {
+			consumed += reading.Time.Sub(cursor).Hours() * currentRate
+			cursor = reading.Time
+		}
+		currentRate = rate(reading.Temperature)
+	}
+	if now.After(cursor) {
+		consumed += now.Sub(cursor).Hours() * currentRate
+	}
+
+	remainingReference := math.Max(model.ReferenceShelfLifeHours-consumed, 0)
+	remaining := remainingReference / currentRate
+
+	return &ShelfLifeEstimate{
+		ProductID:         product.ID,
+		Crop:              model.Crop,
+		StartTime:         start,
+		ConsumedHours:     consumed,
+		RemainingHours:    remaining,
+		RemainingFraction: remainingReference / model.ReferenceShelfLifeHours,
+		EstimatedExpiry:   now.Add(time.Duration(remaining * float64(time.Hour))),
+		Flagged:           remaining < model.FlagThresholdHours,
+		ReadingCount:      len(sorted),
+		CalculatedAt:      now,
+	}, nil
+}
+
+// SetShelfLifeModel 设置作物的保质期模型
+func (t *AgriTrace) SetShelfLifeModel(ctx contractapi.TransactionContextInterface, modelData string) error {
+	var model ShelfLifeModel
+	err := json.Unmarshal([]byte(modelData), &model)
+	if err != nil {
+		return fmt.Errorf("解析保质期模型失败: %v", err)
+	}
+
+	if len(model.Crop) == 0 {
+		return fmt.Errorf("作物名称不能为空")
+	}
+	if model.ReferenceShelfLifeHours <= 0 {
+		return fmt.Errorf("参考保质期必须大于0")
+	}
+	if model.Q10 < 1 {
+		return fmt.Errorf("Q10 系数不能小于1")
+	}
+	if model.FlagThresholdHours < 0 {
+		return fmt.Errorf("预警阈值不能为负数")
+	}
+
+	model.ID = fmt.Sprintf("SHELFLIFE_%s", model.Crop)
+	model.UpdatedAt = time.Now()
+
+	modelJSON, err := json.Marshal(model)
+	if err != nil {
+		return err
+	}
+
+	return ctx.GetStub().PutState(model.ID, modelJSON)
+}
+
+// QueryShelfLifeModel 查询作物的保质期模型
+func (t *AgriTrace) QueryShelfLifeModel(ctx contractapi.TransactionContextInterface, crop string) (*ShelfLifeModel, error) {
+	modelJSON, err := ctx.GetStub().GetState(fmt.Sprintf("SHELFLIFE_%s", crop))
+	if err != nil {
+		return nil, fmt.Errorf("查询保质期模型失败: %v", err)
+	}
+	if modelJSON == nil {
+		return nil, fmt.Errorf("%w: %s", errNoShelfLifeModel, crop)
+	}
+
+	var model ShelfLifeModel
+	err = json.Unmarshal(modelJSON, &model)
+	if err != nil {
+		return nil, err
+	}
+
+	return &model, nil
+}
+
+// productTemperatureReadings 收集产品所有物流记录的温度读数，pending 为本交易内已更新的物流记录
+func (t *AgriTrace) productTemperatureReadings(ctx contractapi.TransactionContextInterface, productID string, pending *LogisticsRecord) ([]TemperatureReading, error) {
+	records, err := t.QueryLogisticsRecordsByProduct(ctx, productID)
+	if err != nil {
+		return nil, err
+	}
+
+	var readings []TemperatureReading
+	for _, record := range records {
+		if pending != nil && record.ID == pending.ID {
+			continue
+		}
+		readings = append(readings, record.TemperatureReadings...)
+	}
+	if pending != nil {
+		readings = append(readings, pending.TemperatureReadings...)
+	}
+
+	return readings, nil
+}
+
+// shelfLifeEstimate 估算产品剩余保质期
+func (t *AgriTrace) shelfLifeEstimate(ctx contractapi.TransactionContextInterface, product *Product, pending *LogisticsRecord) (*ShelfLifeEstimate, error) {
+	model, err := t.QueryShelfLifeModel(ctx, product.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	readings, err := t.productTemperatureReadings(ctx, product.ID, pending)
+	if err != nil {
+		return nil, err
+	}
+
+	return estimateShelfLife(product, model, readings, time.Now())
+}
+
+// refreshShelfLife 估算剩余保质期并保存到产品，返回是否新触发预警
+func (t *AgriTrace) refreshShelfLife(ctx contractapi.TransactionContextInterface, product *Product, pending *LogisticsRecord) (bool, error) {
+	estimate, err := t.shelfLifeEstimate(ctx, product, pending)
+	if err != nil {
+		return false, err
+	}
+
+	newlyFlagged := estimate.Flagged && !product.ShelfLifeFlagged
+	product.RemainingShelfLifeHours = estimate.RemainingHours
+	product.ShelfLifeFlagged = estimate.Flagged
+	product.ShelfLifeUpdatedAt = estimate.CalculatedAt
+	product.UpdatedAt = estimate.CalculatedAt
+
+	productJSON, err := json.Marshal(product)
+	if err != nil {
+		return false, err
+	}
+
+	return newlyFlagged, ctx.GetStub().PutState(product.ID, productJSON)
+}
+
+// EstimateShelfLife 查询产品当前的剩余保质期估算
+func (t *AgriTrace) EstimateShelfLife(ctx contractapi.TransactionContextInterface, productID string) (*ShelfLifeEstimate, error) {
+	product, err := t.QueryProduct(ctx, productID)
+	if err != nil {
+		return nil, err
+	}
+
+	return t.shelfLifeEstimate(ctx, product, nil)
+}
+
+// RefreshShelfLife 重新估算并保存产品剩余保质期，低于预警阈值时标记产品并触发事件
+func (t *AgriTrace) RefreshShelfLife(ctx contractapi.TransactionContextInterface, productID string) error {
+	product, err := t.QueryProduct(ctx, productID)
+	if err != nil {
+		return err
+	}
+
+	newlyFlagged, err := t.refreshShelfLife(ctx, product, nil)
+	if err != nil {
+		return err
+	}
+	if !newlyFlagged {
+		return nil
+	}
+
+	productJSON, err := json.Marshal(product)
+	if err != nil {
+		return err
+	}
+
+	return ctx.GetStub().SetEvent("ShelfLifeLow", productJSON)
+}
+
+// RecommendFEFO 按剩余保质期从短到长排列零售商的在库产品，供先到期先出参考
+func (t *AgriTrace) RecommendFEFO(ctx contractapi.TransactionContextInterface, retailerID string) ([]*FEFORecommendation, error) {
+	inventories, err := t.QueryInventoryByRetailer(ctx, retailerID)
+	if err != nil {
+		return nil, err
+	}
+
+	recommendations := []*FEFORecommendation{}
+	for _, inventory := range inventories {
+		if inventory.Quantity <= 0 {
+			continue
+		}
+
+		product, err := t.QueryProduct(ctx, inventory.ProductID)
+		if err != nil {
+			return nil, err
+		}
+
+		// 未配置保质期模型的产品排在最后
+		recommendation := &FEFORecommendation{
+			InventoryID:    inventory.ID,
+			ProductID:      inventory.ProductID,
+			Quantity:       inventory.Quantity,
+			RemainingHours: math.Inf(1),
+		}
+		estimate, err := t.shelfLifeEstimate(ctx, product, nil)
+		if err == nil {
+			recommendation.RemainingHours = estimate.RemainingHours
+			recommendation.EstimatedExpiry = estimate.EstimatedExpiry
+			recommendation.Flagged = estimate.Flagged
+		} else if !errors.Is(err, errNoShelfLifeModel) {
+			return nil, err
+		}
+
+		recommendations = append(recommendations, recommendation)
+	}
+
+	sort.SliceStable(recommendations, func(i, j int) bool {
+		return recommendations[i].RemainingHours < recommendations[j].RemainingHours
+	})
+
+	// JSON 无法表示无穷大，排序后改为 -1 表示未知
+	for _, recommendation := range recommendations {
+		if math.IsInf(recommendation.RemainingHours, 1) {
+			recommendation.RemainingHours = -1
+		}
+	}
+
+	return recommendations, nil
+}
+
+// shipmentTransitions 运输状态及允许的后续状态，运输中和中转时可重复上报同一状态以更新位置；
+// DELIVERED（已送达）、REJECTED（已拒收）、LOST（已丢失）为终态
+var shipmentTransitions = map[string][]string{
+	"CREATED":          {"PICKED_UP", "LOST"},
+	"PICKED_UP":        {"IN_TRANSIT", "AT_HUB", "LOST"},
+	"IN_TRANSIT":       {"IN_TRANSIT", "AT_HUB", "OUT_FOR_DELIVERY", "LOST"},
+	"AT_HUB":           {"AT_HUB", "IN_TRANSIT", "OUT_FOR_DELIVERY", "LOST"},
+	"OUT_FOR_DELIVERY": {"AT_HUB", "DELIVERED", "REJECTED", "LOST"},
+	"DELIVERED":        {},
+	"REJECTED":         {},
+	"LOST":             {},
+}
+
+// checkShipmentTransition 校验运输状态变更是否合法
+func checkShipmentTransition(from string, to string) error {
+	if _, ok := shipmentTransitions[to]; !ok {
+		return fmt.Errorf("无效的运输状态: %s", to)
+	}
+
+	next, ok := shipmentTransitions[from]
+	if !ok {
+		return fmt.Errorf("无效的运输状态: %s", from)
+	}
+	for _, status := range next {
+		if status == to {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("运输状态不能从 %s 变更为 %s", from, to)
+}
+
+// receiveLogisticsDelivery 物流记录送达且指定了收货方时，由发货方向收货方发起交接，待收货方确认；
+// 未记录发货方的旧记录由产品所属农户移交
+func (t *AgriTrace) receiveLogisticsDelivery(ctx contractapi.TransactionContextInterface, record *LogisticsRecord) error {
+	if record.Status != "DELIVERED" || record.ReceiverID == "" {
+		return nil
+	}
+	if record.Quantity <= 0 {
+		return fmt.Errorf("指定收货方时运输数量必须大于0")
+	}
+
+	senderID := record.ShipperID
+	if senderID == "" {
+		product, err := t.QueryProduct(ctx, record.ProductID)
+		if err != nil {
+			return err
+		}
+		senderID = product.FarmerID
+	}
+
+	return t.createTransfer(ctx, &LotTransfer{
+		ID:                fmt.Sprintf("TRANSFER_%s", record.ID),
+		SenderID:          senderID,
+		ReceiverID:        record.ReceiverID,
+		Items:             []TransferItem{{ProductID: record.ProductID, Quantity: record.Quantity, LotID: record.LotID}},
+		Note:              record.Description,
+		StoreID:           record.StoreID,
+		LogisticsRecordID: record.ID,
+	})
+}
+
+// receiveShipmentDelivery 运输单送达时由发货方向收货方发起交接，待收货方确认
+func (t *AgriTrace) receiveShipmentDelivery(ctx contractapi.TransactionContextInterface, shipment *Shipment) error {
+	transfer := &LotTransfer{
+		ID:         fmt.Sprintf("TRANSFER_%s", shipment.ID),
+		ShipmentID: shipment.ID,
+		SenderID:   shipment.ShipperID,
+		ReceiverID: shipment.ReceiverID,
+		Note:       fmt.Sprintf("运输单 %s 送达 %s", shipment.ID, shipment.Destination),
+		StoreID:    shipment.StoreID,
+	}
+	for _, item := range shipment.Items {
+		transfer.Items = append(transfer.Items, TransferItem{ProductID: item.ProductID, Quantity: item.Quantity, LotID: item.LotID})
+	}
+
+	return t.createTransfer(ctx, transfer)
+}
+
+// putShipment 保存运输单
+func putShipment(ctx contractapi.TransactionContextInterface, shipment *Shipment) error {
+	shipmentJSON, err := json.Marshal(shipment)
+	if err != nil {
+		return err
+	}
+
+	return ctx.GetStub().PutState(shipment.ID, shipmentJSON)
+}
+
+// CreateShipment 创建运输单，创建时记录第一个运输节点
+func (t *AgriTrace) CreateShipment(ctx contractapi.TransactionContextInterface, shipmentData string) error {
+	var shipment Shipment
+	err := json.Unmarshal([]byte(shipmentData), &shipment)
+	if err != nil {
+		return fmt.Errorf("解析运输单数据失败: %v", err)
+	}
+
+	// 确保ID有正确的前缀
+	if !strings.HasPrefix(shipment.ID, "SHIPMENT_") {
+		shipment.ID = fmt.Sprintf("SHIPMENT_%s", shipment.ID)
+	}
+
+	// 检查运输单是否已存在
+	shipmentJSON, err := ctx.GetStub().GetState(shipment.ID)
+	if err != nil {
+		return err
+	}
+	if shipmentJSON != nil {
+		return fmt.Errorf("运输单已存在: %s", shipment.ID)
+	}
+
+	// 检查必要字段
+	if len(shipment.Origin) == 0 || len(shipment.Destination) == 0 {
+		return fmt.Errorf("起运地和目的地不能为空")
+	}
+	if len(shipment.CarrierID) == 0 {
+		return fmt.Errorf("承运物流商ID不能为空")
+	}
+	if len(shipment.ShipperID) == 0 || len(shipment.ReceiverID) == 0 {
+		return fmt.Errorf("发货方和收货方不能为空")
+	}
+	if shipment.ShipperID == shipment.ReceiverID {
+		return fmt.Errorf("发货方和收货方不能相同")
+	}
+	if len(shipment.Items) == 0 {
+		return fmt.Errorf("运输单至少包含一个批次")
+	}
+	err = t.checkReceivingStore(ctx, shipment.ReceiverID, shipment.StoreID)
+	if err != nil {
+		return err
+	}
+	err = checkShipmentPlan(shipment.PlannedRoute, shipment.MaxDeviationKm)
+	if err != nil {
+		return err
+	}
+
+	// 未结束运输单和待确认交接单已占用的数量不能再次发运
+	committed, err := t.committedQuantities(ctx, shipment.ShipperID, "")
+	if err != nil {
+		return err
+	}
+
+	seen := make(map[string]bool)
+	for _, item := range shipment.Items {
+		if seen[item.ProductID] {
+			return fmt.Errorf("运输单中批次重复: %s", item.ProductID)
+		}
+		seen[item.ProductID] = true
+
+		if item.Quantity <= 0 {
+			return fmt.Errorf("批次 %s 的数量必须大于0", item.ProductID)
+		}
+
+		product, err := t.QueryProduct(ctx, item.ProductID)
+		if err != nil {
+			return err
+		}
+		held, err := t.heldQuantity(ctx, product, shipment.ShipperID)
+		if err != nil {
+			return err
+		}
+		if held-committed[item.ProductID] < item.Quantity {
+			return fmt.Errorf("%s 持有的批次 %s 可用数量不足: 持有 %d, 已占用 %d, 需要 %d", shipment.ShipperID, item.ProductID, held, committed[item.ProductID], item.Quantity)
+		}
+	}
+
+	shipment.CreatedAt = time.Now()
+	shipment.UpdatedAt = shipment.CreatedAt
+	shipment.Status = "CREATED"
+	shipment.Checkpoints = []Checkpoint{{
+		Sequence:   1,
+		Location:   shipment.Origin,
+		Status:     shipment.Status,
+		OperatorID: shipment.CarrierID,
+		RecordTime: shipment.CreatedAt,
+	}}
+
+	// 起运节点取计划路线的第一个途经点坐标
+	if len(shipment.PlannedRoute) > 0 {
+		shipment.Checkpoints[0].Latitude = shipment.PlannedRoute[0].Latitude
+		shipment.Checkpoints[0].Longitude = shipment.PlannedRoute[0].Longitude
+		shipment.Checkpoints[0].Located = true
+	}
+	evaluateShipmentRoute(&shipment, shipment.CreatedAt)
+
+	return putShipment(ctx, &shipment)
+}
+
+// AddShipmentCheckpoint 追加运输节点，已有节点不可修改
+func (t *AgriTrace) AddShipmentCheckpoint(ctx contractapi.TransactionContextInterface, shipmentID string, checkpointData string) error {
+	var checkpoint Checkpoint
+	err := json.Unmarshal([]byte(checkpointData), &checkpoint)
+	if err != nil {
+		return fmt.Errorf("解析运输节点数据失败: %v", err)
+	}
+
+	shipment, err := t.QueryShipment(ctx, shipmentID)
+	if err != nil {
+		return err
+	}
+
+	if len(checkpoint.Location) == 0 {
+		return fmt.Errorf("节点位置不能为空")
+	}
+	err = checkShipmentTransition(shipment.Status, checkpoint.Status)
+	if err != nil {
+		return err
+	}
+	err = checkCoordinates(checkpoint.Latitude, checkpoint.Longitude)
+	if err != nil {
+		return err
+	}
+
+	checkpoint.Sequence = len(shipment.Checkpoints) + 1
+	checkpoint.RecordTime = time.Now()
+	shipment.Checkpoints = append(shipment.Checkpoints, checkpoint)
+	shipment.Status = checkpoint.Status
+	shipment.UpdatedAt = checkpoint.RecordTime
+	evaluateShipmentRoute(shipment, checkpoint.RecordTime)
+
+	err = putShipment(ctx, shipment)
+	if err != nil {
+		return err
+	}
+
+	// 送达后向收货方发起交接，拒收或丢失时关联的补货申请退回待发货
+	switch shipment.Status {
+	case "DELIVERED":
+		return t.receiveShipmentDelivery(ctx, shipment)
+	case "REJECTED", "LOST":
+		return t.reopenReplenishments(ctx, shipment.ID, fmt.Sprintf("运输单 %s 已终止，状态: %s", shipment.ID, shipment.Status))
+	}
+
+	return nil
+}
+
+// defaultMaxDeviationKm 未指定时允许偏离计划路线的距离（公里）
+const defaultMaxDeviationKm = 20.0
+
+// earthRadiusKm 地球平均半径（公里）
+const earthRadiusKm = 6371.0
+
+// checkCoordinates 校验经纬度范围，NaN 同样视为无效
+func checkCoordinates(latitude float64, longitude float64) error {
+	if !(latitude >= -90 && latitude <= 90 && longitude >= -180 && longitude <= 180) {
+		return fmt.Errorf("无效的坐标: %.6f, %.6f", latitude, longitude)
+	}
+	return nil
+}
+
+// parseCoordinates 解析字符串形式的经纬度并校验范围，均为空表示未上报坐标
+func parseCoordinates(latitude string, longitude string) (float64, float64, bool, error) {
+	if latitude == "" && longitude == "" {
+		return 0, 0, false, nil
+	}
+
+	lat, err := strconv.ParseFloat(latitude, 64)
+	if err != nil {
+		return 0, 0, false, fmt.Errorf("无效的纬度: %q", latitude)
+	}
+	lon, err := strconv.ParseFloat(longitude, 64)
+	if err != nil {
+		return 0, 0, false, fmt.Errorf("无效的经度: %q", longitude)
+	}
+	return lat, lon, true, checkCoordinates(lat, lon)
+}
+
+// haversineKm 计算两点间的大圆距离（公里）
+func haversineKm(lat1 float64, lon1 float64, lat2 float64, lon2 float64) float64 {
+	toRad := math.Pi / 180
+	dLat := (lat2 - lat1) * toRad
+	dLon := (lon2 - lon1) * toRad
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(lat1*toRad)*math.Cos(lat2*toRad)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadiusKm * math.Asin(math.Min(1, math.Sqrt(a)))
+}
+
+// distanceToRouteKm 计算点到计划路线（途经点连线）的最短距离（公里），
+// 以该点为中心做等距投影后按平面线段计算，适用于路线附近的偏离判断
+func distanceToRouteKm(latitude float64, longitude float64, route []Waypoint) float64 {
+	if len(route) == 1 {
+		return haversineKm(latitude, longitude, route[0].Latitude, route[0].Longitude)
+	}
+
+	toRad := math.Pi / 180
+	project := func(w Waypoint) (float64, float64) {
+		x := (w.Longitude - longitude) * toRad * math.Cos(latitude*toRad) * earthRadiusKm
+		y := (w.Latitude - latitude) * toRad * earthRadiusKm
+		return x, y
+	}
+
+	best := math.Inf(1)
+	for i := 1; i < len(route); i++ {
+		ax, ay := project(route[i-1])
+		bx, by := project(route[i])
+		dx, dy := bx-ax, by-ay
+
+		// 原点到线段 AB 的最近点
+		t := 0.0
+		if lengthSq := dx*dx + dy*dy; lengthSq > 0 {
+			t = math.Max(0, math.Min(1, -(ax*dx+ay*dy)/lengthSq))
+		}
+		best = math.Min(best, math.Hypot(ax+t*dx, ay+t*dy))
+	}
+
+	return best
+}
+
+// evaluateShipmentRoute 根据节点坐标重新计算行驶距离和路线偏离，并按当前时间判断是否延误
+func evaluateShipmentRoute(shipment *Shipment, now time.Time) {
+	shipment.DistanceKm = 0
+	shipment.DeviationKm = 0
+
+	var last *Checkpoint
+	for i := range shipment.Checkpoints {
+		checkpoint := &shipment.Checkpoints[i]
+		if !checkpoint.Located {
+			continue
+		}
+
+		if last != nil {
+			shipment.DistanceKm += haversineKm(last.Latitude, last.Longitude, checkpoint.Latitude, checkpoint.Longitude)
+		}
+		last = checkpoint
+
+		if len(shipment.PlannedRoute) > 0 {
+			deviation := distanceToRouteKm(checkpoint.Latitude, checkpoint.Longitude, shipment.PlannedRoute)
+			shipment.DeviationKm = math.Max(shipment.DeviationKm, deviation)
+		}
+	}
+
+	maxDeviation := shipment.MaxDeviationKm
+	if maxDeviation <= 0 {
+		maxDeviation = defaultMaxDeviationKm
+	}
+	shipment.Deviated = shipment.DeviationKm > maxDeviation
+
+	// 已送达的按送达时间判断，未结束的按当前时间判断，拒收和丢失不再计算延误
+	shipment.Delayed = false
+	if !shipment.ETA.IsZero() {
+		switch shipment.Status {
+		case "DELIVERED":
+			shipment.Delayed = shipment.UpdatedAt.After(shipment.ETA)
+		case "REJECTED", "LOST":
+		default:
+			shipment.Delayed = now.After(shipment.ETA)
+		}
+	}
+}
+
+// checkShipmentPlan 校验计划路线和允许偏离距离
+func checkShipmentPlan(route []Waypoint, maxDeviationKm float64) error {
+	for _, waypoint := range route {
+		err := checkCoordinates(waypoint.Latitude, waypoint.Longitude)
+		if err != nil {
+			return err
+		}
+	}
+	if maxDeviationKm < 0 {
+		return fmt.Errorf("允许偏离距离不能为负数")
+	}
+	return nil
+}
+
+// UpdateShipmentPlan 更新未结束运输单的计划路线和预计送达时间
+func (t *AgriTrace) UpdateShipmentPlan(ctx contractapi.TransactionContextInterface, shipmentID string, planData string) error {
+	var plan ShipmentPlan
+	err := json.Unmarshal([]byte(planData), &plan)
+	if err != nil {
+		return fmt.Errorf("解析运输计划数据失败: %v", err)
+	}
+
+	shipment, err := t.QueryShipment(ctx, shipmentID)
+	if err != nil {
+		return err
+	}
+	if len(shipmentTransitions[shipment.Status]) == 0 {
+		return fmt.Errorf("运输单已结束，当前状态: %s", shipment.Status)
+	}
+
+	err = checkShipmentPlan(plan.PlannedRoute, plan.MaxDeviationKm)
+	if err != nil {
+		return err
+	}
+
+	shipment.PlannedRoute = plan.PlannedRoute
+	shipment.ETA = plan.ETA
+	shipment.MaxDeviationKm = plan.MaxDeviationKm
+	shipment.UpdatedAt = time.Now()
+	evaluateShipmentRoute(shipment, shipment.UpdatedAt)
+
+	return putShipment(ctx, shipment)
+}
+
+// QueryDelayedShipments 查询超过预计送达时间或偏离计划路线的运输单
+func (t *AgriTrace) QueryDelayedShipments(ctx contractapi.TransactionContextInterface) ([]*Shipment, error) {
+	now := time.Now()
+	return t.queryShipments(ctx, func(shipment *Shipment) bool {
+		evaluateShipmentRoute(shipment, now)
+		return shipment.Delayed || shipment.Deviated
+	})
+}
+
+// QueryShipment 查询运输单
+func (t *AgriTrace) QueryShipment(ctx contractapi.TransactionContextInterface, shipmentID string) (*Shipment, error) {
+	shipmentJSON, err := ctx.GetStub().GetState(shipmentID)
+	if err != nil {
+		return nil, fmt.Errorf("查询运输单失败: %v", err)
+	}
+	if shipmentJSON == nil {
+		return nil, fmt.Errorf("运输单不存在: %s", shipmentID)
+	}
+
+	var shipment Shipment
+	err = json.Unmarshal(shipmentJSON, &shipment)
+	if err != nil {
+		return nil, err
+	}
+
+	return &shipment, nil
+}
+
+// queryShipments 查询满足条件的运输单，按创建时间排序
+func (t *AgriTrace) queryShipments(ctx contractapi.TransactionContextInterface, match func(*Shipment) bool) ([]*Shipment, error) {
+	resultsIterator, err := ctx.GetStub().GetStateByRange("", "")
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	var shipments []*Shipment
+	for resultsIterator.HasNext() {
+		queryResult, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		// 只处理以SHIPMENT_开头的记录
+		if !strings.HasPrefix(queryResult.Key, "SHIPMENT_") {
+			continue
+		}
+
+		var shipment Shipment
+		err = json.Unmarshal(queryResult.Value, &shipment)
+		if err != nil {
+			continue // 跳过非运输单记录
+		}
+
+		if match(&shipment) {
+			shipments = append(shipments, &shipment)
+		}
+	}
+
+	// 如果没有找到记录，返回空数组而不是 nil
+	if shipments == nil {
+		shipments = []*Shipment{}
+	}
+
+	sort.Slice(shipments, func(i, j int) bool {
+		return shipments[i].CreatedAt.Before(shipments[j].CreatedAt)
+	})
+
+	return shipments, nil
+}
+
+// QueryShipmentsByProduct 查询包含指定批次的运输单
+func (t *AgriTrace) QueryShipmentsByProduct(ctx contractapi.TransactionContextInterface, productID string) ([]*Shipment, error) {
+	return t.queryShipments(ctx, func(shipment *Shipment) bool {
+		for _, item := range shipment.Items {
+			if item.ProductID == productID {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// QueryShipmentsByCarrier 查询物流商承运的运输单
+func (t *AgriTrace) QueryShipmentsByCarrier(ctx contractapi.TransactionContextInterface, carrierID string) ([]*Shipment, error) {
+	return t.queryShipments(ctx, func(shipment *Shipment) bool {
+		return shipment.CarrierID == carrierID
+	})
+}
+
+// productRoute 汇总运输单节点和物流记录历史，按时间顺序排列
+func productRoute(shipments []*Shipment, records []*LogisticsRecord) []RouteHop {
+	route := []RouteHop{}
+	for _, shipment := range shipments {
+		for _, checkpoint := range shipment.Checkpoints {
+			route = append(route, RouteHop{
+				Source:      "SHIPMENT",
+				RefID:       shipment.ID,
+				Sequence:    checkpoint.Sequence,
+				Location:    checkpoint.Location,
+				Status:      checkpoint.Status,
+				Description: checkpoint.Description,
+				OperatorID:  checkpoint.OperatorID,
+				RecordTime:  checkpoint.RecordTime,
+			})
+		}
+	}
+
+	for _, record := range records {
+		// 跳过全量扫描混入的非物流记录
+		if record.Status == "" && record.Location == "" {
+			continue
+		}
+
+		// 未更新过的物流记录只有当前状态
+		history := record.History
+		if len(history) == 0 {
+			history = []Checkpoint{{
+				Sequence:    1,
+				Location:    record.Location,
+				Status:      record.Status,
+				Description: record.Description,
+				OperatorID:  record.OperatorID,
+				RecordTime:  record.RecordTime,
+			}}
+		}
+		for _, checkpoint := range history {
+			route = append(route, RouteHop{
+				Source:      "LOGISTICS",
+				RefID:       record.ID,
+				Sequence:    checkpoint.Sequence,
+				Location:    checkpoint.Location,
+				Status:      checkpoint.Status,
+				Description: checkpoint.Description,
+				OperatorID:  checkpoint.OperatorID,
+				RecordTime:  checkpoint.RecordTime,
+			})
+		}
+	}
+
+	sort.SliceStable(route, func(i, j int) bool {
+		return route[i].RecordTime.Before(route[j].RecordTime)
+	})
+
+	return route
+}
+
+// custodyHoldingKey 生成批次持有记录键
+func custodyHoldingKey(productID string, holderID string) string {
+	return fmt.Sprintf("CUSTODY_%s_%s", productID, holderID)
+}
+
+// isRetailerID 判断参与方是否为零售商
+func isRetailerID(partyID string) bool {
+	return strings.HasPrefix(partyID, "RETAILER_")
+}
+
+// inventoryIndexName 库存唯一索引的复合键类型，按（零售商, 门店, 产品, 批次号）唯一
+const inventoryIndexName = "inventory~retailer~store~product~lot"
+
+// defaultInventoryID 生成库存记录的默认ID
+func defaultInventoryID(retailerID string, storeID string, productID string, lotID string) string {
+	id := fmt.Sprintf("INV_%s", strings.TrimPrefix(retailerID, "RETAILER_"))
+	if storeID != "" {
+		id = fmt.Sprintf("%s_%s", id, storeID)
+	}
+	id = fmt.Sprintf("%s_%s", id, productID)
+	if lotID != "" {
+		id = fmt.Sprintf("%s_%s", id, lotID)
+	}
+	return id
+}
+
+// checkInventoryIDFree 检查新建库存记录的ID未被占用；默认ID由各段拼接，不同的（门店, 产品, 批次号）组合可能生成相同的ID
+func checkInventoryIDFree(ctx contractapi.TransactionContextInterface, inventoryID string) error {
+	inventoryJSON, err := ctx.GetStub().GetState(inventoryID)
+	if err != nil {
+		return err
+	}
+	if inventoryJSON != nil {
+		return fmt.Errorf("库存记录ID已被占用: %s", inventoryID)
+	}
+	return nil
+}
+
+// findRetailInventory 按（零售商, 门店, 产品, 批次号）唯一索引查找库存记录，不存在时返回 nil；
+// 建立索引前登记的库存没有索引，取匹配记录中ID最小的一条，保证各节点结果一致
+func (t *AgriTrace) findRetailInventory(ctx contractapi.TransactionContextInterface, retailerID string, storeID string, productID string, lotID string) (*RetailInventory, error) {
+	indexKey, err := ctx.GetStub().CreateCompositeKey(inventoryIndexName, []string{retailerID, storeID, productID, lotID})
+	if err != nil {
+		return nil, err
+	}
+	inventoryID, err := ctx.GetStub().GetState(indexKey)
+	if err != nil {
+		return nil, fmt.Errorf("查询库存索引失败: %v", err)
+	}
+	if inventoryID != nil {
+		return t.QueryInventory(ctx, string(inventoryID))
+	}
+
+	inventories, err := t.QueryInventoryByRetailer(ctx, retailerID)
+	if err != nil {
+		return nil, err
+	}
+
+	var found *RetailInventory
+	for _, inventory := range inventories {
+		if inventory.StoreID != storeID || inventory.ProductID != productID || inventory.LotID != lotID {
+			continue
+		}
+		if found == nil || inventory.ID < found.ID {
+			found = inventory
+		}
+	}
+
+	return found, nil
+}
+
+// putRetailInventory 保存库存记录，并在唯一索引尚未建立时建立索引
+func putRetailInventory(ctx contractapi.TransactionContextInterface, inventory *RetailInventory) error {
+	inventoryJSON, err := json.Marshal(inventory)
+	if err != nil {
+		return err
+	}
+	err = ctx.GetStub().PutState(inventory.ID, inventoryJSON)
+	if err != nil {
+		return err
+	}
+
+	indexKey, err := ctx.GetStub().CreateCompositeKey(inventoryIndexName, []string{inventory.RetailerID, inventory.StoreID, inventory.ProductID, inventory.LotID})
+	if err != nil {
+		return err
+	}
+	indexed, err := ctx.GetStub().GetState(indexKey)
+	if err != nil {
+		return err
+	}
+	if indexed != nil {
+		return nil
+	}
+
+	return ctx.GetStub().PutState(indexKey, []byte(inventory.ID))
+}
+
+// heldQuantity 查询参与方持有的批次数量，产品所属农户的持有数量来自收获记录
+func (t *AgriTrace) heldQuantity(ctx contractapi.TransactionContextInterface, product *Product, holderID string) (int, error) {
+	// 零售商持有数量为该产品各批次号库存之和
+	if isRetailerID(holderID) {
+		inventories, err := t.QueryInventoryByRetailer(ctx, holderID)
+		if err != nil {
+			return 0, err
+		}
+		held := 0
+		for _, inventory := range inventories {
+			if inventory.ProductID == product.ID {
+				held += inventory.Quantity
+			}
+		}
+		return held, nil
+	}
+
+	holdingJSON, err := ctx.GetStub().GetState(custodyHoldingKey(product.ID, holderID))
+	if err != nil {
+		return 0, fmt.Errorf("查询持有记录失败: %v", err)
+	}
+	if holdingJSON == nil {
+		return 0, nil
+	}
+
+	var holding CustodyHolding
+	err = json.Unmarshal(holdingJSON, &holding)
+	if err != nil {
+		return 0, err
+	}
+
+	return holding.Quantity, nil
+}
+
+// committedQuantities 按批次汇总参与方已承诺但尚未扣减的数量：未结束运输单和待确认交接单中的数量。
+// 运输单送达后由其交接单接续占用，excludeShipmentID 用于在送达交易中排除该运输单自身
+func (t *AgriTrace) committedQuantities(ctx contractapi.TransactionContextInterface, holderID string, excludeShipmentID string) (map[string]int, error) {
+	committed := make(map[string]int)
+
+	shipments, err := t.queryShipments(ctx, func(shipment *Shipment) bool {
+		return shipment.ShipperID == holderID && shipment.ID != excludeShipmentID && len(shipmentTransitions[shipment.Status]) > 0
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, shipment := range shipments {
+		for _, item := range shipment.Items {
+			committed[item.ProductID] += item.Quantity
+		}
+	}
+
+	transfers, err := t.queryTransfers(ctx, func(transfer *LotTransfer) bool {
+		return transfer.SenderID == holderID && transfer.Status == "PENDING"
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, transfer := range transfers {
+		for _, item := range transfer.Items {
+			committed[item.ProductID] += item.Quantity
+		}
+	}
+
+	return committed, nil
+}
+
+// adjustCustody 调整参与方持有的批次数量：零售商调整零售库存，其他参与方（含农户）调整持有记录
+func (t *AgriTrace) adjustCustody(ctx contractapi.TransactionContextInterface, product *Product, holderID string, delta int, transfer *LotTransfer) error {
+	if delta == 0 {
+		return nil
+	}
+
+	if isRetailerID(holderID) {
+		return t.adjustRetailStock(ctx, holderID, product.ID, delta, transfer)
+	}
+
+	key := custodyHoldingKey(product.ID, holderID)
+	holdingJSON, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return fmt.Errorf("查询持有记录失败: %v", err)
+	}
+
+	holding := CustodyHolding{ID: key, ProductID: product.ID, HolderID: holderID}
+	if holdingJSON != nil {
+		err = json.Unmarshal(holdingJSON, &holding)
+		if err != nil {
+			return err
+		}
+	}
+
+	holding.Quantity += delta
+	if holding.Quantity < 0 {
+		return fmt.Errorf("%s 持有的批次 %s 数量不足", holderID, product.ID)
+	}
+	holding.UpdatedAt = time.Now()
+
+	holdingJSON, err = json.Marshal(holding)
+	if err != nil {
+		return err
+	}
+
+	err = ctx.GetStub().PutState(key, holdingJSON)
+	if err != nil {
+		return err
+	}
+
+	if isWarehouseID(holderID) {
+		return t.recordWarehouseMovement(ctx, product, &holding, delta, transfer)
+	}
+
+	return nil
+}
+
+// adjustRetailStock 按交接单调整零售商库存并记录库存变动：收货时入库到交接单指定的门店和批次号，库存记录不存在则新建；
+// 移交时与持有数量一致，在该零售商各门店、批次号的库存中先到期先出扣减
+func (t *AgriTrace) adjustRetailStock(ctx contractapi.TransactionContextInterface, retailerID string, productID string, delta int, transfer *LotTransfer) error {
+	movement := func(quantity int) *StockMovement {
+		movement := &StockMovement{
+			Type:       "RECEIPT",
+			Quantity:   quantity,
+			Reason:     transfer.Note,
+			Reference:  transfer.ID,
+			TransferID: transfer.ID,
+			ShipmentID: transfer.ShipmentID,
+		}
+		if movement.ShipmentID == "" {
+			movement.ShipmentID = transfer.LogisticsRecordID
+		}
+		if quantity < 0 {
+			movement.Type = "TRANSFER_OUT"
+		}
+		return movement
+	}
+
+	if delta < 0 {
+		retailerInventories, err := t.QueryInventoryByRetailer(ctx, retailerID)
+		if err != nil {
+			return err
+		}
+		var inventories []*RetailInventory
+		available := 0
+		for _, inventory := range retailerInventories {
+			if inventory.ProductID == productID && inventory.Quantity > 0 {
+				inventories = append(inventories, inventory)
+				available += inventory.Quantity
+			}
+		}
+		if available < -delta {
+			return fmt.Errorf("库存不足: 当前库存 %d, 需要数量 %d", available, -delta)
+		}
+		sort.SliceStable(inventories, func(i, j int) bool {
+			return fefoLess(inventories[i], inventories[j])
+		})
+
+		remaining := -delta
+		for _, inventory := range inventories {
+			if remaining == 0 {
+				break
+			}
+			take := inventory.Quantity
+			if take > remaining {
+				take = remaining
+			}
+			err = t.applyStockMovement(ctx, inventory, movement(-take))
+			if err != nil {
+				return err
+			}
+			remaining -= take
+		}
+		return nil
+	}
+
+	lotID := ""
+	for _, item := range transfer.Items {
+		if item.ProductID == productID {
+			lotID = item.LotID
+		}
+	}
+
+	product, err := t.QueryProduct(ctx, productID)
+	if err != nil {
+		return err
+	}
+	inventory, err := t.findRetailInventory(ctx, retailerID, transfer.StoreID, productID, lotID)
+	if err != nil {
+		return err
+	}
+
+	if inventory == nil {
+		inventory = &RetailInventory{
+			ID:         defaultInventoryID(retailerID, transfer.StoreID, productID, lotID),
+			ProductID:  productID,
+			RetailerID: retailerID,
+			StoreID:    transfer.StoreID,
+			LotID:      lotID,
+			ExpiryDate: product.ExpiryDate,
+		}
+		err = checkInventoryIDFree(ctx, inventory.ID)
+		if err != nil {
+			return err
+		}
+	} else if !product.ExpiryDate.IsZero() && !product.ExpiryDate.Equal(inventory.ExpiryDate) {
+		// 与 AddRetailInventory 一致，到期时间不同的货物不能并入同一条库存
+		return fmt.Errorf("库存记录 %s 的到期时间与批次到期时间不一致，请在交接单中指定不同的批次号", inventory.ID)
+	}
+
+	return t.applyStockMovement(ctx, inventory, movement(delta))
+}
+
+// stockMovementSigns 库存变动类型及数量方向：1 为入库，-1 为出库，0 为可增可减
+var stockMovementSigns = map[string]int{
+	"RECEIPT":      1,  // 收货入库
+	"SALE":         -1, // 销售出库
+	"RETURN":       1,  // 退货入库
+	"ADJUSTMENT":   0,  // 盘点调整
+	"TRANSFER_IN":  1,  // 调拨入库
+	"TRANSFER_OUT": -1, // 调拨出库
+	"WRITE_OFF":    -1, // 报损核销
+}
+
+// checkStockMovement 校验库存变动类型和数量方向
+func checkStockMovement(movement *StockMovement) error {
+	sign, ok := stockMovementSigns[movement.Type]
+	if !ok {
+		return fmt.Errorf("无效的库存变动类型: %s", movement.Type)
+	}
+	if movement.Quantity == 0 {
+		return fmt.Errorf("库存变动数量不能为0")
+	}
+	if sign > 0 && movement.Quantity < 0 || sign < 0 && movement.Quantity > 0 {
+		return fmt.Errorf("%s 类型的变动数量方向错误: %d", movement.Type, movement.Quantity)
+	}
+	return nil
+}
+
+// stockBalance 按变动记录累计库存数量
+func stockBalance(movements []*StockMovement) int {
+	balance := 0
+	for _, movement := range movements {
+		balance += movement.Quantity
+	}
+	return balance
+}
+
+// applyStockMovement 记录库存变动并更新库存记录中的数量；
+// 首次记录变动时若已有库存数量（早期直接写入的库存），先补一条期初调整，保证数量可由变动记录累计得出。
+// 同一交易中多次变动需传入同一个库存对象，数量为0的调整直接忽略
+func (t *AgriTrace) applyStockMovement(ctx contractapi.TransactionContextInterface, inventory *RetailInventory, movement *StockMovement) error {
+	if movement.Type == "ADJUSTMENT" && movement.Quantity == 0 {
+		return nil
+	}
+	err := checkStockMovement(movement)
+	if err != nil {
+		return err
+	}
+	if inventory.Quantity+movement.Quantity < 0 {
+		return fmt.Errorf("库存不足: 当前库存 %d, 需要数量 %d", inventory.Quantity, -movement.Quantity)
+	}
+
+	now := time.Now()
+	movements := []*StockMovement{}
+	if inventory.MovementSeq == 0 && inventory.Quantity != 0 {
+		movements = append(movements, &StockMovement{
+			Type:     "ADJUSTMENT",
+			Quantity: inventory.Quantity,
+			Reason:   "期初库存",
+		})
+		inventory.Quantity = 0
+	}
+	movements = append(movements, movement)
+
+	for _, m := range movements {
+		inventory.MovementSeq++
+		inventory.Quantity += m.Quantity
+
+		m.ID = fmt.Sprintf("MOVEMENT_%s_%06d", strings.TrimPrefix(inventory.ID, "INV_"), inventory.MovementSeq)
+		m.InventoryID = inventory.ID
+		m.RetailerID = inventory.RetailerID
+		m.ProductID = inventory.ProductID
+		m.Sequence = inventory.MovementSeq
+		m.Balance = inventory.Quantity
+		m.RecordTime = now
+
+		err = putStockMovement(ctx, m)
+		if err != nil {
+			return err
+		}
+	}
+
+	inventory.UpdatedAt = now
+
+	// 检查是否低于最小库存
+	updateLowStockState(inventory, now)
+
+	return putRetailInventory(ctx, inventory)
+}
+
+// RecordStockMovement 手工登记退货、盘点调整或报损核销，必须填写原因
+func (t *AgriTrace) RecordStockMovement(ctx contractapi.TransactionContextInterface, inventoryID string, movementData string) error {
+	var movement StockMovement
+	err := json.Unmarshal([]byte(movementData), &movement)
+	if err != nil {
+		return fmt.Errorf("解析库存变动数据失败: %v", err)
+	}
+
+	if movement.Type != "RETURN" && movement.Type != "ADJUSTMENT" && movement.Type != "WRITE_OFF" {
+		return fmt.Errorf("只能手工登记 RETURN、ADJUSTMENT 或 WRITE_OFF 类型的库存变动")
+	}
+	if len(movement.Reason) == 0 {
+		return fmt.Errorf("库存变动原因不能为空")
+	}
+	if movement.Type == "ADJUSTMENT" && movement.Quantity == 0 {
+		return fmt.Errorf("库存变动数量不能为0")
+	}
+	if movement.ReasonCode != "" {
+		err = checkAdjustmentReason(movement.ReasonCode, movement.Quantity)
+		if err != nil {
+			return err
+		}
+	}
+
+	inventory, err := t.QueryInventory(ctx, inventoryID)
+	if err != nil {
+		return err
+	}
+
+	movement.TransferID = ""
+	movement.ShipmentID = ""
+
+	return t.applyStockMovement(ctx, inventory, &movement)
+}
+
+// QueryInventoryBalance 按变动记录累计库存数量，未记录过变动的早期库存返回库存记录中的数量
+func (t *AgriTrace) QueryInventoryBalance(ctx contractapi.TransactionContextInterface, inventoryID string) (int, error) {
+	inventory, err := t.QueryInventory(ctx, inventoryID)
+	if err != nil {
+		return 0, err
+	}
+	if inventory.MovementSeq == 0 {
+		return inventory.Quantity, nil
+	}
+
+	movements, err := t.QueryStockMovements(ctx, inventoryID)
+	if err != nil {
+		return 0, err
+	}
+
+	return stockBalance(movements), nil
+}
+
+// putStockMovement 保存库存变动记录
+func putStockMovement(ctx contractapi.TransactionContextInterface, movement *StockMovement) error {
+	movementJSON, err := json.Marshal(movement)
+	if err != nil {
+		return err
+	}
+
+	return ctx.GetStub().PutState(movement.ID, movementJSON)
+}
+
+// QueryStockMovements 查询库存记录的变动历史，按变动序号排序
+func (t *AgriTrace) QueryStockMovements(ctx contractapi.TransactionContextInterface, inventoryID string) ([]*StockMovement, error) {
+	movements, err := t.queryStockMovements(ctx, func(movement *StockMovement) bool {
+		return movement.InventoryID == inventoryID
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(movements, func(i, j int) bool {
+		return movements[i].Sequence < movements[j].Sequence
+	})
+
+	return movements, nil
+}
+
+// queryStockMovements 查询满足条件的库存变动记录
+func (t *AgriTrace) queryStockMovements(ctx contractapi.TransactionContextInterface, match func(*StockMovement) bool) ([]*StockMovement, error) {
+	resultsIterator, err := ctx.GetStub().GetStateByRange("", "")
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	var movements []*StockMovement
+	for resultsIterator.HasNext() {
+		queryResult, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		// 只处理以MOVEMENT_开头的记录
+		if !strings.HasPrefix(queryResult.Key, "MOVEMENT_") {
+			continue
+		}
+
+		var movement StockMovement
+		err = json.Unmarshal(queryResult.Value, &movement)
+		if err != nil {
+			continue // 跳过非库存变动记录
+		}
+
+		if match(&movement) {
+			movements = append(movements, &movement)
+		}
+	}
+
+	// 如果没有找到记录，返回空数组而不是 nil
+	if movements == nil {
+		movements = []*StockMovement{}
+	}
+
+	return movements, nil
+}
+
+// claimCountsAsLoss 判断索赔数量是否计为损失：只计承运方认可或结案赔付的索赔，待处理、有异议和被驳回的不计
+func claimCountsAsLoss(claim *ShipmentClaim) bool {
+	switch claim.Status {
+	case "ACCEPTED":
+		return true
+	case "SETTLED":
+		return claim.Outcome != "DENIED"
+	}
+	return false
+}
+
+// putClaim 保存索赔
+func putClaim(ctx contractapi.TransactionContextInterface, claim *ShipmentClaim) error {
+	claimJSON, err := json.Marshal(claim)
+	if err != nil {
+		return err
+	}
+
+	return ctx.GetStub().PutState(claim.ID, claimJSON)
+}
+
+// FileClaim 收货方或发货方对已结束的运输单提交索赔，同一批次的累计索赔数量不能超过发运数量
+func (t *AgriTrace) FileClaim(ctx contractapi.TransactionContextInterface, claimData string) error {
+	var claim ShipmentClaim
+	err := json.Unmarshal([]byte(claimData), &claim)
+	if err != nil {
+		return fmt.Errorf("解析索赔数据失败: %v", err)
+	}
+
+	// 确保ID有正确的前缀
+	if !strings.HasPrefix(claim.ID, "CLAIM_") {
+		claim.ID = fmt.Sprintf("CLAIM_%s", claim.ID)
+	}
+
+	// 检查索赔是否已存在
+	claimJSON, err := ctx.GetStub().GetState(claim.ID)
+	if err != nil {
+		return err
+	}
+	if claimJSON != nil {
+		return fmt.Errorf("索赔已存在: %s", claim.ID)
+	}
+
+	shipment, err := t.QueryShipment(ctx, claim.ShipmentID)
+	if err != nil {
+		return err
+	}
+	if shipment.Status != "DELIVERED" && shipment.Status != "REJECTED" && shipment.Status != "LOST" {
+		return fmt.Errorf("运输单尚未结束，当前状态: %s", shipment.Status)
+	}
+	if claim.ClaimantID != shipment.ReceiverID && claim.ClaimantID != shipment.ShipperID {
+		return fmt.Errorf("只有运输单的发货方或收货方可以提交索赔")
+	}
+
+	if claim.Type != "SHORTAGE" && claim.Type != "DAMAGE" && claim.Type != "SPOILAGE" {
+		return fmt.Errorf("无效的索赔类型: %s", claim.Type)
+	}
+	if len(claim.Items) == 0 {
+		return fmt.Errorf("索赔至少包含一个批次")
+	}
+	if len(claim.EvidenceHashes) == 0 {
+		return fmt.Errorf("索赔必须提供证据哈希")
+	}
+	for _, hash := range claim.EvidenceHashes {
+		decoded, err := hex.DecodeString(hash)
+		if err != nil || len(decoded) != sha256.Size {
+			return fmt.Errorf("无效的证据哈希: %s", hash)
+		}
+	}
+
+	// 统计同一运输单已有索赔的数量
+	claims, err := t.QueryClaimsByShipment(ctx, shipment.ID)
+	if err != nil {
+		return err
+	}
+	claimed := make(map[string]int)
+	for _, existing := range claims {
+		// 未结案的索赔同样占用可索赔数量，被驳回的不占用
+		if existing.Outcome == "DENIED" {
+			continue
+		}
+		for _, item := range existing.Items {
+			claimed[item.ProductID] += item.Quantity
+		}
+	}
+
+	for _, item := range claim.Items {
+		if item.Quantity <= 0 {
+			return fmt.Errorf("批次 %s 的索赔数量必须大于0", item.ProductID)
+		}
+
+		shipped := 0
+		for _, shipmentItem := range shipment.Items {
+			if shipmentItem.ProductID == item.ProductID {
+				shipped = shipmentItem.Quantity
+			}
+		}
+		if shipped == 0 {
+			return fmt.Errorf("运输单中不包含批次: %s", item.ProductID)
+		}
+
+		claimed[item.ProductID] += item.Quantity
+		if claimed[item.ProductID] > shipped {
+			return fmt.Errorf("批次 %s 的累计索赔数量 %d 超过发运数量 %d", item.ProductID, claimed[item.ProductID], shipped)
+		}
+	}
+
+	claim.CarrierID = shipment.CarrierID
+	claim.Status = "FILED"
+	claim.CarrierResponse = ""
+	claim.Outcome = ""
+	claim.SettledAmount = 0
+	claim.SettlementNote = ""
+	claim.FiledAt = time.Now()
+	claim.RespondedAt = time.Time{}
+	claim.SettledAt = time.Time{}
+
+	return putClaim(ctx, &claim)
+}
+
+// RespondToClaim 承运方答复索赔，accept 为 true 表示认可，否则提出异议
+func (t *AgriTrace) RespondToClaim(ctx contractapi.TransactionContextInterface, claimID string, carrierID string, accept bool, response string) error {
+	claim, err := t.QueryClaim(ctx, claimID)
+	if err != nil {
+		return err
+	}
+	if claim.Status != "FILED" {
+		return fmt.Errorf("只有已提交的索赔可以答复，当前状态: %s", claim.Status)
+	}
+	if claim.CarrierID != carrierID {
+		return fmt.Errorf("只有承运方 %s 可以答复索赔", claim.CarrierID)
+	}
+	if len(response) == 0 {
+		return fmt.Errorf("答复内容不能为空")
+	}
+
+	claim.Status = "DISPUTED"
+	if accept {
+		claim.Status = "ACCEPTED"
+	}
+	claim.CarrierResponse = response
+	claim.RespondedAt = time.Now()
+
+	return putClaim(ctx, claim)
+}
+
+// SettleClaim 索赔结案，承运方答复后才能结案
+func (t *AgriTrace) SettleClaim(ctx contractapi.TransactionContextInterface, claimID string, outcome string, amount float64, note string) error {
+	claim, err := t.QueryClaim(ctx, claimID)
+	if err != nil {
+		return err
+	}
+	if claim.Status != "ACCEPTED" && claim.Status != "DISPUTED" {
+		return fmt.Errorf("只有承运方已答复的索赔可以结案，当前状态: %s", claim.Status)
+	}
+
+	switch outcome {
+	case "COMPENSATED", "PARTIAL":
+		if amount <= 0 {
+			return fmt.Errorf("赔付金额必须大于0")
+		}
+	case "DENIED":
+		if amount != 0 {
+			return fmt.Errorf("驳回的索赔赔付金额必须为0")
+		}
+	default:
+		return fmt.Errorf("无效的结案结果: %s", outcome)
+	}
+
+	claim.Status = "SETTLED"
+	claim.Outcome = outcome
+	claim.SettledAmount = amount
+	claim.SettlementNote = note
+	claim.SettledAt = time.Now()
+
+	return putClaim(ctx, claim)
+}
+
+// QueryClaim 查询索赔
+func (t *AgriTrace) QueryClaim(ctx contractapi.TransactionContextInterface, claimID string) (*ShipmentClaim, error) {
+	claimJSON, err := ctx.GetStub().GetState(claimID)
+	if err != nil {
+		return nil, fmt.Errorf("查询索赔失败: %v", err)
+	}
+	if claimJSON == nil {
+		return nil, fmt.Errorf("索赔不存在: %s", claimID)
+	}
+
+	var claim ShipmentClaim
+	err = json.Unmarshal(claimJSON, &claim)
+	if err != nil {
+		return nil, err
+	}
+
+	return &claim, nil
+}
+
+// queryClaims 查询满足条件的索赔，按提交时间排序
+func (t *AgriTrace) queryClaims(ctx contractapi.TransactionContextInterface, match func(*ShipmentClaim) bool) ([]*ShipmentClaim, error) {
+	resultsIterator, err := ctx.GetStub().GetStateByRange("", "")
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	var claims []*ShipmentClaim
+	for resultsIterator.HasNext() {
+		queryResult, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		// 只处理以CLAIM_开头的记录
+		if !strings.HasPrefix(queryResult.Key, "CLAIM_") {
+			continue
+		}
+
+		var claim ShipmentClaim
+		err = json.Unmarshal(queryResult.Value, &claim)
+		if err != nil {
+			continue // 跳过非索赔记录
+		}
+
+		if match(&claim) {
+			claims = append(claims, &claim)
+		}
+	}
+
+	// 如果没有找到记录，返回空数组而不是 nil
+	if claims == nil {
+		claims = []*ShipmentClaim{}
+	}
+
+	sort.Slice(claims, func(i, j int) bool {
+		return claims[i].FiledAt.Before(claims[j].FiledAt)
+	})
+
+	return claims, nil
+}
+
+// QueryClaimsByShipment 查询运输单的索赔
+func (t *AgriTrace) QueryClaimsByShipment(ctx contractapi.TransactionContextInterface, shipmentID string) ([]*ShipmentClaim, error) {
+	return t.queryClaims(ctx, func(claim *ShipmentClaim) bool {
+		return claim.ShipmentID == shipmentID
+	})
+}
+
+// massBalance 根据运输单、交接单和索赔计算批次的物料平衡
+func massBalance(productID string, shipments []*Shipment, transfers []*LotTransfer, claims []*ShipmentClaim) *MassBalance {
+	balance := &MassBalance{ProductID: productID}
+
+	// 送达后生成的交接单按运输单索引
+	receipts := make(map[string]*LotTransfer)
+	for _, transfer := range transfers {
+		if transfer.ShipmentID != "" {
+			receipts[transfer.ShipmentID] = transfer
+		}
+	}
+
+	// 计为损失的索赔数量按运输单汇总
+	claimed := make(map[string]int)
+	for _, claim := range claims {
+		if !claimCountsAsLoss(claim) {
+			continue
+		}
+		for _, item := range claim.Items {
+			if item.ProductID == productID {
+				claimed[claim.ShipmentID] += item.Quantity
+			}
+		}
+	}
+
+	for _, shipment := range shipments {
+		for _, item := range shipment.Items {
+			if item.ProductID != productID {
+				continue
+			}
+			balance.Shipped += item.Quantity
+
+			// 每个单位只计入一个去向，先按运输和收货状态归类
+			var inTransit, pending, received, rejected int
+			switch shipment.Status {
+			case "DELIVERED":
+				receipt := receipts[shipment.ID]
+				if receipt == nil || receipt.Status == "PENDING" {
+					pending = item.Quantity
+				} else if receipt.Status == "REJECTED" {
+					rejected = item.Quantity
+				} else {
+					for _, r := range receipt.Items {
+						if r.ProductID == productID {
+							received += r.AcceptedQuantity
+						}
+					}
+				}
+			case "REJECTED":
+				rejected = item.Quantity
+			case "LOST":
+			default:
+				inTransit = item.Quantity
+			}
+
+			// 索赔确认的损失先解释未归类的数量（短少、丢失），
+			// 超出部分是已收货、待收货或拒收货物的损坏变质，从对应去向转出
+			lost := claimed[shipment.ID]
+			if lost > item.Quantity {
+				lost = item.Quantity
+			}
+			excess := lost - (item.Quantity - inTransit - pending - received - rejected)
+			for _, bucket := range []*int{&received, &pending, &rejected, &inTransit} {
+				if excess <= 0 {
+					break
+				}
+				moved := *bucket
+				if moved > excess {
+					moved = excess
+				}
+				*bucket -= moved
+				excess -= moved
+			}
+
+			balance.InTransit += inTransit
+			balance.PendingReceipt += pending
+			balance.Received += received
+			balance.Rejected += rejected
+			balance.Lost += lost
+		}
+	}
+
+	balance.Unaccounted = balance.Shipped - balance.InTransit - balance.PendingReceipt - balance.Received - balance.Rejected - balance.Lost
+
+	return balance
+}
+
+// QueryMassBalance 查询批次的运输物料平衡
+func (t *AgriTrace) QueryMassBalance(ctx contractapi.TransactionContextInterface, productID string) (*MassBalance, error) {
+	exists, err := t.ProductExists(ctx, productID)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, fmt.Errorf("产品不存在: %s", productID)
+	}
+
+	shipments, err := t.QueryShipmentsByProduct(ctx, productID)
+	if err != nil {
+		return nil, err
+	}
+	transfers, err := t.QueryTransfersByProduct(ctx, productID)
+	if err != nil {
+		return nil, err
+	}
+	claims, err := t.queryClaims(ctx, func(claim *ShipmentClaim) bool {
+		for _, item := range claim.Items {
+			if item.ProductID == productID {
+				return true
+			}
+		}
+		return false
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return massBalance(productID, shipments, transfers, claims), nil
+}
+
+// carrierPerformance 根据承运方的运输单和索赔计算绩效
+func carrierPerformance(carrierID string, shipments []*Shipment, claims []*ShipmentClaim) *CarrierPerformance {
+	performance := &CarrierPerformance{CarrierID: carrierID}
+
+	for _, shipment := range shipments {
+		performance.Shipments++
+		switch shipment.Status {
+		case "DELIVERED":
+			performance.Delivered++
+		case "REJECTED":
+			performance.Rejected++
+		case "LOST":
+			performance.Lost++
+		}
+		for _, item := range shipment.Items {
+			performance.ShippedQuantity += item.Quantity
+		}
+	}
+
+	for _, claim := range claims {
+		performance.Claims++
+		performance.SettledAmount += claim.SettledAmount
+		if !claimCountsAsLoss(claim) {
+			continue
+		}
+		for _, item := range claim.Items {
+			performance.LostQuantity += item.Quantity
+		}
+	}
+
+	if performance.ShippedQuantity > 0 {
+		performance.LossRate = float64(performance.LostQuantity) / float64(performance.ShippedQuantity)
+	}
+
+	return performance
+}
+
+// QueryCarrierPerformance 查询承运方的运输及索赔绩效
+func (t *AgriTrace) QueryCarrierPerformance(ctx contractapi.TransactionContextInterface, carrierID string) (*CarrierPerformance, error) {
+	shipments, err := t.QueryShipmentsByCarrier(ctx, carrierID)
+	if err != nil {
+		return nil, err
+	}
+	claims, err := t.queryClaims(ctx, func(claim *ShipmentClaim) bool {
+		return claim.CarrierID == carrierID
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return carrierPerformance(carrierID, shipments, claims), nil
+}
+
+// isWarehouseID 判断参与方是否为仓库
+func isWarehouseID(partyID string) bool {
+	return strings.HasPrefix(partyID, "WAREHOUSE_")
+}
+
+// RegisterWarehouse 登记仓储设施及其存储条件
+func (t *AgriTrace) RegisterWarehouse(ctx contractapi.TransactionContextInterface, warehouseData string) error {
+	var warehouse Warehouse
+	err := json.Unmarshal([]byte(warehouseData), &warehouse)
+	if err != nil {
+		return fmt.Errorf("解析仓库数据失败: %v", err)
+	}
+
+	// 确保ID有正确的前缀
+	if !strings.HasPrefix(warehouse.ID, "WAREHOUSE_") {
+		warehouse.ID = fmt.Sprintf("WAREHOUSE_%s", warehouse.ID)
+	}
+
+	// 检查仓库是否已存在
+	warehouseJSON, err := ctx.GetStub().GetState(warehouse.ID)
+	if err != nil {
+		return err
+	}
+	if warehouseJSON != nil {
+		return fmt.Errorf("仓库已存在: %s", warehouse.ID)
+	}
+
+	if len(warehouse.Name) == 0 || len(warehouse.OperatorID) == 0 {
+		return fmt.Errorf("仓库名称和运营方不能为空")
+	}
+	if warehouse.Type != "WAREHOUSE" && warehouse.Type != "COLD_STORE" {
+		return fmt.Errorf("无效的仓库类型: %s", warehouse.Type)
+	}
+	err = checkCoordinates(warehouse.Latitude, warehouse.Longitude)
+	if err != nil {
+		return err
+	}
+	if warehouse.MinTemperature > warehouse.MaxTemperature {
+		return fmt.Errorf("存储温度下限不能高于上限")
+	}
+	if warehouse.MinHumidity < 0 || warehouse.MaxHumidity > 100 || warehouse.MinHumidity > warehouse.MaxHumidity {
+		return fmt.Errorf("存储湿度范围无效")
+	}
+
+	warehouse.CreatedAt = time.Now()
+
+	warehouseJSON, err = json.Marshal(warehouse)
+	if err != nil {
+		return err
+	}
+
+	return ctx.GetStub().PutState(warehouse.ID, warehouseJSON)
+}
+
+// QueryWarehouse 查询仓库
+func (t *AgriTrace) QueryWarehouse(ctx contractapi.TransactionContextInterface, warehouseID string) (*Warehouse, error) {
+	warehouseJSON, err := ctx.GetStub().GetState(warehouseID)
+	if err != nil {
+		return nil, fmt.Errorf("查询仓库失败: %v", err)
+	}
+	if warehouseJSON == nil {
+		return nil, fmt.Errorf("仓库不存在: %s", warehouseID)
+	}
+
+	var warehouse Warehouse
+	err = json.Unmarshal(warehouseJSON, &warehouse)
+	if err != nil {
+		return nil, err
+	}
+
+	return &warehouse, nil
+}
+
+// storageConditionWarning 检查仓库温度范围是否落在产品要求的储存温度范围内，未设置范围时不检查
+func storageConditionWarning(warehouse *Warehouse, product *Product) string {
+	if product.StorageMinTemp == 0 && product.StorageMaxTemp == 0 {
+		return ""
+	}
+	if warehouse.MinTemperature == 0 && warehouse.MaxTemperature == 0 {
+		return ""
+	}
+	if warehouse.MinTemperature < product.StorageMinTemp || warehouse.MaxTemperature > product.StorageMaxTemp {
+		return fmt.Sprintf("仓库温度范围 %.1f~%.1f°C 超出产品要求的 %.1f~%.1f°C",
+			warehouse.MinTemperature, warehouse.MaxTemperature, product.StorageMinTemp, product.StorageMaxTemp)
+	}
+	return ""
+}
+
+// recordWarehouseMovement 记录仓库出入库
+func (t *AgriTrace) recordWarehouseMovement(ctx contractapi.TransactionContextInterface, product *Product, holding *CustodyHolding, delta int, transfer *LotTransfer) error {
+	warehouse, err := t.QueryWarehouse(ctx, holding.HolderID)
+	if err != nil {
+		return err
+	}
+
+	movement := WarehouseMovement{
+		WarehouseID: warehouse.ID,
+		ProductID:   product.ID,
+		Direction:   "INBOUND",
+		Quantity:    delta,
+		Balance:     holding.Quantity,
+		TransferID:  transfer.ID,
+		RecordTime:  holding.UpdatedAt,
+	}
+	if delta < 0 {
+		movement.Direction = "OUTBOUND"
+		movement.Quantity = -delta
+	} else {
+		movement.ConditionWarning = storageConditionWarning(warehouse, product)
+	}
+	movement.ID = fmt.Sprintf("WHMOVE_%s_%s_%s", strings.TrimPrefix(transfer.ID, "TRANSFER_"), product.ID, movement.Direction)
+
+	movementJSON, err := json.Marshal(movement)
+	if err != nil {
+		return err
+	}
+
+	return ctx.GetStub().PutState(movement.ID, movementJSON)
+}
+
+// queryWarehouseMovements 查询满足条件的出入库记录，按时间排序
+func (t *AgriTrace) queryWarehouseMovements(ctx contractapi.TransactionContextInterface, match func(*WarehouseMovement) bool) ([]*WarehouseMovement, error) {
+	resultsIterator, err := ctx.GetStub().GetStateByRange("", "")
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	var movements []*WarehouseMovement
+	for resultsIterator.HasNext() {
+		queryResult, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		// 只处理以WHMOVE_开头的记录
+		if !strings.HasPrefix(queryResult.Key, "WHMOVE_") {
+			continue
+		}
+
+		var movement WarehouseMovement
+		err = json.Unmarshal(queryResult.Value, &movement)
+		if err != nil {
+			continue // 跳过非出入库记录
+		}
+
+		if match(&movement) {
+			movements = append(movements, &movement)
+		}
+	}
+
+	// 如果没有找到记录，返回空数组而不是 nil
+	if movements == nil {
+		movements = []*WarehouseMovement{}
+	}
+
+	sort.SliceStable(movements, func(i, j int) bool {
+		return movements[i].RecordTime.Before(movements[j].RecordTime)
+	})
+
+	return movements, nil
+}
+
+// QueryWarehouseMovements 查询仓库的出入库记录
+func (t *AgriTrace) QueryWarehouseMovements(ctx contractapi.TransactionContextInterface, warehouseID string) ([]*WarehouseMovement, error) {
+	return t.queryWarehouseMovements(ctx, func(movement *WarehouseMovement) bool {
+		return movement.WarehouseID == warehouseID
+	})
+}
+
+// QueryWarehouseStock 查询仓库当前在库的批次
+func (t *AgriTrace) QueryWarehouseStock(ctx contractapi.TransactionContextInterface, warehouseID string) ([]*CustodyHolding, error) {
+	resultsIterator, err := ctx.GetStub().GetStateByRange("", "")
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	var holdings []*CustodyHolding
+	for resultsIterator.HasNext() {
+		queryResult, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		// 只处理以CUSTODY_开头的记录
+		if !strings.HasPrefix(queryResult.Key, "CUSTODY_") {
+			continue
+		}
+
+		var holding CustodyHolding
+		err = json.Unmarshal(queryResult.Value, &holding)
+		if err != nil {
+			continue // 跳过非持有记录
+		}
+
+		if holding.HolderID == warehouseID && holding.Quantity > 0 {
+			holdings = append(holdings, &holding)
+		}
+	}
+
+	// 如果没有找到记录，返回空数组而不是 nil
+	if holdings == nil {
+		holdings = []*CustodyHolding{}
+	}
+
+	return holdings, nil
+}
+
+// warehouseStays 按仓库和批次把按时间排序的出入库记录归并为停留记录
+func warehouseStays(movements []*WarehouseMovement, now time.Time) []*WarehouseStay {
+	stays := []*WarehouseStay{}
+	open := make(map[string]*WarehouseStay)
+
+	for _, movement := range movements {
+		key := movement.WarehouseID + "|" + movement.ProductID
+		stay := open[key]
+
+		if movement.Direction == "INBOUND" {
+			if stay == nil {
+				stay = &WarehouseStay{
+					WarehouseID: movement.WarehouseID,
+					ProductID:   movement.ProductID,
+					InboundAt:   movement.RecordTime,
+					InStorage:   true,
+				}
+				open[key] = stay
+				stays = append(stays, stay)
+			}
+			stay.InQuantity += movement.Quantity
+		} else if stay != nil {
+			stay.OutQuantity += movement.Quantity
+			if movement.Balance <= 0 {
+				stay.OutboundAt = movement.RecordTime
+				stay.InStorage = false
+				delete(open, key)
+			}
+		}
+	}
+
+	for _, stay := range stays {
+		end := now
+		if !stay.InStorage {
+			end = stay.OutboundAt
+		}
+		stay.DurationHours = end.Sub(stay.InboundAt).Hours()
+	}
+
+	return stays
+}
+
+// QueryWarehouseStaysByProduct 查询批次的仓储停留记录及存储时长
+func (t *AgriTrace) QueryWarehouseStaysByProduct(ctx contractapi.TransactionContextInterface, productID string) ([]*WarehouseStay, error) {
+	movements, err := t.queryWarehouseMovements(ctx, func(movement *WarehouseMovement) bool {
+		return movement.ProductID == productID
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return warehouseStays(movements, time.Now()), nil
+}
+
+// putTransfer 保存交接单
+func putTransfer(ctx contractapi.TransactionContextInterface, transfer *LotTransfer) error {
+	transferJSON, err := json.Marshal(transfer)
+	if err != nil {
+		return err
+	}
+
+	return ctx.GetStub().PutState(transfer.ID, transferJSON)
+}
+
+// InitiateTransfer 移交方发起批次保管权交接，接收方确认前保管权不变
+func (t *AgriTrace) InitiateTransfer(ctx contractapi.TransactionContextInterface, transferData string) error {
+	var transfer LotTransfer
+	err := json.Unmarshal([]byte(transferData), &transfer)
+	if err != nil {
+		return fmt.Errorf("解析交接数据失败: %v", err)
+	}
+
+	// 物流记录关联由送达时的交接填写
+	transfer.LogisticsRecordID = ""
+
+	return t.createTransfer(ctx, &transfer)
+}
+
+// createTransfer 校验并保存待确认的交接单
+func (t *AgriTrace) createTransfer(ctx contractapi.TransactionContextInterface, transfer *LotTransfer) error {
+	// 确保ID有正确的前缀
+	if !strings.HasPrefix(transfer.ID, "TRANSFER_") {
+		transfer.ID = fmt.Sprintf("TRANSFER_%s", transfer.ID)
+	}
+
+	// 检查交接单是否已存在
+	transferJSON, err := ctx.GetStub().GetState(transfer.ID)
+	if err != nil {
+		return err
+	}
+	if transferJSON != nil {
+		return fmt.Errorf("交接单已存在: %s", transfer.ID)
+	}
+
+	if len(transfer.SenderID) == 0 || len(transfer.ReceiverID) == 0 {
+		return fmt.Errorf("移交方和接收方不能为空")
+	}
+	if transfer.SenderID == transfer.ReceiverID {
+		return fmt.Errorf("移交方和接收方不能相同")
+	}
+	for _, partyID := range []string{transfer.SenderID, transfer.ReceiverID} {
+		if isWarehouseID(partyID) {
+			_, err = t.QueryWarehouse(ctx, partyID)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if len(transfer.Items) == 0 {
+		return fmt.Errorf("交接单至少包含一个批次")
+	}
+	err = t.checkReceivingStore(ctx, transfer.ReceiverID, transfer.StoreID)
+	if err != nil {
+		return err
+	}
+
+	if transfer.ShipmentID != "" {
+		_, err = t.QueryShipment(ctx, transfer.ShipmentID)
+		if err != nil {
+			return err
+		}
+	}
+
+	// 运输单送达时其数量由本交接单接续占用，不重复计入
+	committed, err := t.committedQuantities(ctx, transfer.SenderID, transfer.ShipmentID)
+	if err != nil {
+		return err
+	}
+
+	seen := make(map[string]bool)
+	for i := range transfer.Items {
+		item := &transfer.Items[i]
+		if seen[item.ProductID] {
+			return fmt.Errorf("交接单中批次重复: %s", item.ProductID)
+		}
+		seen[item.ProductID] = true
+
+		if item.Quantity <= 0 {
+			return fmt.Errorf("批次 %s 的数量必须大于0", item.ProductID)
+		}
+
+		product, err := t.QueryProduct(ctx, item.ProductID)
+		if err != nil {
+			return err
+		}
+		held, err := t.heldQuantity(ctx, product, transfer.SenderID)
+		if err != nil {
+			return err
+		}
+		if held-committed[item.ProductID] < item.Quantity {
+			return fmt.Errorf("%s 持有的批次 %s 可用数量不足: 持有 %d, 已占用 %d, 需要 %d", transfer.SenderID, item.ProductID, held, committed[item.ProductID], item.Quantity)
+		}
+
+		item.AcceptedQuantity = 0
+		item.Discrepancy = ""
+	}
+
+	transfer.Status = "PENDING"
+	transfer.Reason = ""
+	transfer.InitiatedAt = time.Now()
+	transfer.RespondedAt = time.Time{}
+
+	return putTransfer(ctx, transfer)
+}
+
+// AcceptTransfer 接收方确认交接，可按批次填写实收数量和差异说明，未填写的批次按移交数量全部接收；
+// 移交方扣减移交数量，接收方增加实收数量
+func (t *AgriTrace) AcceptTransfer(ctx contractapi.TransactionContextInterface, transferID string, receiverID string, acceptanceData string) error {
+	transfer, err := t.QueryTransfer(ctx, transferID)
+	if err != nil {
+		return err
+	}
+	if transfer.Status != "PENDING" {
+		return fmt.Errorf("只有待确认的交接单可以接收，当前状态: %s", transfer.Status)
+	}
+	if transfer.ReceiverID != receiverID {
+		return fmt.Errorf("只有接收方 %s 可以确认交接", transfer.ReceiverID)
+	}
+
+	var received []TransferItem
+	if len(acceptanceData) > 0 {
+		err = json.Unmarshal([]byte(acceptanceData), &received)
+		if err != nil {
+			return fmt.Errorf("解析实收数据失败: %v", err)
+		}
+	}
+
+	for i := range transfer.Items {
+		item := &transfer.Items[i]
+		item.AcceptedQuantity = item.Quantity
+		for _, r := range received {
+			if r.ProductID != item.ProductID {
+				continue
+			}
+			if r.AcceptedQuantity < 0 || r.AcceptedQuantity > item.Quantity {
+				return fmt.Errorf("批次 %s 的实收数量必须在0到 %d 之间", item.ProductID, item.Quantity)
+			}
+			item.AcceptedQuantity = r.AcceptedQuantity
+			item.Discrepancy = r.Discrepancy
+		}
+
+		product, err := t.QueryProduct(ctx, item.ProductID)
+		if err != nil {
+			return err
+		}
+		err = t.adjustCustody(ctx, product, transfer.SenderID, -item.Quantity, transfer)
+		if err != nil {
+			return err
+		}
+		err = t.adjustCustody(ctx, product, transfer.ReceiverID, item.AcceptedQuantity, transfer)
+		if err != nil {
+			return err
+		}
+	}
+
+	transfer.Status = "ACCEPTED"
+	transfer.RespondedAt = time.Now()
+
+	err = putTransfer(ctx, transfer)
+	if err != nil {
+		return err
+	}
+
+	return t.fulfillReplenishments(ctx, transfer)
+}
+
+// RejectTransfer 接收方拒收，保管权不变
+func (t *AgriTrace) RejectTransfer(ctx contractapi.TransactionContextInterface, transferID string, receiverID string, reason string) error {
+	transfer, err := t.QueryTransfer(ctx, transferID)
+	if err != nil {
+		return err
+	}
+	if transfer.Status != "PENDING" {
+		return fmt.Errorf("只有待确认的交接单可以拒收，当前状态: %s", transfer.Status)
+	}
+	if transfer.ReceiverID != receiverID {
+		return fmt.Errorf("只有接收方 %s 可以拒收", transfer.ReceiverID)
+	}
+
+	transfer.Status = "REJECTED"
+	transfer.Reason = reason
+	transfer.RespondedAt = time.Now()
+
+	err = putTransfer(ctx, transfer)
+	if err != nil {
+		return err
+	}
+
+	if transfer.ShipmentID == "" {
+		return nil
+	}
+	return t.reopenReplenishments(ctx, transfer.ShipmentID, fmt.Sprintf("运输单 %s 交接被拒收: %s", transfer.ShipmentID, reason))
+}
+
+// QueryTransfer 查询交接单
+func (t *AgriTrace) QueryTransfer(ctx contractapi.TransactionContextInterface, transferID string) (*LotTransfer, error) {
+	transferJSON, err := ctx.GetStub().GetState(transferID)
+	if err != nil {
+		return nil, fmt.Errorf("查询交接单失败: %v", err)
+	}
+	if transferJSON == nil {
+		return nil, fmt.Errorf("交接单不存在: %s", transferID)
+	}
+
+	var transfer LotTransfer
+	err = json.Unmarshal(transferJSON, &transfer)
+	if err != nil {
+		return nil, err
+	}
+
+	return &transfer, nil
+}
+
+// queryTransfers 查询满足条件的交接单，按发起时间排序
+func (t *AgriTrace) queryTransfers(ctx contractapi.TransactionContextInterface, match func(*LotTransfer) bool) ([]*LotTransfer, error) {
+	resultsIterator, err := ctx.GetStub().GetStateByRange("", "")
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	var transfers []*LotTransfer
+	for resultsIterator.HasNext() {
+		queryResult, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		// 只处理以TRANSFER_开头的记录
+		if !strings.HasPrefix(queryResult.Key, "TRANSFER_") {
+			continue
+		}
+
+		var transfer LotTransfer
+		err = json.Unmarshal(queryResult.Value, &transfer)
+		if err != nil {
+			continue // 跳过非交接单记录
+		}
+
+		if match(&transfer) {
+			transfers = append(transfers, &transfer)
+		}
+	}
+
+	// 如果没有找到记录，返回空数组而不是 nil
+	if transfers == nil {
+		transfers = []*LotTransfer{}
+	}
+
+	sort.Slice(transfers, func(i, j int) bool {
+		return transfers[i].InitiatedAt.Before(transfers[j].InitiatedAt)
+	})
+
+	return transfers, nil
+}
+
+// QueryTransfersByParty 查询参与方作为移交方或接收方的交接单
+func (t *AgriTrace) QueryTransfersByParty(ctx contractapi.TransactionContextInterface, partyID string) ([]*LotTransfer, error) {
+	return t.queryTransfers(ctx, func(transfer *LotTransfer) bool {
+		return transfer.SenderID == partyID || transfer.ReceiverID == partyID
+	})
+}
+
+// QueryTransfersByProduct 查询包含指定批次的交接单
+func (t *AgriTrace) QueryTransfersByProduct(ctx contractapi.TransactionContextInterface, productID string) ([]*LotTransfer, error) {
+	return t.queryTransfers(ctx, func(transfer *LotTransfer) bool {
+		for _, item := range transfer.Items {
+			if item.ProductID == productID {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// defaultReservationTTL 未指定过期时间时预留的有效期
+const defaultReservationTTL = 30 * time.Minute
+
+// maxReservationTTL 预留的最长有效期
+const maxReservationTTL = 7 * 24 * time.Hour
+
+// reservationActive 判断预留在指定时间是否仍占用库存，过期未处理的预留不再占用
+func reservationActive(reservation *StockReservation, now time.Time) bool {
+	return reservation.Status == "ACTIVE" && now.Before(reservation.ExpiresAt)
+}
+
+// availableToSell 计算可售数量：在库数量减去仍有效的预留，excludeID 对应的预留不扣减
+func availableToSell(onHand int, reservations []*StockReservation, excludeID string, now time.Time) int {
+	available := onHand
+	for _, reservation := range reservations {
+		if reservation.ID != excludeID && reservationActive(reservation, now) {
+			available -= reservation.Quantity
+		}
+	}
+	return available
+}
+
+// availableQuantity 查询库存记录的可售数量
+func (t *AgriTrace) availableQuantity(ctx contractapi.TransactionContextInterface, inventory *RetailInventory, excludeID string) (int, error) {
+	reservations, err := t.QueryReservationsByInventory(ctx, inventory.ID)
+	if err != nil {
+		return 0, err
+	}
+
+	return availableToSell(inventory.Quantity, reservations, excludeID, time.Now()), nil
+}
+
+// putReservation 保存预留
+func putReservation(ctx contractapi.TransactionContextInterface, reservation *StockReservation) error {
+	reservationJSON, err := json.Marshal(reservation)
+	if err != nil {
+		return err
+	}
+
+	return ctx.GetStub().PutState(reservation.ID, reservationJSON)
+}
+
+// ReserveStock 为待付款订单预留库存，预留数量不能超过可售数量
+func (t *AgriTrace) ReserveStock(ctx contractapi.TransactionContextInterface, reservationData string) error {
+	var reservation StockReservation
+	err := json.Unmarshal([]byte(reservationData), &reservation)
+	if err != nil {
+		return fmt.Errorf("解析预留数据失败: %v", err)
+	}
+
+	// 确保ID有正确的前缀
+	if !strings.HasPrefix(reservation.ID, "RESERVE_") {
+		reservation.ID = fmt.Sprintf("RESERVE_%s", reservation.ID)
+	}
+
+	// 检查预留是否已存在
+	reservationJSON, err := ctx.GetStub().GetState(reservation.ID)
+	if err != nil {
+		return err
+	}
+	if reservationJSON != nil {
+		return fmt.Errorf("预留已存在: %s", reservation.ID)
+	}
+
+	if reservation.Quantity <= 0 {
+		return fmt.Errorf("预留数量必须大于0")
+	}
+	if len(reservation.ConsumerID) == 0 {
+		return fmt.Errorf("消费者ID不能为空")
+	}
+
+	now := time.Now()
+	if reservation.ExpiresAt.IsZero() {
+		reservation.ExpiresAt = now.Add(defaultReservationTTL)
+	}
+	if !reservation.ExpiresAt.After(now) || reservation.ExpiresAt.Sub(now) > maxReservationTTL {
+		return fmt.Errorf("预留过期时间必须在当前时间之后的 %v 以内", maxReservationTTL)
+	}
+
+	product, err := t.QueryProduct(ctx, reservation.ProductID)
+	if err != nil {
+		return err
+	}
+	if product.QualityHold {
+		return fmt.Errorf("产品处于质量冻结状态，无法预留: %s", product.QualityHoldReason)
+	}
+
+	inventory, err := t.findRetailInventory(ctx, reservation.RetailerID, reservation.StoreID, reservation.ProductID, reservation.LotID)
+	if err != nil {
+		return err
+	}
+	if inventory == nil {
+		return fmt.Errorf("未找到相关库存记录")
+	}
+	if inventoryExpired(inventory, now) {
+		return fmt.Errorf("库存已到期，不可预留: %s", inventory.ID)
+	}
+
+	available, err := t.availableQuantity(ctx, inventory, "")
+	if err != nil {
+		return err
+	}
+	if available < reservation.Quantity {
+		return fmt.Errorf("可售库存不足: 当前可售 %d, 需要数量 %d", available, reservation.Quantity)
+	}
+
+	reservation.InventoryID = inventory.ID
+	reservation.Status = "ACTIVE"
+	reservation.PurchaseID = ""
+	reservation.CreatedAt = now
+	reservation.ClosedAt = time.Time{}
+
+	return putReservation(ctx, &reservation)
+}
+
+// activeReservation 查询仍有效的预留
+func (t *AgriTrace) activeReservation(ctx contractapi.TransactionContextInterface, reservationID string, now time.Time) (*StockReservation, error) {
+	reservation, err := t.QueryReservation(ctx, reservationID)
+	if err != nil {
+		return nil, err
+	}
+	if reservation.Status != "ACTIVE" {
+		return nil, fmt.Errorf("预留已结束，当前状态: %s", reservation.Status)
+	}
+	if !reservationActive(reservation, now) {
+		return nil, fmt.Errorf("预留已过期: %s", reservationID)
+	}
+
+	return reservation, nil
+}
+
+// ReleaseReservation 取消订单时释放预留
+func (t *AgriTrace) ReleaseReservation(ctx contractapi.TransactionContextInterface, reservationID string) error {
+	now := time.Now()
+	reservation, err := t.activeReservation(ctx, reservationID, now)
+	if err != nil {
+		return err
+	}
+
+	reservation.Status = "RELEASED"
+	reservation.ClosedAt = now
+
+	return putReservation(ctx, reservation)
+}
+
+// ConfirmReservation 付款后按预留成交，购买数据中的产品、零售商、消费者和数量以预留为准
+func (t *AgriTrace) ConfirmReservation(ctx contractapi.TransactionContextInterface, reservationID string, purchaseData string) error {
+	var purchase ConsumerPurchase
+	err := json.Unmarshal([]byte(purchaseData), &purchase)
+	if err != nil {
+		return fmt.Errorf("解析购买记录数据失败: %v", err)
+	}
+
+	now := time.Now()
+	reservation, err := t.activeReservation(ctx, reservationID, now)
+	if err != nil {
+		return err
+	}
+
+	purchase.ProductID = reservation.ProductID
+	purchase.RetailerID = reservation.RetailerID
+	purchase.ConsumerID = reservation.ConsumerID
+	purchase.LotID = reservation.LotID
+	purchase.StoreID = reservation.StoreID
+	purchase.Quantity = reservation.Quantity
+
+	err = t.addConsumerPurchase(ctx, &purchase, reservation.ID)
+	if err != nil {
+		return err
+	}
+
+	reservation.Status = "CONFIRMED"
+	reservation.PurchaseID = purchase.ID
+	reservation.ClosedAt = now
+
+	return putReservation(ctx, reservation)
+}
+
+// QueryReservation 查询预留
+func (t *AgriTrace) QueryReservation(ctx contractapi.TransactionContextInterface, reservationID string) (*StockReservation, error) {
+	reservationJSON, err := ctx.GetStub().GetState(reservationID)
+	if err != nil {
+		return nil, fmt.Errorf("查询预留失败: %v", err)
+	}
+	if reservationJSON == nil {
+		return nil, fmt.Errorf("预留不存在: %s", reservationID)
+	}
+
+	var reservation StockReservation
+	err = json.Unmarshal(reservationJSON, &reservation)
+	if err != nil {
+		return nil, err
+	}
+
+	return &reservation, nil
+}
+
+// QueryReservationsByInventory 查询库存记录的所有预留
+func (t *AgriTrace) QueryReservationsByInventory(ctx contractapi.TransactionContextInterface, inventoryID string) ([]*StockReservation, error) {
+	return t.queryReservations(ctx, func(reservation *StockReservation) bool {
+		return reservation.InventoryID == inventoryID
+	})
+}
+
+// queryReservations 查询满足条件的预留
+func (t *AgriTrace) queryReservations(ctx contractapi.TransactionContextInterface, match func(*StockReservation) bool) ([]*StockReservation, error) {
+	resultsIterator, err := ctx.GetStub().GetStateByRange("", "")
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	var reservations []*StockReservation
+	for resultsIterator.HasNext() {
+		queryResult, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		// 只处理以RESERVE_开头的记录
+		if !strings.HasPrefix(queryResult.Key, "RESERVE_") {
+			continue
+		}
+
+		var reservation StockReservation
+		err = json.Unmarshal(queryResult.Value, &reservation)
+		if err != nil {
+			continue // 跳过非预留记录
+		}
+
+		if match(&reservation) {
+			reservations = append(reservations, &reservation)
+		}
+	}
+
+	// 如果没有找到记录，返回空数组而不是 nil
+	if reservations == nil {
+		reservations = []*StockReservation{}
+	}
+
+	return reservations, nil
+}
+
+// QueryAvailableStock 查询库存记录的可售数量（在库数量减去有效预留）
+func (t *AgriTrace) QueryAvailableStock(ctx contractapi.TransactionContextInterface, inventoryID string) (int, error) {
+	inventory, err := t.QueryInventory(ctx, inventoryID)
+	if err != nil {
+		return 0, err
+	}
+
+	return t.availableQuantity(ctx, inventory, "")
+}
+
+// updateLowStockState 按最小库存更新低库存预警状态，进入预警时记录时间
+func updateLowStockState(inventory *RetailInventory, now time.Time) {
+	low := inventory.Quantity <= inventory.MinQuantity
+	if low && !inventory.LowStock {
+		inventory.LowStockSince = now
+	}
+	if !low {
+		inventory.LowStockSince = time.Time{}
+	}
+	inventory.LowStock = low
+}
+
+// QueryLowStockInventories 查询零售商处于低库存预警的库存记录，按进入预警时间排序
+func (t *AgriTrace) QueryLowStockInventories(ctx contractapi.TransactionContextInterface, retailerID string) ([]*RetailInventory, error) {
+	inventories, err := t.QueryInventoryByRetailer(ctx, retailerID)
+	if err != nil {
+		return nil, err
+	}
+
+	lowStock := []*RetailInventory{}
+	for _, inventory := range inventories {
+		if inventory.LowStock {
+			lowStock = append(lowStock, inventory)
+		}
+	}
+
+	sort.SliceStable(lowStock, func(i, j int) bool {
+		return lowStock[i].LowStockSince.Before(lowStock[j].LowStockSince)
+	})
+
+	return lowStock, nil
+}
+
+// putReplenishment 保存补货申请
+func putReplenishment(ctx contractapi.TransactionContextInterface, request *ReplenishmentRequest) error {
+	request.UpdatedAt = time.Now()
+
+	requestJSON, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+
+	return ctx.GetStub().PutState(request.ID, requestJSON)
+}
+
+// RequestReplenishment 零售商发起补货申请
+func (t *AgriTrace) RequestReplenishment(ctx contractapi.TransactionContextInterface, requestData string) error {
+	var request ReplenishmentRequest
+	err := json.Unmarshal([]byte(requestData), &request)
+	if err != nil {
+		return fmt.Errorf("解析补货申请数据失败: %v", err)
+	}
+
+	// 确保ID有正确的前缀
+	if !strings.HasPrefix(request.ID, "REPLENISH_") {
+		request.ID = fmt.Sprintf("REPLENISH_%s", request.ID)
+	}
+
+	// 检查补货申请是否已存在
+	requestJSON, err := ctx.GetStub().GetState(request.ID)
+	if err != nil {
+		return err
+	}
+	if requestJSON != nil {
+		return fmt.Errorf("补货申请已存在: %s", request.ID)
+	}
+
+	if !isRetailerID(request.RetailerID) {
+		return fmt.Errorf("无效的零售商ID: %s", request.RetailerID)
+	}
+	if len(request.SupplierID) == 0 || request.SupplierID == request.RetailerID {
+		return fmt.Errorf("无效的供货方ID: %s", request.SupplierID)
+	}
+	if request.Quantity <= 0 {
+		return fmt.Errorf("补货数量必须大于0")
+	}
+
+	exists, err := t.ProductExists(ctx, request.ProductID)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("产品不存在: %s", request.ProductID)
+	}
+
+	request.Status = "REQUESTED"
+	request.SupplierNote = ""
+	request.ShipmentID = ""
+	request.FulfilledQuantity = 0
+	request.CreatedAt = time.Now()
+
+	return putReplenishment(ctx, &request)
+}
+
+// RespondReplenishment 供货方确认或拒绝补货申请
+func (t *AgriTrace) RespondReplenishment(ctx contractapi.TransactionContextInterface, requestID string, supplierID string, accept bool, note string) error {
+	request, err := t.QueryReplenishment(ctx, requestID)
+	if err != nil {
+		return err
+	}
+	if request.Status != "REQUESTED" {
+		return fmt.Errorf("只有已申请的补货可以答复，当前状态: %s", request.Status)
+	}
+	if request.SupplierID != supplierID {
+		return fmt.Errorf("只有供货方 %s 可以答复补货申请", request.SupplierID)
+	}
+
+	request.Status = "DECLINED"
+	if accept {
+		request.Status = "ACKNOWLEDGED"
+	}
+	request.SupplierNote = note
+
+	return putReplenishment(ctx, request)
+}
+
+// ShipReplenishment 供货方关联发货运输单，运输单须由供货方发往该零售商、包含申请的产品且尚未结束
+func (t *AgriTrace) ShipReplenishment(ctx contractapi.TransactionContextInterface, requestID string, shipmentID string) error {
+	request, err := t.QueryReplenishment(ctx, requestID)
+	if err != nil {
+		return err
+	}
+	if request.Status != "ACKNOWLEDGED" {
+		return fmt.Errorf("只有已确认的补货可以发货，当前状态: %s", request.Status)
+	}
+
+	shipment, err := t.QueryShipment(ctx, shipmentID)
+	if err != nil {
+		return err
+	}
+	if shipment.ShipperID != request.SupplierID || shipment.ReceiverID != request.RetailerID {
+		return fmt.Errorf("运输单的发货方和收货方与补货申请不符")
+	}
+	// 已结束的运输单不会再触发交接，关联后补货申请将无法完成
+	if len(shipmentTransitions[shipment.Status]) == 0 {
+		return fmt.Errorf("运输单已结束，当前状态: %s", shipment.Status)
+	}
+
+	found := false
+	for _, item := range shipment.Items {
+		if item.ProductID == request.ProductID {
+			found = true
+		}
+	}
+	if !found {
+		return fmt.Errorf("运输单中不包含产品: %s", request.ProductID)
+	}
+
+	request.Status = "SHIPPED"
+	request.ShipmentID = shipment.ID
+
+	return putReplenishment(ctx, request)
+}
+
+// CancelReplenishment 零售商取消尚未发货的补货申请
+func (t *AgriTrace) CancelReplenishment(ctx contractapi.TransactionContextInterface, requestID string, retailerID string) error {
+	request, err := t.QueryReplenishment(ctx, requestID)
+	if err != nil {
+		return err
+	}
+	if request.RetailerID != retailerID {
+		return fmt.Errorf("只有零售商 %s 可以取消补货申请", request.RetailerID)
+	}
+	if request.Status != "REQUESTED" && request.Status != "ACKNOWLEDGED" {
+		return fmt.Errorf("补货申请当前状态不能取消: %s", request.Status)
+	}
+
+	request.Status = "CANCELLED"
+
+	return putReplenishment(ctx, request)
+}
+
+// fulfillReplenishments 运输单送达的交接被接收后，完成关联的补货申请并记录实收数量
+func (t *AgriTrace) fulfillReplenishments(ctx contractapi.TransactionContextInterface, transfer *LotTransfer) error {
+	if transfer.ShipmentID == "" {
+		return nil
+	}
+
+	requests, err := t.queryReplenishments(ctx, func(request *ReplenishmentRequest) bool {
+		return request.ShipmentID == transfer.ShipmentID && request.Status == "SHIPPED"
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, request := range requests {
+		request.FulfilledQuantity = 0
+		for _, item := range transfer.Items {
+			if item.ProductID == request.ProductID {
+				request.FulfilledQuantity += item.AcceptedQuantity
+			}
+		}
+		request.Status = "FULFILLED"
+
+		err = putReplenishment(ctx, request)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// reopenReplenishments 运输单被拒收、丢失或送达的交接被拒收时，关联的补货申请退回已确认状态，供货方可重新发货
+func (t *AgriTrace) reopenReplenishments(ctx contractapi.TransactionContextInterface, shipmentID string, note string) error {
+	requests, err := t.queryReplenishments(ctx, func(request *ReplenishmentRequest) bool {
+		return request.ShipmentID == shipmentID && request.Status == "SHIPPED"
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, request := range requests {
+		request.Status = "ACKNOWLEDGED"
+		request.ShipmentID = ""
+		request.FulfilledQuantity = 0
+		request.SupplierNote = note
+
+		err = putReplenishment(ctx, request)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// QueryReplenishment 查询补货申请
+func (t *AgriTrace) QueryReplenishment(ctx contractapi.TransactionContextInterface, requestID string) (*ReplenishmentRequest, error) {
+	requestJSON, err := ctx.GetStub().GetState(requestID)
+	if err != nil {
+		return nil, fmt.Errorf("查询补货申请失败: %v", err)
+	}
+	if requestJSON == nil {
+		return nil, fmt.Errorf("补货申请不存在: %s", requestID)
+	}
+
+	var request ReplenishmentRequest
+	err = json.Unmarshal(requestJSON, &request)
+	if err != nil {
+		return nil, err
+	}
+
+	return &request, nil
+}
+
+// queryReplenishments 查询满足条件的补货申请，按申请时间排序
+func (t *AgriTrace) queryReplenishments(ctx contractapi.TransactionContextInterface, match func(*ReplenishmentRequest) bool) ([]*ReplenishmentRequest, error) {
+	resultsIterator, err := ctx.GetStub().GetStateByRange("", "")
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	var requests []*ReplenishmentRequest
+	for resultsIterator.HasNext() {
+		queryResult, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		// 只处理以REPLENISH_开头的记录
+		if !strings.HasPrefix(queryResult.Key, "REPLENISH_") {
+			continue
+		}
+
+		var request ReplenishmentRequest
+		err = json.Unmarshal(queryResult.Value, &request)
+		if err != nil {
+			continue // 跳过非补货申请记录
+		}
+
+		if match(&request) {
+			requests = append(requests, &request)
+		}
+	}
+
+	// 如果没有找到记录，返回空数组而不是 nil
+	if requests == nil {
+		requests = []*ReplenishmentRequest{}
+	}
+
+	sort.Slice(requests, func(i, j int) bool {
+		return requests[i].CreatedAt.Before(requests[j].CreatedAt)
+	})
+
+	return requests, nil
+}
+
+// QueryReplenishmentsByParty 查询零售商发起的或供货方收到的补货申请
+func (t *AgriTrace) QueryReplenishmentsByParty(ctx contractapi.TransactionContextInterface, partyID string) ([]*ReplenishmentRequest, error) {
+	return t.queryReplenishments(ctx, func(request *ReplenishmentRequest) bool {
+		return request.RetailerID == partyID || request.SupplierID == partyID
+	})
+}
+
+// queryRetailer 查询零售商
+func (t *AgriTrace) queryRetailer(ctx contractapi.TransactionContextInterface, retailerID string) (*Retailer, error) {
+	retailerJSON, err := ctx.GetStub().GetState(retailerID)
+	if err != nil {
+		return nil, fmt.Errorf("查询零售商失败: %v", err)
+	}
+	if retailerJSON == nil {
+		return nil, fmt.Errorf("零售商不存在: %s", retailerID)
+	}
+
+	var retailer Retailer
+	err = json.Unmarshal(retailerJSON, &retailer)
+	if err != nil {
+		return nil, err
+	}
+
+	return &retailer, nil
+}
+
+// checkRetailerStore 检查门店属于零售商，空门店表示零售商本部
+func (t *AgriTrace) checkRetailerStore(ctx contractapi.TransactionContextInterface, retailerID string, storeID string) error {
+	if storeID == "" {
+		return nil
+	}
+
+	retailer, err := t.queryRetailer(ctx, retailerID)
+	if err != nil {
+		return err
+	}
+	for _, store := range retailer.Stores {
+		if store.ID == storeID {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("零售商 %s 没有门店: %s", retailerID, storeID)
+}
+
+// checkReceivingStore 校验收货门店：只有收货方为零售商时可以指定，且须为该零售商的门店
+func (t *AgriTrace) checkReceivingStore(ctx contractapi.TransactionContextInterface, receiverID string, storeID string) error {
+	if storeID != "" && !isRetailerID(receiverID) {
+		return fmt.Errorf("只有收货方为零售商时可以指定收货门店: %s", receiverID)
+	}
+	return t.checkRetailerStore(ctx, receiverID, storeID)
+}
+
+// AddRetailerStore 为零售商添加门店
+func (t *AgriTrace) AddRetailerStore(ctx contractapi.TransactionContextInterface, retailerID string, storeData string) error {
+	var store Store
+	err := json.Unmarshal([]byte(storeData), &store)
+	if err != nil {
+		return fmt.Errorf("解析门店数据失败: %v", err)
+	}
+
+	retailer, err := t.queryRetailer(ctx, retailerID)
+	if err != nil {
+		return err
+	}
+
+	if len(store.ID) == 0 || len(store.Name) == 0 {
+		return fmt.Errorf("门店ID和名称不能为空")
+	}
+	for _, existing := range retailer.Stores {
+		if existing.ID == store.ID {
+			return fmt.Errorf("门店已存在: %s", store.ID)
+		}
+	}
+	err = checkCoordinates(store.Latitude, store.Longitude)
+	if err != nil {
+		return err
+	}
+
+	store.CreatedAt = time.Now()
+	retailer.Stores = append(retailer.Stores, store)
+
+	retailerJSON, err := json.Marshal(retailer)
+	if err != nil {
+		return err
+	}
+
+	return ctx.GetStub().PutState(retailer.ID, retailerJSON)
+}
+
+// QueryInventoryByStore 查询零售商门店的库存，空门店表示本部
+func (t *AgriTrace) QueryInventoryByStore(ctx contractapi.TransactionContextInterface, retailerID string, storeID string) ([]*RetailInventory, error) {
+	inventories, err := t.QueryInventoryByRetailer(ctx, retailerID)
+	if err != nil {
+		return nil, err
+	}
+
+	storeInventories := []*RetailInventory{}
+	for _, inventory := range inventories {
+		if inventory.StoreID == storeID {
+			storeInventories = append(storeInventories, inventory)
+		}
+	}
+
+	return storeInventories, nil
+}
+
+// TransferStock 在零售商的门店间调拨库存，调出扣减和调入增加在同一交易中完成，调入库存沿用原批次号
+func (t *AgriTrace) TransferStock(ctx contractapi.TransactionContextInterface, transferData string) error {
+	var transfer StockTransfer
+	err := json.Unmarshal([]byte(transferData), &transfer)
+	if err != nil {
+		return fmt.Errorf("解析调拨数据失败: %v", err)
+	}
+
+	// 确保ID有正确的前缀
+	if !strings.HasPrefix(transfer.ID, "STOCKXFER_") {
+		transfer.ID = fmt.Sprintf("STOCKXFER_%s", transfer.ID)
+	}
+
+	// 检查调拨单是否已存在
+	transferJSON, err := ctx.GetStub().GetState(transfer.ID)
+	if err != nil {
+		return err
+	}
+	if transferJSON != nil {
+		return fmt.Errorf("调拨单已存在: %s", transfer.ID)
+	}
+
+	if transfer.FromStoreID == transfer.ToStoreID {
+		return fmt.Errorf("调出门店和调入门店不能相同")
+	}
+	if transfer.Quantity <= 0 {
+		return fmt.Errorf("调拨数量必须大于0")
+	}
+	for _, storeID := range []string{transfer.FromStoreID, transfer.ToStoreID} {
+		err = t.checkRetailerStore(ctx, transfer.RetailerID, storeID)
+		if err != nil {
+			return err
+		}
+	}
+
+	source, err := t.findRetailInventory(ctx, transfer.RetailerID, transfer.FromStoreID, transfer.ProductID, transfer.LotID)
+	if err != nil {
+		return err
+	}
+	if source == nil {
+		return fmt.Errorf("未找到调出门店的库存记录")
+	}
+
+	// 已被预留的库存不能调出
+	available, err := t.availableQuantity(ctx, source, "")
+	if err != nil {
+		return err
+	}
+	if available < transfer.Quantity {
+		return fmt.Errorf("可调拨库存不足: 当前可售 %d, 需要数量 %d", available, transfer.Quantity)
+	}
+
+	target, err := t.findRetailInventory(ctx, transfer.RetailerID, transfer.ToStoreID, transfer.ProductID, transfer.LotID)
+	if err != nil {
+		return err
+	}
+	if target == nil {
+		target = &RetailInventory{
+			ID:          defaultInventoryID(transfer.RetailerID, transfer.ToStoreID, transfer.ProductID, transfer.LotID),
+			ProductID:   transfer.ProductID,
+			RetailerID:  transfer.RetailerID,
+			LotID:       transfer.LotID,
+			StoreID:     transfer.ToStoreID,
+			MinQuantity: source.MinQuantity,
+			ExpiryDate:  source.ExpiryDate,
+		}
+		err = checkInventoryIDFree(ctx, target.ID)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = t.applyStockMovement(ctx, source, &StockMovement{
+		Type:      "TRANSFER_OUT",
+		Quantity:  -transfer.Quantity,
+		Reason:    transfer.Reason,
+		Reference: transfer.ID,
+	})
+	if err != nil {
+		return err
+	}
+	err = t.applyStockMovement(ctx, target, &StockMovement{
+		Type:      "TRANSFER_IN",
+		Quantity:  transfer.Quantity,
+		Reason:    transfer.Reason,
+		Reference: transfer.ID,
+	})
+	if err != nil {
+		return err
+	}
+
+	transfer.FromInventoryID = source.ID
+	transfer.ToInventoryID = target.ID
+	transfer.TransferTime = time.Now()
+
+	transferJSON, err = json.Marshal(transfer)
+	if err != nil {
+		return err
+	}
+
+	return ctx.GetStub().PutState(transfer.ID, transferJSON)
+}
+
+// QueryStockTransfers 查询零售商的门店调拨记录，按调拨时间排序
+func (t *AgriTrace) QueryStockTransfers(ctx contractapi.TransactionContextInterface, retailerID string) ([]*StockTransfer, error) {
+	resultsIterator, err := ctx.GetStub().GetStateByRange("", "")
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	var transfers []*StockTransfer
+	for resultsIterator.HasNext() {
+		queryResult, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		// 只处理以STOCKXFER_开头的记录
+		if !strings.HasPrefix(queryResult.Key, "STOCKXFER_") {
+			continue
+		}
+
+		var transfer StockTransfer
+		err = json.Unmarshal(queryResult.Value, &transfer)
+		if err != nil {
+			continue // 跳过非调拨记录
+		}
+
+		if transfer.RetailerID == retailerID {
+			transfers = append(transfers, &transfer)
+		}
+	}
+
+	// 如果没有找到记录，返回空数组而不是 nil
+	if transfers == nil {
+		transfers = []*StockTransfer{}
+	}
+
+	sort.Slice(transfers, func(i, j int) bool {
+		return transfers[i].TransferTime.Before(transfers[j].TransferTime)
+	})
+
+	return transfers, nil
+}
+
+// adjustmentReasonCodes 库存调整原因代码，值为 true 的计入损耗（只能用于减少库存）
+var adjustmentReasonCodes = map[string]bool{
+	"SPOILAGE":    true,  // 变质
+	"THEFT":       true,  // 失窃
+	"DAMAGE":      true,  // 损坏
+	"COUNT_ERROR": false, // 记账或盘点误差
+	"OTHER":       false, // 其他
+}
+
+// checkAdjustmentReason 校验原因代码及其与调整方向是否匹配
+func checkAdjustmentReason(reasonCode string, quantity int) error {
+	shrinkage, ok := adjustmentReasonCodes[reasonCode]
+	if !ok {
+		return fmt.Errorf("无效的原因代码: %s", reasonCode)
+	}
+	if shrinkage && quantity > 0 {
+		return fmt.Errorf("原因代码 %s 只能用于减少库存", reasonCode)
+	}
+	return nil
+}
+
+// SubmitStocktake 提交盘点结果，按实盘数量与账面数量的差异记录带原因代码的盘点调整
+func (t *AgriTrace) SubmitStocktake(ctx contractapi.TransactionContextInterface, stocktakeData string) error {
+	var stocktake Stocktake
+	err := json.Unmarshal([]byte(stocktakeData), &stocktake)
+	if err != nil {
+		return fmt.Errorf("解析盘点数据失败: %v", err)
+	}
+
+	// 确保ID有正确的前缀
+	if !strings.HasPrefix(stocktake.ID, "STOCKTAKE_") {
+		stocktake.ID = fmt.Sprintf("STOCKTAKE_%s", stocktake.ID)
+	}
+
+	// 检查盘点单是否已存在
+	stocktakeJSON, err := ctx.GetStub().GetState(stocktake.ID)
+	if err != nil {
+		return err
+	}
+	if stocktakeJSON != nil {
+		return fmt.Errorf("盘点单已存在: %s", stocktake.ID)
+	}
+
+	if len(stocktake.Lines) == 0 {
+		return fmt.Errorf("盘点单至少包含一条明细")
+	}
+
+	seen := make(map[string]bool)
+	for i := range stocktake.Lines {
+		line := &stocktake.Lines[i]
+		if seen[line.InventoryID] {
+			return fmt.Errorf("盘点单中库存记录重复: %s", line.InventoryID)
+		}
+		seen[line.InventoryID] = true
+
+		if line.CountedQuantity < 0 {
+			return fmt.Errorf("库存记录 %s 的实盘数量不能为负数", line.InventoryID)
+		}
+
+		inventory, err := t.QueryInventory(ctx, line.InventoryID)
+		if err != nil {
+			return err
+		}
+		if inventory.RetailerID != stocktake.RetailerID {
+			return fmt.Errorf("库存记录 %s 不属于零售商 %s", line.InventoryID, stocktake.RetailerID)
+		}
+
+		line.ProductID = inventory.ProductID
+		line.BookQuantity = inventory.Quantity
+		line.Variance = line.CountedQuantity - line.BookQuantity
+		if line.Variance == 0 {
+			continue
+		}
+
+		if line.ReasonCode == "" {
+			return fmt.Errorf("库存记录 %s 存在差异 %d，必须填写原因代码", line.InventoryID, line.Variance)
+		}
+		err = checkAdjustmentReason(line.ReasonCode, line.Variance)
+		if err != nil {
+			return err
+		}
+
+		err = t.applyStockMovement(ctx, inventory, &StockMovement{
+			Type:       "ADJUSTMENT",
+			Quantity:   line.Variance,
+			Reason:     line.Note,
+			ReasonCode: line.ReasonCode,
+			Reference:  stocktake.ID,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	stocktake.SubmittedAt = time.Now()
+
+	stocktakeJSON, err = json.Marshal(stocktake)
+	if err != nil {
+		return err
+	}
+
+	return ctx.GetStub().PutState(stocktake.ID, stocktakeJSON)
+}
+
+// QueryStocktake 查询盘点单
+func (t *AgriTrace) QueryStocktake(ctx contractapi.TransactionContextInterface, stocktakeID string) (*Stocktake, error) {
+	stocktakeJSON, err := ctx.GetStub().GetState(stocktakeID)
+	if err != nil {
+		return nil, fmt.Errorf("查询盘点单失败: %v", err)
+	}
+	if stocktakeJSON == nil {
+		return nil, fmt.Errorf("盘点单不存在: %s", stocktakeID)
+	}
+
+	var stocktake Stocktake
+	err = json.Unmarshal(stocktakeJSON, &stocktake)
+	if err != nil {
+		return nil, err
+	}
+
+	return &stocktake, nil
+}
+
+// shrinkageReport 按产品和月份汇总带损耗原因代码的减少库存变动，结果按产品、月份排序
+func shrinkageReport(movements []*StockMovement) []*ShrinkageEntry {
+	entries := make(map[string]*ShrinkageEntry)
+	for _, movement := range movements {
+		if movement.Quantity >= 0 || !adjustmentReasonCodes[movement.ReasonCode] {
+			continue
+		}
+
+		period := movement.RecordTime.Format("2006-01")
+		key := movement.ProductID + "|" + period
+		entry := entries[key]
+		if entry == nil {
+			entry = &ShrinkageEntry{ProductID: movement.ProductID, Period: period, ByReason: make(map[string]int)}
+			entries[key] = entry
+		}
+		entry.Quantity += -movement.Quantity
+		entry.ByReason[movement.ReasonCode] += -movement.Quantity
+	}
+
+	report := []*ShrinkageEntry{}
+	for _, entry := range entries {
+		report = append(report, entry)
+	}
+	sort.Slice(report, func(i, j int) bool {
+		if report[i].ProductID != report[j].ProductID {
+			return report[i].ProductID < report[j].ProductID
+		}
+		return report[i].Period < report[j].Period
+	})
+
+	return report
+}
+
+// QueryShrinkageReport 查询零售商在日期范围内（含结束日期当天）按产品和月份汇总的损耗
+func (t *AgriTrace) QueryShrinkageReport(ctx contractapi.TransactionContextInterface, retailerID string, startDate string, endDate string) ([]*ShrinkageEntry, error) {
+	start, err := time.Parse("2006-01-02", startDate)
+	if err != nil {
+		return nil, fmt.Errorf("开始日期格式错误: %v", err)
+	}
+	end, err := time.Parse("2006-01-02", endDate)
+	if err != nil {
+		return nil, fmt.Errorf("结束日期格式错误: %v", err)
+	}
+	if end.Before(start) {
+		return nil, fmt.Errorf("结束日期不能早于开始日期")
+	}
+	end = end.AddDate(0, 0, 1)
+
+	movements, err := t.queryStockMovements(ctx, func(movement *StockMovement) bool {
+		return movement.RetailerID == retailerID &&
+			!movement.RecordTime.Before(start) && movement.RecordTime.Before(end)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return shrinkageReport(movements), nil
+}
+
+// inventoryExpired 判断库存在指定时间是否已到期
+func inventoryExpired(inventory *RetailInventory, now time.Time) bool {
+	return !inventory.ExpiryDate.IsZero() && !now.Before(inventory.ExpiryDate)
+}
+
+// stockLine 参与分配的库存及其可售数量
+type stockLine struct {
+	inventory *RetailInventory
+	available int
+}
+
+// fefoLess 先到期先出的库存顺序：先到期的在前，未设置到期时间的排在最后，到期时间相同时按ID排序
+func fefoLess(a *RetailInventory, b *RetailInventory) bool {
+	if a.ExpiryDate.IsZero() != b.ExpiryDate.IsZero() {
+		return b.ExpiryDate.IsZero()
+	}
+	if !a.ExpiryDate.Equal(b.ExpiryDate) {
+		return a.ExpiryDate.Before(b.ExpiryDate)
+	}
+	return a.ID < b.ID
+}
+
+// allocateFEFO 按先到期先出从库存中分配销售数量，跳过已到期的库存，未设置到期时间的排在最后
+func allocateFEFO(lines []stockLine, quantity int, now time.Time) ([]SaleAllocation, error) {
+	candidates := []stockLine{}
+	expired := 0
+	for _, line := range lines {
+		if inventoryExpired(line.inventory, now) {
+			expired += line.available
+			continue
+		}
+		if line.available > 0 {
+			candidates = append(candidates, line)
+		}
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return fefoLess(candidates[i].inventory, candidates[j].inventory)
+	})
+
+	allocations := []SaleAllocation{}
+	remaining := quantity
+	for _, line := range candidates {
+		if remaining == 0 {
+			break
+		}
+		take := line.available
+		if take > remaining {
+			take = remaining
+		}
+		allocations = append(allocations, SaleAllocation{
+			InventoryID: line.inventory.ID,
+			LotID:       line.inventory.LotID,
+			Quantity:    take,
+			ExpiryDate:  line.inventory.ExpiryDate,
+		})
+		remaining -= take
+	}
+
+	if remaining > 0 {
+		if expired > 0 {
+			return nil, fmt.Errorf("可售库存不足: 需要数量 %d, 未到期可售 %d, 另有 %d 已到期不可销售", quantity, quantity-remaining, expired)
+		}
+		return nil, fmt.Errorf("可售库存不足: 当前可售 %d, 需要数量 %d", quantity-remaining, quantity)
+	}
+
+	return allocations, nil
+}
+
+// sellStock 为销售扣减库存：按预留成交时使用预留的库存，指定批次号时只使用该批次，否则在门店该产品的所有库存中先到期先出
+func (t *AgriTrace) sellStock(ctx contractapi.TransactionContextInterface, record *SalesRecord, reservationID string, reason string) ([]SaleAllocation, error) {
+	// 已在售的产品被检测不合格或申诉未决时同样停止销售
+	product, err := t.QueryProduct(ctx, record.ProductID)
+	if err != nil {
+		return nil, err
+	}
+	if product.QualityHold {
+		return nil, fmt.Errorf("产品处于质量冻结状态，无法销售: %s", product.QualityHoldReason)
+	}
+
+	var inventories []*RetailInventory
+	if reservationID != "" {
+		reservation, err := t.QueryReservation(ctx, reservationID)
+		if err != nil {
+			return nil, err
+		}
+		inventory, err := t.QueryInventory(ctx, reservation.InventoryID)
+		if err != nil {
+			return nil, err
+		}
+		inventories = append(inventories, inventory)
+	} else if record.LotID != "" {
+		inventory, err := t.findRetailInventory(ctx, record.RetailerID, record.StoreID, record.ProductID, record.LotID)
+		if err != nil {
+			return nil, err
+		}
+		if inventory != nil {
+			inventories = append(inventories, inventory)
+		}
+	} else {
+		storeInventories, err := t.QueryInventoryByStore(ctx, record.RetailerID, record.StoreID)
+		if err != nil {
+			return nil, err
+		}
+		for _, inventory := range storeInventories {
+			if inventory.ProductID == record.ProductID {
+				inventories = append(inventories, inventory)
+			}
+		}
+	}
+
+	if len(inventories) == 0 {
+		return nil, fmt.Errorf("未找到相关库存记录")
+	}
+
+	byID := make(map[string]*RetailInventory)
+	for _, inventory := range inventories {
+		byID[inventory.ID] = inventory
+	}
+
+	// 一次查询所有候选库存的预留，按库存记录分组
+	reservations, err := t.queryReservations(ctx, func(reservation *StockReservation) bool {
+		return byID[reservation.InventoryID] != nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	reservationsByInventory := make(map[string][]*StockReservation)
+	for _, reservation := range reservations {
+		reservationsByInventory[reservation.InventoryID] = append(reservationsByInventory[reservation.InventoryID], reservation)
+	}
+
+	now := time.Now()
+	lines := []stockLine{}
+	for _, inventory := range inventories {
+		available := availableToSell(inventory.Quantity, reservationsByInventory[inventory.ID], reservationID, now)
+		lines = append(lines, stockLine{inventory: inventory, available: available})
+	}
+
+	allocations, err := allocateFEFO(lines, record.Quantity, now)
+	if err != nil {
+		return nil, err
+	}
+
+	// 记录销售出库
+	for _, allocation := range allocations {
+		err = t.applyStockMovement(ctx, byID[allocation.InventoryID], &StockMovement{
+			Type:      "SALE",
+			Quantity:  -allocation.Quantity,
+			Reason:    reason,
+			Reference: record.ID,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return allocations, nil
+}
+
+// parseExpiryDate 解析到期日期（yyyy-MM-dd），批次在该日结束时到期
+func parseExpiryDate(expiryDate string) (time.Time, error) {
+	date, err := time.Parse("2006-01-02", expiryDate)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("到期日期格式错误: %v", err)
+	}
+	return date.AddDate(0, 0, 1), nil
+}
+
+// SetProductExpiry 设置批次到期日期，之后新建的零售库存沿用该日期
+func (t *AgriTrace) SetProductExpiry(ctx contractapi.TransactionContextInterface, productID string, expiryDate string) error {
+	expiry, err := parseExpiryDate(expiryDate)
+	if err != nil {
+		return err
+	}
+
+	product, err := t.QueryProduct(ctx, productID)
+	if err != nil {
+		return err
+	}
+
+	product.ExpiryDate = expiry
+	product.UpdatedAt = time.Now()
+
+	productJSON, err := json.Marshal(product)
+	if err != nil {
+		return err
+	}
+
+	return ctx.GetStub().PutState(product.ID, productJSON)
+}
+
+// SetInventoryExpiry 设置库存记录的到期日期
+func (t *AgriTrace) SetInventoryExpiry(ctx contractapi.TransactionContextInterface, inventoryID string, expiryDate string) error {
+	expiry, err := parseExpiryDate(expiryDate)
+	if err != nil {
+		return err
+	}
+
+	inventory, err := t.QueryInventory(ctx, inventoryID)
+	if err != nil {
+		return err
+	}
+
+	inventory.ExpiryDate = expiry
+	inventory.UpdatedAt = time.Now()
+
+	return putRetailInventory(ctx, inventory)
+}
+
+// QueryExpiringInventories 查询在 days 天内到期（含已到期）且仍有库存的记录，按到期时间排序；retailerID 为空时查询所有零售商
+func (t *AgriTrace) QueryExpiringInventories(ctx contractapi.TransactionContextInterface, retailerID string, days int) ([]*RetailInventory, error) {
+	if days < 0 {
+		return nil, fmt.Errorf("天数不能为负数")
+	}
+
+	inventories, err := t.QueryAllInventories(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	deadline := time.Now().AddDate(0, 0, days)
+	expiring := []*RetailInventory{}
+	for _, inventory := range inventories {
+		if retailerID != "" && inventory.RetailerID != retailerID {
+			continue
+		}
+		if inventory.Quantity > 0 && !inventory.ExpiryDate.IsZero() && inventory.ExpiryDate.Before(deadline) {
+			expiring = append(expiring, inventory)
+		}
+	}
+
+	sort.SliceStable(expiring, func(i, j int) bool {
+		return expiring[i].ExpiryDate.Before(expiring[j].ExpiryDate)
+	})
+
+	return expiring, nil
+}
+
+// ExpirationReport 到期处理结果
+type ExpirationReport struct {
+	ProcessedAt         time.Time          `json:"processedAt"`         // 处理时间
+	WrittenOff          []ExpiredInventory `json:"writtenOff"`          // 到期报废的库存
+	ExpiredReservations []string           `json:"expiredReservations"` // 释放的预留ID
+	ClosedPrices        []string           `json:"closedPrices"`        // 结束的价格记录ID
+	SoldOutProducts     []string           `json:"soldOutProducts"`     // 标记为售罄的产品ID
+}
+
+// ExpiredInventory 到期报废的库存明细
+type ExpiredInventory struct {
+	InventoryID string    `json:"inventoryId"` // 库存记录ID
+	ProductID   string    `json:"productId"`   // 产品ID
+	RetailerID  string    `json:"retailerId"`  // 零售商ID
+	LotID       string    `json:"lotId"`       // 批次号
+	Quantity    int       `json:"quantity"`    // 报废数量
+	ExpiryDate  time.Time `json:"expiryDate"`  // 到期时间
+}
+
+// priceEnded 判断仍为有效状态的价格记录是否已过结束时间
+func priceEnded(price *PriceRecord, now time.Time) bool {
+	return price.Status == "ACTIVE" && !price.EndTime.IsZero() && !now.Before(price.EndTime)
+}
+
+// soldOutProducts 从在售产品中找出零售库存已全部清空的产品，没有任何零售库存记录的产品不计入
+func soldOutProducts(products []*Product, inventories []*RetailInventory) []*Product {
+	stocked := make(map[string]bool)
+	onHand := make(map[string]int)
+	for _, inventory := range inventories {
+		stocked[inventory.ProductID] = true
+		onHand[inventory.ProductID] += inventory.Quantity
+	}
+
+	soldOut := []*Product{}
+	for _, product := range products {
+		if product.Status == "ON_SALE" && stocked[product.ID] && onHand[product.ID] <= 0 {
+			soldOut = append(soldOut, product)
+		}
+	}
+	return soldOut
+}
+
+// ProcessExpirations 到期处理，供链下定时任务调用：报废到期库存、释放过期预留、结束到期价格、将库存清空的在售产品标记为售罄。
+// 已处理的记录不会再次命中，重复调用不会产生额外变更
+func (t *AgriTrace) ProcessExpirations(ctx contractapi.TransactionContextInterface) (*ExpirationReport, error) {
+	now := time.Now()
+	report := &ExpirationReport{
+		ProcessedAt:         now,
+		WrittenOff:          []ExpiredInventory{},
+		ExpiredReservations: []string{},
+		ClosedPrices:        []string{},
+		SoldOutProducts:     []string{},
+	}
+
+	// 报废到期库存
+	inventories, err := t.QueryAllInventories(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	expiredInventories := make(map[string]bool)
+	for _, inventory := range inventories {
+		if inventory.Quantity <= 0 || !inventoryExpired(inventory, now) {
+			continue
+		}
+
+		quantity := inventory.Quantity
+		err = t.applyStockMovement(ctx, inventory, &StockMovement{
+			Type:       "WRITE_OFF",
+			Quantity:   -quantity,
+			Reason:     "批次到期报废",
+			ReasonCode: "SPOILAGE",
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		expiredInventories[inventory.ID] = true
+		report.WrittenOff = append(report.WrittenOff, ExpiredInventory{
+			InventoryID: inventory.ID,
+			ProductID:   inventory.ProductID,
+			RetailerID:  inventory.RetailerID,
+			LotID:       inventory.LotID,
+			Quantity:    quantity,
+			ExpiryDate:  inventory.ExpiryDate,
+		})
+	}
+
+	// 释放过期预留以及已报废库存上的预留
+	reservations, err := t.queryReservations(ctx, func(reservation *StockReservation) bool {
+		return reservation.Status == "ACTIVE" &&
+			(!reservationActive(reservation, now) || expiredInventories[reservation.InventoryID])
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, reservation := range reservations {
+		reservation.Status = "EXPIRED"
+		reservation.ClosedAt = now
+		err = putReservation(ctx, reservation)
+		if err != nil {
+			return nil, err
+		}
+		report.ExpiredReservations = append(report.ExpiredReservations, reservation.ID)
+	}
+
+	// 结束到期价格
+	resultsIterator, err := ctx.GetStub().GetStateByRange("", "")
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	var prices []*PriceRecord
+	for resultsIterator.HasNext() {
+		queryResult, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		// 只处理以PRICE_开头的记录
+		if !strings.HasPrefix(queryResult.Key, "PRICE_") {
+			continue
+		}
+
+		var price PriceRecord
+		err = json.Unmarshal(queryResult.Value, &price)
+		if err != nil {
+			continue // 跳过非价格记录
+		}
+
+		if priceEnded(&price, now) {
+			prices = append(prices, &price)
+		}
+	}
+
+	for _, price := range prices {
+		price.Status = "INACTIVE"
+		priceJSON, err := json.Marshal(price)
+		if err != nil {
+			return nil, err
+		}
+		err = ctx.GetStub().PutState(price.ID, priceJSON)
+		if err != nil {
+			return nil, err
+		}
+		report.ClosedPrices = append(report.ClosedPrices, price.ID)
+	}
+
+	// 库存已清空的在售产品标记为售罄，报废后的库存数量已在内存中更新
+	products, err := t.QueryProductsByStatus(ctx, "ON_SALE")
+	if err != nil {
+		return nil, err
+	}
+
+	for _, product := range soldOutProducts(products, inventories) {
+		product.Status = "SOLD_OUT"
+		product.UpdatedAt = now
+		productJSON, err := json.Marshal(product)
+		if err != nil {
+			return nil, err
+		}
+		err = ctx.GetStub().PutState(product.ID, productJSON)
+		if err != nil {
+			return nil, err
+		}
+		report.SoldOutProducts = append(report.SoldOutProducts, product.ID)
+	}
+
+	return report, nil
+}
+
 func main() {
 	chaincode, err := contractapi.NewChaincode(&AgriTrace{})
 	if err != nil {
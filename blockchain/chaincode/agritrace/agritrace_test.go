@@ -1,12 +1,25 @@
 package main
 
 import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
 	"encoding/json"
+	"encoding/pem"
 	"fmt"
+	"sort"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/hyperledger/fabric-chaincode-go/shim"
 	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+	"github.com/hyperledger/fabric-protos-go/ledger/queryresult"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 )
@@ -56,13 +69,13 @@ func (mi *MockIterator) HasNext() bool {
 	return mi.current < len(mi.items)
 }
 
-func (mi *MockIterator) Next() (*shim.QueryResponse, error) {
+func (mi *MockIterator) Next() (*queryresult.KV, error) {
 	if !mi.HasNext() {
 		return nil, fmt.Errorf("no more items")
 	}
 	item := mi.items[mi.current]
 	mi.current++
-	return &shim.QueryResponse{
+	return &queryresult.KV{
 		Key:    fmt.Sprintf("key%d", mi.current),
 		Value:  item,
 	}, nil
@@ -73,6 +86,100 @@ func (mi *MockIterator) Close() error {
 	return nil
 }
 
+// memoryStub 内存账本，写入在 commit 之后才对读取可见，与 Fabric 交易内读不到本交易写入的行为一致
+type memoryStub struct {
+	shim.ChaincodeStubInterface
+	state  map[string][]byte
+	writes map[string][]byte
+	events []string
+}
+
+type memoryContext struct {
+	contractapi.TransactionContextInterface
+	stub *memoryStub
+}
+
+func (mc *memoryContext) GetStub() shim.ChaincodeStubInterface {
+	return mc.stub
+}
+
+func newMemoryContext() (*memoryContext, *memoryStub) {
+	stub := &memoryStub{state: map[string][]byte{}, writes: map[string][]byte{}}
+	return &memoryContext{stub: stub}, stub
+}
+
+// commit 交易成功时提交写入，失败时丢弃写入，返回交易的错误
+func (ms *memoryStub) commit(err error) error {
+	if err == nil {
+		for key, value := range ms.writes {
+			ms.state[key] = value
+		}
+	}
+	ms.writes = map[string][]byte{}
+	return err
+}
+
+func (ms *memoryStub) GetState(key string) ([]byte, error) {
+	return ms.state[key], nil
+}
+
+func (ms *memoryStub) PutState(key string, value []byte) error {
+	ms.writes[key] = value
+	return nil
+}
+
+func (ms *memoryStub) SetEvent(name string, payload []byte) error {
+	ms.events = append(ms.events, name)
+	return nil
+}
+
+func (ms *memoryStub) CreateCompositeKey(objectType string, attributes []string) (string, error) {
+	key := "\x00" + objectType + "\x00"
+	for _, attribute := range attributes {
+		key += attribute + "\x00"
+	}
+	return key, nil
+}
+
+// GetStateByRange 与 Fabric 一致，范围查询不返回复合键，endKey 不包含在内
+func (ms *memoryStub) GetStateByRange(startKey string, endKey string) (shim.StateQueryIteratorInterface, error) {
+	var keys []string
+	for key := range ms.state {
+		if strings.HasPrefix(key, "\x00") || key < startKey || (endKey != "" && key >= endKey) {
+			continue
+		}
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	iterator := &memoryIterator{}
+	for _, key := range keys {
+		iterator.items = append(iterator.items, &queryresult.KV{Key: key, Value: ms.state[key]})
+	}
+	return iterator, nil
+}
+
+type memoryIterator struct {
+	items   []*queryresult.KV
+	current int
+}
+
+func (mi *memoryIterator) HasNext() bool {
+	return mi.current < len(mi.items)
+}
+
+func (mi *memoryIterator) Next() (*queryresult.KV, error) {
+	if !mi.HasNext() {
+		return nil, fmt.Errorf("no more items")
+	}
+	mi.current++
+	return mi.items[mi.current-1], nil
+}
+
+func (mi *memoryIterator) Close() error {
+	return nil
+}
+
 func TestQueryProductsByFarmer(t *testing.T) {
 	// 创建测试数据
 	products := []Product{
@@ -128,4 +235,1714 @@ func TestQueryProductsByFarmer(t *testing.T) {
 	assert.Equal(t, 2, len(resultProducts))
 	assert.Equal(t, "farmer1", resultProducts[0].FarmerID)
 	assert.Equal(t, "farmer1", resultProducts[1].FarmerID)
-} 
\ No newline at end of file
+} 
+
+func TestCertificateHashAndSignature(t *testing.T) {
+	recordTime := time.Date(2024, 5, 1, 8, 0, 0, 0, time.UTC)
+	records := []*QualityRecord{
+		{ID: "qr2", ProductID: "product1", Stage: "HARVESTING", TestType: "农残", Result: "未检出", IsQualified: true, RecordTime: recordTime, InspectorID: "inspector1"},
+		{ID: "qr1", ProductID: "product1", Stage: "GROWING", TestType: "重金属", Result: "合格", IsQualified: true, RecordTime: recordTime, InspectorID: "inspector1"},
+	}
+
+	// 记录顺序不影响哈希
+	hash, err := certificateHash("product1", records)
+	assert.NoError(t, err)
+	reversed, err := certificateHash("product1", []*QualityRecord{records[1], records[0]})
+	assert.NoError(t, err)
+	assert.Equal(t, hash, reversed)
+
+	// 记录内容变化导致哈希变化
+	tampered := *records[0]
+	tampered.Result = "超标"
+	changed, err := certificateHash("product1", []*QualityRecord{&tampered, records[1]})
+	assert.NoError(t, err)
+	assert.NotEqual(t, hash, changed)
+
+	// Ed25519 原始公钥
+	edPublic, edPrivate, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	edSignature := base64.StdEncoding.EncodeToString(ed25519.Sign(edPrivate, []byte(hash)))
+	edKey := base64.StdEncoding.EncodeToString(edPublic)
+	assert.NoError(t, verifySignature(edKey, []byte(hash), edSignature))
+	assert.Error(t, verifySignature(edKey, []byte(changed), edSignature))
+
+	// PEM 格式的 ECDSA 公钥
+	ecPrivate, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	digest := sha256.Sum256([]byte(hash))
+	ecSignature, err := ecdsa.SignASN1(rand.Reader, ecPrivate, digest[:])
+	assert.NoError(t, err)
+	der, err := x509.MarshalPKIXPublicKey(&ecPrivate.PublicKey)
+	assert.NoError(t, err)
+	ecKey := string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+	assert.NoError(t, verifySignature(ecKey, []byte(hash), base64.StdEncoding.EncodeToString(ecSignature)))
+	assert.Error(t, verifySignature(ecKey, []byte(changed), base64.StdEncoding.EncodeToString(ecSignature)))
+}
+
+func TestEnvironmentMetricsAndThreshold(t *testing.T) {
+	// 旧格式记录转换为指标读数
+	legacy := &EnvironmentRecord{ID: "env1", ProductID: "product1", Temperature: 38, Humidity: 60}
+	assert.NoError(t, normalizeEnvironmentMetrics(legacy))
+	assert.Equal(t, 2, len(legacy.Metrics))
+	assert.Equal(t, "°C", legacy.Metrics[0].Unit)
+
+	// 指标读数回填温度字段
+	record := &EnvironmentRecord{ID: "env2", ProductID: "product1", Metrics: []SensorMetric{
+		{Metric: "temperature", Value: 28},
+		{Metric: "soil_ph", Value: 5.2},
+		{Metric: "leaf_wetness", Value: 3, Unit: "h"},
+	}}
+	assert.NoError(t, normalizeEnvironmentMetrics(record))
+	assert.Equal(t, 28.0, record.Temperature)
+
+	// 未采集温度、湿度的记录不写出旧字段，避免被旧版读取方当作 0 读数
+	soil := &EnvironmentRecord{ID: "env3", ProductID: "product1", Metrics: []SensorMetric{{Metric: "soil_ph", Value: 6.5}}}
+	assert.NoError(t, normalizeEnvironmentMetrics(soil))
+	soilJSON, err := json.Marshal(soil)
+	assert.NoError(t, err)
+	assert.NotContains(t, string(soilJSON), `"temperature"`)
+	assert.NotContains(t, string(soilJSON), `"humidity"`)
+
+	// 实测 0°C 仍写出温度字段
+	frozen := &EnvironmentRecord{ID: "env4", ProductID: "product1", Metrics: []SensorMetric{{Metric: "temperature", Value: 0}}}
+	assert.NoError(t, normalizeEnvironmentMetrics(frozen))
+	frozenJSON, err := json.Marshal(frozen)
+	assert.NoError(t, err)
+	assert.Contains(t, string(frozenJSON), `"temperature":0`)
+	assert.NotContains(t, string(frozenJSON), `"humidity"`)
+
+	var decoded EnvironmentRecord
+	assert.NoError(t, json.Unmarshal(frozenJSON, &decoded))
+	assert.Equal(t, frozen.Metrics, decoded.Metrics)
+
+	// 单位不符、超出物理范围、自定义指标缺少单位均视为无效数据
+	assert.Error(t, normalizeEnvironmentMetrics(&EnvironmentRecord{Metrics: []SensorMetric{{Metric: "temperature", Value: 80, Unit: "°F"}}}))
+	assert.Error(t, normalizeEnvironmentMetrics(&EnvironmentRecord{Metrics: []SensorMetric{{Metric: "soil_ph", Value: 15}}}))
+	assert.Error(t, normalizeEnvironmentMetrics(&EnvironmentRecord{Metrics: []SensorMetric{{Metric: "leaf_wetness", Value: 3}}}))
+
+	// 旧格式阈值转换为按指标阈值
+	threshold := &EnvironmentThreshold{MinTemperature: 10, MaxTemperature: 40, MinHumidity: 30, MaxHumidity: 90}
+	normalizeThreshold(threshold)
+	assert.Empty(t, checkEnvironmentThreshold(legacy, threshold))
+
+	threshold.Limits = append(threshold.Limits, MetricLimit{Metric: "soil_ph", Min: 5.5, Max: 7.5})
+	alerts := checkEnvironmentThreshold(record, threshold)
+	assert.Equal(t, 1, len(alerts))
+	assert.Equal(t, "soil_ph", alerts[0].Metric)
+}
+
+func TestDetectExcursions(t *testing.T) {
+	start := time.Date(2024, 6, 1, 8, 0, 0, 0, time.UTC)
+	temperatures := []float64{3, 5, 9, 12, 7, 4, 0, -1, 2, 10}
+	var readings []TemperatureReading
+	for i, temperature := range temperatures {
+		readings = append(readings, TemperatureReading{LoggerID: "logger1", Time: start.Add(time.Duration(i) * 10 * time.Minute), Temperature: temperature})
+	}
+
+	excursions := detectExcursions("logistics1", readings, 1, 8)
+	assert.Equal(t, 3, len(excursions))
+
+	// 高于上限：9、12，第5条读数恢复
+	assert.Equal(t, "ABOVE", excursions[0].Type)
+	assert.Equal(t, 12.0, excursions[0].PeakTemperature)
+	assert.Equal(t, 20.0, excursions[0].DurationMinutes)
+	assert.True(t, excursions[0].Resolved)
+
+	// 低于下限：0、-1
+	assert.Equal(t, "BELOW", excursions[1].Type)
+	assert.Equal(t, -1.0, excursions[1].PeakTemperature)
+
+	// 最后一条读数仍超限，尚未恢复
+	assert.Equal(t, "ABOVE", excursions[2].Type)
+	assert.False(t, excursions[2].Resolved)
+	assert.Equal(t, 0.0, excursions[2].DurationMinutes)
+}
+
+func TestEstimateShelfLife(t *testing.T) {
+	model := &ShelfLifeModel{Crop: "生菜", ReferenceTemp: 4, ReferenceShelfLifeHours: 240, Q10: 2, FlagThresholdHours: 48}
+	product := &Product{ID: "product1", Name: "生菜", HarvestDate: "2024-06-01"}
+	harvest := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+
+	// 收获后10小时按参考温度计算，随后在14°C下放置10小时，劣变速率为参考温度的2倍
+	readings := []TemperatureReading{{LoggerID: "logger1", Time: harvest.Add(10 * time.Hour), Temperature: 14}}
+	estimate, err := estimateShelfLife(product, model, readings, harvest.Add(20*time.Hour))
+	assert.NoError(t, err)
+	assert.InDelta(t, 30.0, estimate.ConsumedHours, 1e-9)
+	assert.InDelta(t, 105.0, estimate.RemainingHours, 1e-9)
+	assert.False(t, estimate.Flagged)
+
+	// 持续高温导致剩余保质期低于预警阈值
+	estimate, err = estimateShelfLife(product, model, readings, harvest.Add(100*time.Hour))
+	assert.NoError(t, err)
+	assert.InDelta(t, 25.0, estimate.RemainingHours, 1e-9)
+	assert.True(t, estimate.Flagged)
+}
+
+func TestShipmentTransitions(t *testing.T) {
+	assert.NoError(t, checkShipmentTransition("CREATED", "PICKED_UP"))
+	assert.NoError(t, checkShipmentTransition("IN_TRANSIT", "IN_TRANSIT"))
+	assert.NoError(t, checkShipmentTransition("OUT_FOR_DELIVERY", "DELIVERED"))
+	assert.NoError(t, checkShipmentTransition("AT_HUB", "LOST"))
+
+	assert.Error(t, checkShipmentTransition("CREATED", "DELIVERED"))
+	assert.Error(t, checkShipmentTransition("DELIVERED", "IN_TRANSIT"))
+	assert.Error(t, checkShipmentTransition("LOST", "LOST"))
+	assert.Error(t, checkShipmentTransition("IN_TRANSIT", "ARRIVED"))
+}
+
+func TestMassBalanceAndCarrierPerformance(t *testing.T) {
+	shipments := []*Shipment{
+		{ID: "SHIPMENT_1", CarrierID: "C1", Status: "DELIVERED", Items: []ShipmentItem{{ProductID: "P1", Quantity: 100}}},
+		{ID: "SHIPMENT_2", CarrierID: "C1", Status: "IN_TRANSIT", Items: []ShipmentItem{{ProductID: "P1", Quantity: 30}}},
+		{ID: "SHIPMENT_3", CarrierID: "C1", Status: "LOST", Items: []ShipmentItem{{ProductID: "P1", Quantity: 20}}},
+	}
+	transfers := []*LotTransfer{
+		{ID: "TRANSFER_SHIPMENT_1", ShipmentID: "SHIPMENT_1", Status: "ACCEPTED", Items: []TransferItem{{ProductID: "P1", Quantity: 100, AcceptedQuantity: 90}}},
+	}
+	claims := []*ShipmentClaim{
+		{ID: "CLAIM_1", ShipmentID: "SHIPMENT_1", Items: []ClaimItem{{ProductID: "P1", Quantity: 10}}, Status: "SETTLED", Outcome: "COMPENSATED", SettledAmount: 50},
+		{ID: "CLAIM_2", ShipmentID: "SHIPMENT_3", Items: []ClaimItem{{ProductID: "P1", Quantity: 20}}, Status: "SETTLED", Outcome: "DENIED"},
+	}
+
+	balance := massBalance("P1", shipments, transfers, claims)
+	assert.Equal(t, 150, balance.Shipped)
+	assert.Equal(t, 30, balance.InTransit)
+	assert.Equal(t, 90, balance.Received)
+	assert.Equal(t, 10, balance.Lost)
+	// 丢失运输单的索赔被驳回，数量仍未解释
+	assert.Equal(t, 20, balance.Unaccounted)
+
+	performance := carrierPerformance("C1", shipments, claims)
+	assert.Equal(t, 3, performance.Shipments)
+	assert.Equal(t, 1, performance.Lost)
+	assert.Equal(t, 2, performance.Claims)
+	assert.Equal(t, 10, performance.LostQuantity)
+	assert.InDelta(t, 10.0/150.0, performance.LossRate, 1e-9)
+	assert.Equal(t, 50.0, performance.SettledAmount)
+}
+
+func TestEvaluateShipmentRoute(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	route := []Waypoint{{Name: "A", Latitude: 30, Longitude: 120}, {Name: "B", Latitude: 31, Longitude: 120}}
+
+	// 经线方向1度约111公里
+	assert.InDelta(t, 111.2, haversineKm(30, 120, 31, 120), 0.5)
+	assert.InDelta(t, 0, distanceToRouteKm(30.5, 120, route), 0.01)
+	assert.InDelta(t, 48.2, distanceToRouteKm(30.5, 120.5, route), 0.5)
+
+	shipment := &Shipment{
+		Status:       "IN_TRANSIT",
+		PlannedRoute: route,
+		ETA:          now.Add(-time.Hour),
+		Checkpoints: []Checkpoint{
+			{Latitude: 30, Longitude: 120, Located: true},
+			{Location: "无坐标节点"},
+			{Latitude: 30.5, Longitude: 120.5, Located: true},
+		},
+	}
+	evaluateShipmentRoute(shipment, now)
+	assert.InDelta(t, haversineKm(30, 120, 30.5, 120.5), shipment.DistanceKm, 1e-9)
+	assert.True(t, shipment.Deviated)
+	assert.True(t, shipment.Delayed)
+
+	shipment.MaxDeviationKm = 60
+	shipment.Status = "DELIVERED"
+	shipment.UpdatedAt = now.Add(-2 * time.Hour)
+	evaluateShipmentRoute(shipment, now)
+	assert.False(t, shipment.Deviated)
+	assert.False(t, shipment.Delayed)
+}
+
+func TestWarehouseStays(t *testing.T) {
+	start := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	movements := []*WarehouseMovement{
+		{WarehouseID: "WAREHOUSE_A", ProductID: "P1", Direction: "INBOUND", Quantity: 100, Balance: 100, RecordTime: start},
+		{WarehouseID: "WAREHOUSE_A", ProductID: "P1", Direction: "OUTBOUND", Quantity: 40, Balance: 60, RecordTime: start.Add(24 * time.Hour)},
+		{WarehouseID: "WAREHOUSE_B", ProductID: "P1", Direction: "INBOUND", Quantity: 40, Balance: 40, RecordTime: start.Add(30 * time.Hour)},
+		{WarehouseID: "WAREHOUSE_A", ProductID: "P1", Direction: "OUTBOUND", Quantity: 60, Balance: 0, RecordTime: start.Add(48 * time.Hour)},
+	}
+
+	stays := warehouseStays(movements, start.Add(60*time.Hour))
+	assert.Len(t, stays, 2)
+
+	assert.Equal(t, "WAREHOUSE_A", stays[0].WarehouseID)
+	assert.False(t, stays[0].InStorage)
+	assert.Equal(t, 100, stays[0].OutQuantity)
+	assert.Equal(t, 48.0, stays[0].DurationHours)
+
+	// 仍在库的停留计算到当前时间
+	assert.True(t, stays[1].InStorage)
+	assert.Equal(t, 30.0, stays[1].DurationHours)
+}
+
+func TestStockMovements(t *testing.T) {
+	assert.NoError(t, checkStockMovement(&StockMovement{Type: "RECEIPT", Quantity: 10}))
+	assert.NoError(t, checkStockMovement(&StockMovement{Type: "ADJUSTMENT", Quantity: -3}))
+	assert.NoError(t, checkStockMovement(&StockMovement{Type: "WRITE_OFF", Quantity: -2}))
+	assert.Error(t, checkStockMovement(&StockMovement{Type: "SALE", Quantity: 5}))
+	assert.Error(t, checkStockMovement(&StockMovement{Type: "RETURN", Quantity: 0}))
+	assert.Error(t, checkStockMovement(&StockMovement{Type: "LOSS", Quantity: -1}))
+
+	movements := []*StockMovement{
+		{Type: "RECEIPT", Quantity: 100},
+		{Type: "SALE", Quantity: -30},
+		{Type: "RETURN", Quantity: 2},
+		{Type: "WRITE_OFF", Quantity: -5},
+	}
+	assert.Equal(t, 67, stockBalance(movements))
+}
+
+func TestDefaultInventoryID(t *testing.T) {
+	assert.Equal(t, "INV_R1_P1", defaultInventoryID("RETAILER_R1", "", "P1", ""))
+	assert.Equal(t, "INV_R1_P1_L2", defaultInventoryID("RETAILER_R1", "", "P1", "L2"))
+	assert.Equal(t, "INV_R1_S1_P1_L2", defaultInventoryID("RETAILER_R1", "S1", "P1", "L2"))
+}
+
+func TestAvailableToSell(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	reservations := []*StockReservation{
+		{ID: "RESERVE_1", Quantity: 10, Status: "ACTIVE", ExpiresAt: now.Add(time.Hour)},
+		{ID: "RESERVE_2", Quantity: 5, Status: "ACTIVE", ExpiresAt: now.Add(-time.Minute)},
+		{ID: "RESERVE_3", Quantity: 7, Status: "RELEASED", ExpiresAt: now.Add(time.Hour)},
+		{ID: "RESERVE_4", Quantity: 3, Status: "ACTIVE", ExpiresAt: now.Add(time.Hour)},
+	}
+
+	// 过期和已释放的预留不占用库存
+	assert.Equal(t, 37, availableToSell(50, reservations, "", now))
+	// 按预留成交时该预留的数量可售
+	assert.Equal(t, 47, availableToSell(50, reservations, "RESERVE_1", now))
+}
+
+func TestUpdateLowStockState(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	inventory := &RetailInventory{Quantity: 5, MinQuantity: 10}
+
+	updateLowStockState(inventory, now)
+	assert.True(t, inventory.LowStock)
+	assert.Equal(t, now, inventory.LowStockSince)
+
+	// 持续低库存时保留首次预警时间
+	inventory.Quantity = 3
+	updateLowStockState(inventory, now.Add(time.Hour))
+	assert.Equal(t, now, inventory.LowStockSince)
+
+	inventory.Quantity = 20
+	updateLowStockState(inventory, now.Add(2*time.Hour))
+	assert.False(t, inventory.LowStock)
+	assert.True(t, inventory.LowStockSince.IsZero())
+}
+
+func TestShrinkageReport(t *testing.T) {
+	may := time.Date(2024, 5, 20, 0, 0, 0, 0, time.UTC)
+	june := time.Date(2024, 6, 3, 0, 0, 0, 0, time.UTC)
+	movements := []*StockMovement{
+		{ProductID: "P2", Type: "ADJUSTMENT", Quantity: -4, ReasonCode: "THEFT", RecordTime: june},
+		{ProductID: "P1", Type: "ADJUSTMENT", Quantity: -3, ReasonCode: "SPOILAGE", RecordTime: may},
+		{ProductID: "P1", Type: "WRITE_OFF", Quantity: -2, ReasonCode: "DAMAGE", RecordTime: may},
+		{ProductID: "P1", Type: "ADJUSTMENT", Quantity: -1, ReasonCode: "SPOILAGE", RecordTime: june},
+		// 盘点误差和盘盈不计入损耗
+		{ProductID: "P1", Type: "ADJUSTMENT", Quantity: -5, ReasonCode: "COUNT_ERROR", RecordTime: june},
+		{ProductID: "P1", Type: "ADJUSTMENT", Quantity: 2, ReasonCode: "OTHER", RecordTime: june},
+		{ProductID: "P1", Type: "SALE", Quantity: -10, RecordTime: june},
+	}
+
+	report := shrinkageReport(movements)
+	assert.Len(t, report, 3)
+	assert.Equal(t, "P1", report[0].ProductID)
+	assert.Equal(t, "2024-05", report[0].Period)
+	assert.Equal(t, 5, report[0].Quantity)
+	assert.Equal(t, map[string]int{"SPOILAGE": 3, "DAMAGE": 2}, report[0].ByReason)
+	assert.Equal(t, 1, report[1].Quantity)
+	assert.Equal(t, "P2", report[2].ProductID)
+
+	assert.Error(t, checkAdjustmentReason("THEFT", 3))
+	assert.NoError(t, checkAdjustmentReason("COUNT_ERROR", 3))
+	assert.Error(t, checkAdjustmentReason("LOST", -1))
+}
+
+func TestAllocateFEFO(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	lines := []stockLine{
+		{inventory: &RetailInventory{ID: "INV_C", LotID: "L3"}, available: 10},
+		{inventory: &RetailInventory{ID: "INV_B", LotID: "L2", ExpiryDate: now.AddDate(0, 0, 5)}, available: 4},
+		{inventory: &RetailInventory{ID: "INV_A", LotID: "L1", ExpiryDate: now.AddDate(0, 0, 2)}, available: 3},
+		// 已到期的批次不参与分配
+		{inventory: &RetailInventory{ID: "INV_X", LotID: "L0", ExpiryDate: now}, available: 8},
+	}
+
+	allocations, err := allocateFEFO(lines, 9, now)
+	assert.NoError(t, err)
+	assert.Len(t, allocations, 3)
+	assert.Equal(t, "INV_A", allocations[0].InventoryID)
+	assert.Equal(t, 3, allocations[0].Quantity)
+	assert.Equal(t, "INV_B", allocations[1].InventoryID)
+	assert.Equal(t, 4, allocations[1].Quantity)
+	assert.Equal(t, "INV_C", allocations[2].InventoryID)
+	assert.Equal(t, 2, allocations[2].Quantity)
+
+	_, err = allocateFEFO(lines, 18, now)
+	assert.Error(t, err)
+}
+
+func TestProcessExpirationsHelpers(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	assert.True(t, priceEnded(&PriceRecord{Status: "ACTIVE", EndTime: now}, now))
+	assert.False(t, priceEnded(&PriceRecord{Status: "ACTIVE"}, now))
+	assert.False(t, priceEnded(&PriceRecord{Status: "INACTIVE", EndTime: now.Add(-time.Hour)}, now))
+
+	products := []*Product{
+		{ID: "P1", Status: "ON_SALE"},
+		{ID: "P2", Status: "ON_SALE"},
+		// 没有零售库存记录的产品不标记售罄
+		{ID: "P3", Status: "ON_SALE"},
+		{ID: "P4", Status: "SOLD_OUT"},
+	}
+	inventories := []*RetailInventory{
+		{ProductID: "P1", Quantity: 0},
+		{ProductID: "P1", Quantity: 0},
+		{ProductID: "P2", Quantity: 0},
+		{ProductID: "P2", Quantity: 5},
+		{ProductID: "P4", Quantity: 0},
+	}
+
+	soldOut := soldOutProducts(products, inventories)
+	assert.Len(t, soldOut, 1)
+	assert.Equal(t, "P1", soldOut[0].ID)
+}
+
+func TestProcessExpirationsIdempotent(t *testing.T) {
+	ctx, stub := newMemoryContext()
+	contract := new(AgriTrace)
+
+	assert.NoError(t, stub.commit(contract.CreateProduct(ctx, `{"id":"P1","name":"番茄","farmerId":"F1"}`)))
+	assert.NoError(t, stub.commit(contract.CreateProduct(ctx, `{"id":"P2","name":"黄瓜","farmerId":"F1"}`)))
+	assert.NoError(t, stub.commit(contract.RegisterRetailer(ctx, `{"id":"R1","name":"生鲜超市"}`)))
+	assert.NoError(t, stub.commit(contract.AddRetailInventory(ctx, `{"retailerId":"RETAILER_R1","productId":"P1","lotId":"L1","quantity":10,"expiryDate":"2000-01-01T00:00:00Z"}`)))
+	assert.NoError(t, stub.commit(contract.AddRetailInventory(ctx, `{"retailerId":"RETAILER_R1","productId":"P2","lotId":"L2","quantity":10,"expiryDate":"2099-01-01T00:00:00Z"}`)))
+	assert.NoError(t, stub.commit(contract.UpdateProductStatus(ctx, "P1", "ON_SALE")))
+	assert.NoError(t, stub.commit(contract.SetProductPrice(ctx, `{"id":"PRICE_1","productId":"P2","retailerId":"RETAILER_R1","price":3,"endTime":"2000-01-01T00:00:00Z"}`)))
+
+	// 预留创建后将过期时间改到过去
+	assert.NoError(t, stub.commit(contract.ReserveStock(ctx, `{"id":"RS1","retailerId":"RETAILER_R1","productId":"P2","lotId":"L2","consumerId":"C1","quantity":2}`)))
+	var reservation StockReservation
+	assert.NoError(t, json.Unmarshal(stub.state["RESERVE_RS1"], &reservation))
+	reservation.ExpiresAt = time.Now().Add(-time.Minute)
+	reservationJSON, err := json.Marshal(reservation)
+	assert.NoError(t, err)
+	stub.state["RESERVE_RS1"] = reservationJSON
+
+	report, err := contract.ProcessExpirations(ctx)
+	assert.NoError(t, stub.commit(err))
+	assert.Len(t, report.WrittenOff, 1)
+	assert.Equal(t, []string{"RESERVE_RS1"}, report.ExpiredReservations)
+	assert.Equal(t, []string{"PRICE_1"}, report.ClosedPrices)
+	assert.Equal(t, []string{"P1"}, report.SoldOutProducts)
+
+	// 已处理的记录不再命中，第二次调用没有任何变更
+	report, err = contract.ProcessExpirations(ctx)
+	assert.NoError(t, stub.commit(err))
+	assert.Empty(t, report.WrittenOff)
+	assert.Empty(t, report.ExpiredReservations)
+	assert.Empty(t, report.ClosedPrices)
+	assert.Empty(t, report.SoldOutProducts)
+}
+
+// registerLabSample 登记样品并移交实验室，得到保管链完整的样品
+func registerLabSample(t *testing.T, ctx *memoryContext, stub *memoryStub, sampleID string, productID string) {
+	contract := new(AgriTrace)
+	assert.NoError(t, stub.commit(contract.RegisterSample(ctx, fmt.Sprintf(`{"id":%q,"productId":%q,"samplerId":"SAMPLER1","sealNumber":"SEAL_%s","sampleSize":1}`, sampleID, productID, sampleID))))
+	assert.NoError(t, stub.commit(contract.TransferSampleCustody(ctx, "SAMPLE_"+sampleID, "SAMPLER1", "LAB1", "SEAL_"+sampleID, true)))
+}
+
+func TestQualityAppealWorkflow(t *testing.T) {
+	ctx, stub := newMemoryContext()
+	contract := new(AgriTrace)
+
+	assert.NoError(t, stub.commit(contract.CreateProduct(ctx, `{"id":"P1","farmerId":"F1"}`)))
+	assert.NoError(t, stub.commit(contract.RegisterInspector(ctx, `{"id":"I1"}`)))
+	assert.NoError(t, stub.commit(contract.RegisterInspector(ctx, `{"id":"I2"}`)))
+	registerLabSample(t, ctx, stub, "S1", "P1")
+	registerLabSample(t, ctx, stub, "S2", "P1")
+
+	// 不合格检测记录冻结产品
+	assert.NoError(t, stub.commit(contract.AddQualityRecord(ctx, `{"id":"Q1","productId":"P1","stage":"HARVESTING","testType":"农残","isQualified":false,"inspectorId":"I1","sampleId":"SAMPLE_S1"}`)))
+	product, err := contract.QueryProduct(ctx, "P1")
+	assert.NoError(t, err)
+	assert.True(t, product.QualityHold)
+
+	// 只有产品所属农户可以申诉，同一记录只能有一个未决申诉
+	assert.Error(t, stub.commit(contract.OpenAppeal(ctx, `{"id":"A0","originalRecordId":"Q1","farmerId":"F2"}`)))
+	assert.NoError(t, stub.commit(contract.OpenAppeal(ctx, `{"id":"A1","originalRecordId":"Q1","farmerId":"F1","reason":"采样不规范"}`)))
+	assert.Error(t, stub.commit(contract.OpenAppeal(ctx, `{"id":"A2","originalRecordId":"Q1","farmerId":"F1"}`)))
+
+	appeal, err := contract.QueryQualityAppeal(ctx, "APPEAL_A1")
+	assert.NoError(t, err)
+	assert.Equal(t, "OPEN", appeal.Status)
+	product, _ = contract.QueryProduct(ctx, "P1")
+	assert.Equal(t, "质量申诉处理中: APPEAL_A1", product.QualityHoldReason)
+
+	// 未指派复检不能裁决，复检员不能是原检测员
+	assert.Error(t, stub.commit(contract.ResolveAppeal(ctx, "APPEAL_A1", "Q2", "")))
+	assert.Error(t, stub.commit(contract.AssignReinspection(ctx, "APPEAL_A1", "I1")))
+	assert.NoError(t, stub.commit(contract.AssignReinspection(ctx, "APPEAL_A1", "I2")))
+
+	// 复检记录须由指定复检员录入
+	assert.Error(t, stub.commit(contract.AddQualityRecord(ctx, `{"id":"Q2","productId":"P1","stage":"HARVESTING","testType":"农残","isQualified":true,"inspectorId":"I1","appealId":"APPEAL_A1","sampleId":"SAMPLE_S2"}`)))
+	assert.NoError(t, stub.commit(contract.AddQualityRecord(ctx, `{"id":"Q2","productId":"P1","stage":"HARVESTING","testType":"农残","isQualified":true,"inspectorId":"I2","appealId":"APPEAL_A1","sampleId":"SAMPLE_S2"}`)))
+
+	// 复检合格改判，原记录被取代，解除冻结
+	assert.NoError(t, stub.commit(contract.ResolveAppeal(ctx, "APPEAL_A1", "Q2", "复检合格")))
+	appeal, _ = contract.QueryQualityAppeal(ctx, "APPEAL_A1")
+	assert.Equal(t, "RESOLVED", appeal.Status)
+	assert.Equal(t, "OVERTURNED", appeal.Decision)
+	original, err := contract.QueryQualityRecord(ctx, "Q1")
+	assert.NoError(t, err)
+	assert.Equal(t, "Q2", original.SupersededBy)
+	product, _ = contract.QueryProduct(ctx, "P1")
+	assert.False(t, product.QualityHold)
+	assert.Empty(t, product.QualityHoldReason)
+
+	// 已裁决的申诉不能再次裁决
+	assert.Error(t, stub.commit(contract.ResolveAppeal(ctx, "APPEAL_A1", "Q2", "")))
+}
+
+func TestQualityAppealUpheld(t *testing.T) {
+	ctx, stub := newMemoryContext()
+	contract := new(AgriTrace)
+
+	assert.NoError(t, stub.commit(contract.CreateProduct(ctx, `{"id":"P1","farmerId":"F1"}`)))
+	assert.NoError(t, stub.commit(contract.RegisterInspector(ctx, `{"id":"I1"}`)))
+	assert.NoError(t, stub.commit(contract.RegisterInspector(ctx, `{"id":"I2"}`)))
+	registerLabSample(t, ctx, stub, "S1", "P1")
+	registerLabSample(t, ctx, stub, "S2", "P1")
+
+	assert.NoError(t, stub.commit(contract.AddQualityRecord(ctx, `{"id":"Q1","productId":"P1","stage":"HARVESTING","testType":"农残","isQualified":false,"inspectorId":"I1","sampleId":"SAMPLE_S1"}`)))
+	assert.NoError(t, stub.commit(contract.OpenAppeal(ctx, `{"id":"A1","originalRecordId":"Q1","farmerId":"F1"}`)))
+	assert.NoError(t, stub.commit(contract.AssignReinspection(ctx, "APPEAL_A1", "I2")))
+	assert.NoError(t, stub.commit(contract.AddQualityRecord(ctx, `{"id":"Q2","productId":"P1","stage":"HARVESTING","testType":"农残","isQualified":false,"inspectorId":"I2","appealId":"APPEAL_A1","sampleId":"SAMPLE_S2"}`)))
+	assert.NoError(t, stub.commit(contract.ResolveAppeal(ctx, "APPEAL_A1", "Q2", "复检仍不合格")))
+
+	appeal, _ := contract.QueryQualityAppeal(ctx, "APPEAL_A1")
+	assert.Equal(t, "UPHELD", appeal.Decision)
+
+	// 维持原判后仍冻结，原记录未被改判取代
+	product, _ := contract.QueryProduct(ctx, "P1")
+	assert.True(t, product.QualityHold)
+	original, _ := contract.QueryQualityRecord(ctx, "Q1")
+	assert.Empty(t, original.SupersededBy)
+}
+
+func TestCheckCustodyChain(t *testing.T) {
+	sample := &Sample{
+		ID:        "SAMPLE_S1",
+		SamplerID: "SAMPLER1",
+		LabID:     "LAB1",
+		Status:    "RECEIVED_BY_LAB",
+		Custody: []CustodyTransfer{
+			{FromID: "SAMPLER1", ToID: "COURIER1", SealIntact: true},
+			{FromID: "COURIER1", ToID: "LAB1", SealIntact: true, ToLab: true},
+		},
+	}
+	assert.NoError(t, checkCustodyChain(sample))
+
+	// 交接链断开
+	broken := *sample
+	broken.Custody = []CustodyTransfer{
+		{FromID: "SAMPLER1", ToID: "COURIER1", SealIntact: true},
+		{FromID: "COURIER2", ToID: "LAB1", SealIntact: true, ToLab: true},
+	}
+	assert.Error(t, checkCustodyChain(&broken))
+
+	// 封条异常
+	unsealed := *sample
+	unsealed.Custody = []CustodyTransfer{
+		{FromID: "SAMPLER1", ToID: "LAB1", SealIntact: false, ToLab: true},
+	}
+	assert.Error(t, checkCustodyChain(&unsealed))
+
+	// 未由实验室接收
+	pending := *sample
+	pending.Status = "IN_CUSTODY"
+	assert.Error(t, checkCustodyChain(&pending))
+
+	// 最后一次交接不是移交给登记的实验室
+	wrongLab := *sample
+	wrongLab.LabID = "LAB2"
+	assert.Error(t, checkCustodyChain(&wrongLab))
+}
+
+func TestQualityRecordRequiresSampleCustody(t *testing.T) {
+	ctx, stub := newMemoryContext()
+	contract := new(AgriTrace)
+
+	assert.NoError(t, stub.commit(contract.CreateProduct(ctx, `{"id":"P1","farmerId":"F1"}`)))
+	assert.NoError(t, stub.commit(contract.CreateProduct(ctx, `{"id":"P2","farmerId":"F1"}`)))
+	assert.NoError(t, stub.commit(contract.RegisterSample(ctx, `{"id":"S1","productId":"P1","samplerId":"SAMPLER1","sealNumber":"SEAL1","sampleSize":1}`)))
+
+	record := `{"id":"Q1","productId":"P1","stage":"HARVESTING","testType":"农残","isQualified":true,"inspectorId":"I1","sampleId":"S1"}`
+
+	// 样品尚未移交实验室
+	assert.Error(t, stub.commit(contract.AddQualityRecord(ctx, record)))
+	assert.NoError(t, stub.commit(contract.TransferSampleCustody(ctx, "SAMPLE_S1", "SAMPLER1", "COURIER1", "SEAL1", false)))
+	assert.Error(t, stub.commit(contract.AddQualityRecord(ctx, record)))
+
+	// 非当前保管人不能移交
+	assert.Error(t, stub.commit(contract.TransferSampleCustody(ctx, "SAMPLE_S1", "SAMPLER1", "LAB1", "SEAL1", true)))
+	assert.NoError(t, stub.commit(contract.TransferSampleCustody(ctx, "SAMPLE_S1", "COURIER1", "LAB1", "SEAL1", true)))
+
+	// 样品须属于同一产品，样品ID未带前缀时自动补齐
+	assert.Error(t, stub.commit(contract.AddQualityRecord(ctx, `{"id":"Q0","productId":"P2","stage":"HARVESTING","testType":"农残","isQualified":true,"inspectorId":"I1","sampleId":"S1"}`)))
+	assert.NoError(t, stub.commit(contract.AddQualityRecord(ctx, record)))
+	saved, err := contract.QueryQualityRecord(ctx, "Q1")
+	assert.NoError(t, err)
+	assert.Equal(t, "SAMPLE_S1", saved.SampleID)
+
+	// 封条编号不符的样品不能用于检测
+	assert.NoError(t, stub.commit(contract.RegisterSample(ctx, `{"id":"S2","productId":"P1","samplerId":"SAMPLER1","sealNumber":"SEAL2","sampleSize":1}`)))
+	assert.NoError(t, stub.commit(contract.TransferSampleCustody(ctx, "SAMPLE_S2", "SAMPLER1", "LAB1", "SEAL9", true)))
+	sample, err := contract.QuerySample(ctx, "SAMPLE_S2")
+	assert.NoError(t, err)
+	assert.Equal(t, "COMPROMISED", sample.Status)
+	assert.Error(t, stub.commit(contract.AddQualityRecord(ctx, `{"id":"Q2","productId":"P1","stage":"HARVESTING","testType":"农残","isQualified":true,"inspectorId":"I1","sampleId":"S2"}`)))
+}
+
+func TestNormalizeThreshold(t *testing.T) {
+	// 旧格式只设置温度时不生成湿度阈值
+	legacy := &EnvironmentThreshold{MinTemperature: 10, MaxTemperature: 30}
+	normalizeThreshold(legacy)
+	assert.Equal(t, []MetricLimit{{Metric: "temperature", Min: 10, Max: 30}}, legacy.Limits)
+
+	record := &EnvironmentRecord{Metrics: []SensorMetric{
+		{Metric: "temperature", Value: 25, Unit: "°C"},
+		{Metric: "humidity", Value: 60, Unit: "%"},
+	}}
+	assert.Empty(t, checkEnvironmentThreshold(record, legacy))
+
+	record.Metrics[0].Value = 35
+	alerts := checkEnvironmentThreshold(record, legacy)
+	assert.Len(t, alerts, 1)
+	assert.Equal(t, "temperature", alerts[0].Metric)
+
+	// 按指标阈值回填温度、湿度字段
+	threshold := &EnvironmentThreshold{Limits: []MetricLimit{
+		{Metric: "humidity", Min: 40, Max: 80},
+		{Metric: "soil_ph", Min: 5.5, Max: 7.5},
+	}}
+	normalizeThreshold(threshold)
+	assert.Equal(t, 40.0, threshold.MinHumidity)
+	assert.Equal(t, 80.0, threshold.MaxHumidity)
+	assert.Len(t, threshold.Limits, 2)
+
+	empty := &EnvironmentThreshold{}
+	normalizeThreshold(empty)
+	assert.Empty(t, empty.Limits)
+}
+
+func TestSetEnvironmentThreshold(t *testing.T) {
+	ctx, stub := newMemoryContext()
+	contract := new(AgriTrace)
+
+	assert.Error(t, stub.commit(contract.SetEnvironmentThreshold(ctx, `{"crop":"番茄"}`)))
+	assert.Error(t, stub.commit(contract.SetEnvironmentThreshold(ctx, `{"crop":"番茄","limits":[{"metric":"soil_ph","min":8,"max":6}]}`)))
+	assert.NoError(t, stub.commit(contract.SetEnvironmentThreshold(ctx, `{"crop":"番茄","minHumidity":40,"maxHumidity":85}`)))
+
+	threshold, err := contract.QueryEnvironmentThreshold(ctx, thresholdKey("番茄", ""))
+	assert.NoError(t, err)
+	assert.Equal(t, []MetricLimit{{Metric: "humidity", Min: 40, Max: 85}}, threshold.Limits)
+}
+
+// registerTestDevice 生成 Ed25519 密钥并登记分配到产品的设备
+func registerTestDevice(t *testing.T, ctx *memoryContext, stub *memoryStub, deviceID string, productID string) ed25519.PrivateKey {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	device := fmt.Sprintf(`{"id":%q,"ownerId":"F1","productId":%q,"publicKey":%q}`, deviceID, productID, base64.StdEncoding.EncodeToString(public))
+	assert.NoError(t, stub.commit(new(AgriTrace).RegisterDevice(ctx, device)))
+	return private
+}
+
+// signedReading 生成设备签名的环境读数
+func signedReading(t *testing.T, private ed25519.PrivateKey, id string, recordTime time.Time, metrics ...SensorMetric) EnvironmentRecord {
+	record := EnvironmentRecord{ID: id, ProductID: "P1", DeviceID: "DEVICE_D1", RecordTime: recordTime, Metrics: metrics}
+	payload, err := environmentReadingPayload(&record)
+	assert.NoError(t, err)
+	record.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(private, payload))
+	return record
+}
+
+func TestAddEnvironmentBatch(t *testing.T) {
+	ctx, stub := newMemoryContext()
+	contract := new(AgriTrace)
+
+	assert.NoError(t, stub.commit(contract.CreateProduct(ctx, `{"id":"P1","name":"番茄","farmerId":"F1"}`)))
+	private := registerTestDevice(t, ctx, stub, "D1", "P1")
+
+	hour := time.Now().UTC().Truncate(time.Hour).Add(-3 * time.Hour)
+	normal := SensorMetric{Metric: "temperature", Value: 22, Unit: "°C"}
+	hot := SensorMetric{Metric: "temperature", Value: 40, Unit: "°C"}
+
+	tampered := signedReading(t, private, "R3", hour.Add(10*time.Minute), normal)
+	tampered.Metrics = []SensorMetric{hot}
+	batch, err := json.Marshal(EnvironmentBatch{BatchID: "B1", Readings: []EnvironmentRecord{
+		signedReading(t, private, "R1", hour.Add(5*time.Minute), normal),
+		signedReading(t, private, "R2", hour.Add(65*time.Minute), hot),
+		signedReading(t, private, "R1", hour.Add(5*time.Minute), normal),
+		tampered,
+	}})
+	assert.NoError(t, err)
+
+	result, err := contract.AddEnvironmentBatch(ctx, string(batch))
+	assert.NoError(t, stub.commit(err))
+	assert.Equal(t, 2, result.Accepted)
+	assert.Equal(t, 2, result.Rejected)
+	assert.Equal(t, 1, result.Alerts)
+	assert.Contains(t, result.Results[2].Error, "读数已存在")
+	assert.False(t, result.Results[3].Accepted)
+	assert.Equal(t, []string{"EnvironmentBatchAlert"}, stub.events)
+
+	// 后续批次重放已写入的签名读数，在原数据桶内查出重复，不另建索引键
+	batch, err = json.Marshal(EnvironmentBatch{BatchID: "B2", Readings: []EnvironmentRecord{
+		signedReading(t, private, "R2", hour.Add(65*time.Minute), hot),
+	}})
+	assert.NoError(t, err)
+	result, err = contract.AddEnvironmentBatch(ctx, string(batch))
+	assert.NoError(t, stub.commit(err))
+	assert.Equal(t, 0, result.Accepted)
+	assert.Contains(t, result.Results[0].Error, "读数已存在")
+	for key := range stub.state {
+		assert.False(t, strings.HasPrefix(key, "\x00"), "unexpected index key %q", key)
+	}
+
+	// 单条上报同一读数同样被拒绝
+	replayed, err := json.Marshal(signedReading(t, private, "R1", hour.Add(5*time.Minute), normal))
+	assert.NoError(t, err)
+	assert.Error(t, stub.commit(contract.AddEnvironmentRecord(ctx, string(replayed))))
+
+	records, err := contract.QueryEnvironmentRecords(ctx, "P1")
+	assert.NoError(t, err)
+	assert.Len(t, records, 2)
+}
+
+func TestVerifySignature(t *testing.T) {
+	message := []byte("reading payload")
+	changed := []byte("reading payload!")
+
+	// Ed25519：PEM 公钥与 Base64 原始公钥
+	edPublic, edPrivate, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	edDER, err := x509.MarshalPKIXPublicKey(edPublic)
+	assert.NoError(t, err)
+	edPEM := string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: edDER}))
+	edRaw := base64.StdEncoding.EncodeToString(edPublic)
+	edSignature := base64.StdEncoding.EncodeToString(ed25519.Sign(edPrivate, message))
+
+	for _, key := range []string{edPEM, edRaw} {
+		parsed, err := parsePublicKey(key)
+		assert.NoError(t, err)
+		assert.IsType(t, ed25519.PublicKey{}, parsed)
+		assert.NoError(t, verifySignature(key, message, edSignature))
+		assert.Error(t, verifySignature(key, changed, edSignature))
+	}
+
+	// ECDSA P-256：对 SHA-256 摘要的 ASN.1 签名
+	ecPrivate, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	ecDER, err := x509.MarshalPKIXPublicKey(&ecPrivate.PublicKey)
+	assert.NoError(t, err)
+	ecPEM := string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: ecDER}))
+	digest := sha256.Sum256(message)
+	ecSignature, err := ecdsa.SignASN1(rand.Reader, ecPrivate, digest[:])
+	assert.NoError(t, err)
+	assert.NoError(t, verifySignature(ecPEM, message, base64.StdEncoding.EncodeToString(ecSignature)))
+	assert.Error(t, verifySignature(ecPEM, changed, base64.StdEncoding.EncodeToString(ecSignature)))
+
+	// 签名与公钥不匹配、签名不是 Base64
+	assert.Error(t, verifySignature(ecPEM, message, edSignature))
+	assert.Error(t, verifySignature(edPEM, message, base64.StdEncoding.EncodeToString(ecSignature)))
+	assert.Error(t, verifySignature(edRaw, message, "not base64!"))
+
+	// 无效公钥：长度错误、非 Base64、PEM 内容损坏、不支持的算法
+	_, err = parsePublicKey(base64.StdEncoding.EncodeToString([]byte("short")))
+	assert.Error(t, err)
+	_, err = parsePublicKey("not a key")
+	assert.Error(t, err)
+	_, err = parsePublicKey(string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: []byte("garbage")})))
+	assert.Error(t, err)
+	rsaPrivate, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	rsaDER, err := x509.MarshalPKIXPublicKey(&rsaPrivate.PublicKey)
+	assert.NoError(t, err)
+	_, err = parsePublicKey(string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: rsaDER})))
+	assert.Error(t, err)
+}
+
+func TestAddEnvironmentRecordSignature(t *testing.T) {
+	ctx, stub := newMemoryContext()
+	contract := new(AgriTrace)
+
+	assert.NoError(t, stub.commit(contract.CreateProduct(ctx, `{"id":"P1","name":"番茄","farmerId":"F1"}`)))
+	private := registerTestDevice(t, ctx, stub, "D1", "P1")
+
+	// 设备按原始读数签名，内置指标的单位由链码补全
+	recordTime := time.Now().Add(-time.Hour)
+	reading := signedReading(t, private, "R1", recordTime, SensorMetric{Metric: "temperature", Value: 18.5})
+	readingJSON, err := json.Marshal(reading)
+	assert.NoError(t, err)
+	assert.NoError(t, stub.commit(contract.AddEnvironmentRecord(ctx, string(readingJSON))))
+
+	records, err := contract.QueryEnvironmentRecords(ctx, "P1")
+	assert.NoError(t, err)
+	assert.Len(t, records, 1)
+	assert.Equal(t, "°C", records[0].Metrics[0].Unit)
+
+	// 重放同一读数被拒绝，批量上报同一ID同样被拒绝
+	assert.ErrorContains(t, stub.commit(contract.AddEnvironmentRecord(ctx, string(readingJSON))), "环境记录已存在")
+	batch, err := json.Marshal(EnvironmentBatch{BatchID: "B1", Readings: []EnvironmentRecord{reading}})
+	assert.NoError(t, err)
+	result, err := contract.AddEnvironmentBatch(ctx, string(batch))
+	assert.NoError(t, stub.commit(err))
+	assert.Equal(t, 0, result.Accepted)
+
+	// 篡改读数后签名失效
+	tampered := signedReading(t, private, "R2", recordTime, SensorMetric{Metric: "temperature", Value: 18.5})
+	tampered.Metrics[0].Value = 4
+	tamperedJSON, err := json.Marshal(tampered)
+	assert.NoError(t, err)
+	assert.Error(t, stub.commit(contract.AddEnvironmentRecord(ctx, string(tamperedJSON))))
+
+	// 旧格式读数按温度、湿度字段签名
+	legacy := EnvironmentRecord{ID: "R3", ProductID: "P1", DeviceID: "DEVICE_D1", RecordTime: recordTime, Temperature: 20, Humidity: 55}
+	payload, err := environmentReadingPayload(&legacy)
+	assert.NoError(t, err)
+	legacy.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(private, payload))
+	legacyJSON, err := json.Marshal(legacy)
+	assert.NoError(t, err)
+	assert.NoError(t, stub.commit(contract.AddEnvironmentRecord(ctx, string(legacyJSON))))
+
+	// 不带DEVICE_前缀的设备ID由链码补全后再校验签名
+	unprefixed := signedReading(t, private, "R4", recordTime, SensorMetric{Metric: "temperature", Value: 19})
+	unprefixed.DeviceID = "D1"
+	unprefixedJSON, err := json.Marshal(unprefixed)
+	assert.NoError(t, err)
+	assert.NoError(t, stub.commit(contract.AddEnvironmentRecord(ctx, string(unprefixedJSON))))
+
+	unprefixed = signedReading(t, private, "R5", recordTime, SensorMetric{Metric: "temperature", Value: 19})
+	unprefixed.DeviceID = "D1"
+	batch, err = json.Marshal(EnvironmentBatch{BatchID: "B2", Readings: []EnvironmentRecord{unprefixed}})
+	assert.NoError(t, err)
+	result, err = contract.AddEnvironmentBatch(ctx, string(batch))
+	assert.NoError(t, stub.commit(err))
+	assert.Equal(t, 1, result.Accepted)
+
+	records, err = contract.QueryEnvironmentRecords(ctx, "P1")
+	assert.NoError(t, err)
+	for _, record := range records {
+		assert.Equal(t, "DEVICE_D1", record.DeviceID)
+	}
+}
+
+func TestMetricAggregates(t *testing.T) {
+	var aggregates []MetricAggregate
+	for _, value := range []float64{12, 18, 9} {
+		aggregates = addMetricValue(aggregates, SensorMetric{Metric: "temperature", Value: value, Unit: "°C"})
+	}
+	aggregates = addMetricValue(aggregates, SensorMetric{Metric: "humidity", Value: 60, Unit: "%"})
+	assert.Equal(t, []MetricAggregate{
+		{Metric: "temperature", Unit: "°C", Count: 3, Min: 9, Max: 18, Sum: 39, Mean: 13},
+		{Metric: "humidity", Unit: "%", Count: 1, Min: 60, Max: 60, Sum: 60, Mean: 60},
+	}, aggregates)
+
+	merged := mergeMetricAggregates(aggregates, []MetricAggregate{
+		{Metric: "temperature", Unit: "°C", Count: 1, Min: 25, Max: 25, Sum: 25, Mean: 25},
+		{Metric: "soil_ph", Unit: "pH", Count: 2, Min: 6, Max: 7, Sum: 13, Mean: 6.5},
+	})
+	assert.Len(t, merged, 3)
+	assert.Equal(t, MetricAggregate{Metric: "temperature", Unit: "°C", Count: 4, Min: 9, Max: 25, Sum: 64, Mean: 16}, merged[0])
+	assert.Equal(t, "soil_ph", merged[2].Metric)
+}
+
+func TestSummaryPeriods(t *testing.T) {
+	day := func(date string) time.Time {
+		parsed, err := time.Parse("2006-01-02", date)
+		assert.NoError(t, err)
+		return parsed
+	}
+
+	// 周以周一开始，周日属于上一周
+	assert.Equal(t, day("2024-01-29"), summaryPeriodStart(day("2024-01-29"), "WEEK"))
+	assert.Equal(t, day("2024-01-29"), summaryPeriodStart(day("2024-02-04"), "WEEK"))
+	assert.Equal(t, day("2024-02-04"), summaryPeriodEnd(day("2024-01-29"), "WEEK"))
+
+	// 月末按当月天数计算，含闰年二月
+	assert.Equal(t, day("2024-02-01"), summaryPeriodStart(day("2024-02-29"), "MONTH"))
+	assert.Equal(t, day("2024-02-29"), summaryPeriodEnd(day("2024-02-01"), "MONTH"))
+	assert.Equal(t, day("2023-12-31"), summaryPeriodEnd(day("2023-12-01"), "MONTH"))
+
+	assert.Equal(t, day("2024-02-07"), summaryPeriodStart(day("2024-02-07"), "DAY"))
+	assert.Equal(t, day("2024-02-07"), summaryPeriodEnd(day("2024-02-07"), "DAY"))
+}
+
+func TestEnvironmentSummary(t *testing.T) {
+	ctx, stub := newMemoryContext()
+	contract := new(AgriTrace)
+
+	assert.NoError(t, stub.commit(contract.CreateProduct(ctx, `{"id":"P1","name":"番茄","farmerId":"F1"}`)))
+	// 同一产品的生产记录不计入环境汇总
+	assert.NoError(t, stub.commit(contract.AddProductionRecord(ctx, `{"id":"PR1","productId":"P1","type":"PLANTING","date":"2024-01-15"}`)))
+	private := registerTestDevice(t, ctx, stub, "D1", "P1")
+
+	readings := []struct {
+		id    string
+		time  string
+		value float64
+	}{
+		{"R1", "2024-01-31T08:00:00Z", 10},
+		{"R2", "2024-02-01T08:00:00Z", 20},
+		{"R3", "2024-02-01T20:00:00Z", 30},
+		{"R4", "2024-02-05T08:00:00Z", 40},
+	}
+	var submitted []string
+	for _, r := range readings {
+		recordTime, err := time.Parse(time.RFC3339, r.time)
+		assert.NoError(t, err)
+		reading := signedReading(t, private, r.id, recordTime, SensorMetric{Metric: "temperature", Value: r.value, Unit: "°C"})
+		readingJSON, err := json.Marshal(reading)
+		assert.NoError(t, err)
+		assert.NoError(t, stub.commit(contract.AddEnvironmentRecord(ctx, string(readingJSON))))
+		submitted = append(submitted, string(readingJSON))
+	}
+
+	// 重复提交的读数被拒绝，不重复计入汇总
+	assert.Error(t, stub.commit(contract.AddEnvironmentRecord(ctx, submitted[1])))
+
+	summaries, err := contract.QueryEnvironmentSummary(ctx, "P1", "2024-01-31", "2024-02-05", "DAY")
+	assert.NoError(t, err)
+	assert.Len(t, summaries, 3)
+	assert.Equal(t, "2024-02-01", summaries[1].PeriodStart)
+	assert.Equal(t, 2, summaries[1].Metrics[0].Count)
+	assert.Equal(t, 25.0, summaries[1].Metrics[0].Mean)
+
+	summaries, err = contract.QueryEnvironmentSummary(ctx, "P1", "2024-01-31", "2024-02-05", "WEEK")
+	assert.NoError(t, err)
+	assert.Len(t, summaries, 2)
+	assert.Equal(t, "2024-01-29", summaries[0].PeriodStart)
+	assert.Equal(t, "2024-02-04", summaries[0].PeriodEnd)
+	assert.Equal(t, MetricAggregate{Metric: "temperature", Unit: "°C", Count: 3, Min: 10, Max: 30, Sum: 60, Mean: 20}, summaries[0].Metrics[0])
+	assert.Equal(t, 1, summaries[1].Metrics[0].Count)
+
+	summaries, err = contract.QueryEnvironmentSummary(ctx, "P1", "2024-01-31", "2024-02-05", "MONTH")
+	assert.NoError(t, err)
+	assert.Len(t, summaries, 2)
+	assert.Equal(t, "2024-01-31", summaries[0].PeriodEnd)
+	assert.Equal(t, "2024-02-01", summaries[1].PeriodStart)
+	assert.Equal(t, "2024-02-29", summaries[1].PeriodEnd)
+	assert.Equal(t, 3, summaries[1].Metrics[0].Count)
+	assert.Equal(t, 30.0, summaries[1].Metrics[0].Mean)
+
+	// 日期范围之外的汇总不计入
+	summaries, err = contract.QueryEnvironmentSummary(ctx, "P1", "2024-02-01", "2024-02-04", "ALL")
+	assert.NoError(t, err)
+	assert.Len(t, summaries, 1)
+	assert.Equal(t, 2, summaries[0].Metrics[0].Count)
+
+	// 重建结果与增量维护一致
+	assert.NoError(t, stub.commit(contract.RebuildEnvironmentSummary(ctx, "P1")))
+	assert.NotContains(t, stub.state, "ENVDAILY_P1_00010101")
+	assert.NotContains(t, stub.state, "ENVDAILY_P1_20240115")
+	rebuilt, err := contract.QueryEnvironmentSummary(ctx, "P1", "2024-01-01", "2024-02-05", "ALL")
+	assert.NoError(t, err)
+	assert.Equal(t, 4, rebuilt[0].Metrics[0].Count)
+	assert.Equal(t, 25.0, rebuilt[0].Metrics[0].Mean)
+}
+
+func TestQueryEnvironmentMetricSkipsOtherRecords(t *testing.T) {
+	ctx, stub := newMemoryContext()
+	contract := new(AgriTrace)
+
+	assert.NoError(t, stub.commit(contract.CreateProduct(ctx, `{"id":"P1","name":"番茄","farmerId":"F1"}`)))
+	assert.NoError(t, stub.commit(contract.AddProductionRecord(ctx, `{"id":"PR1","productId":"P1","type":"HARVESTING","date":"2024-06-01","quantity":100}`)))
+	// 旧版合约写入的环境记录只有温度、湿度字段
+	stub.state["E0"] = []byte(`{"id":"E0","productId":"P1","temperature":12,"humidity":60,"recordTime":"2024-06-01T06:00:00Z","operatorId":"F1"}`)
+
+	private := registerTestDevice(t, ctx, stub, "D1", "P1")
+	recordTime, err := time.Parse(time.RFC3339, "2024-06-01T08:00:00Z")
+	assert.NoError(t, err)
+	readingJSON, err := json.Marshal(signedReading(t, private, "R1", recordTime, SensorMetric{Metric: "temperature", Value: 18, Unit: "°C"}))
+	assert.NoError(t, err)
+	assert.NoError(t, stub.commit(contract.AddEnvironmentRecord(ctx, string(readingJSON))))
+
+	// 生产记录不会被当作温度、湿度为 0 的旧格式读数
+	readings, err := contract.QueryEnvironmentMetric(ctx, "P1", "temperature")
+	assert.NoError(t, err)
+	if assert.Len(t, readings, 2) {
+		assert.Equal(t, "E0", readings[0].RecordID)
+		assert.Equal(t, 12.0, readings[0].Value)
+		assert.Equal(t, "R1", readings[1].RecordID)
+	}
+
+	readings, err = contract.QueryEnvironmentMetric(ctx, "P1", "humidity")
+	assert.NoError(t, err)
+	if assert.Len(t, readings, 1) {
+		assert.Equal(t, "E0", readings[0].RecordID)
+	}
+}
+
+func TestAddColdChainReadingsShelfLifeEvent(t *testing.T) {
+	ctx, stub := newMemoryContext()
+	contract := new(AgriTrace)
+
+	harvest := time.Now().Add(-200 * time.Hour).UTC()
+	assert.NoError(t, stub.commit(contract.CreateProduct(ctx, fmt.Sprintf(`{"id":"P1","name":"生菜","farmerId":"F1","harvestDate":"%s"}`, harvest.Format(time.RFC3339)))))
+	assert.NoError(t, stub.commit(contract.SetShelfLifeModel(ctx, `{"crop":"生菜","referenceTemp":4,"referenceShelfLifeHours":240,"q10":2,"flagThresholdHours":48}`)))
+	assert.NoError(t, stub.commit(contract.AddLogisticsRecord(ctx, `{"id":"L1","productId":"P1","location":"仓库","status":"CREATED","operatorId":"C1"}`)))
+	stub.events = nil
+
+	// 高温读数使剩余保质期首次低于预警阈值
+	readings := fmt.Sprintf(`[{"loggerId":"logger1","time":"%s","temperature":14}]`, harvest.Add(10*time.Hour).Format(time.RFC3339))
+	assert.NoError(t, stub.commit(contract.AddColdChainReadings(ctx, "L1", readings)))
+	assert.Equal(t, []string{"ShelfLifeLow"}, stub.events)
+
+	product, err := contract.QueryProduct(ctx, "P1")
+	assert.NoError(t, err)
+	assert.True(t, product.ShelfLifeFlagged)
+
+	// 已标记的产品不重复触发预警
+	readings = fmt.Sprintf(`[{"loggerId":"logger1","time":"%s","temperature":4}]`, harvest.Add(20*time.Hour).Format(time.RFC3339))
+	assert.NoError(t, stub.commit(contract.AddColdChainReadings(ctx, "L1", readings)))
+	assert.Equal(t, []string{"ShelfLifeLow"}, stub.events)
+}
+
+func TestAddColdChainReadingsDedupe(t *testing.T) {
+	ctx, stub := newMemoryContext()
+	contract := new(AgriTrace)
+
+	assert.NoError(t, stub.commit(contract.CreateProduct(ctx, `{"id":"P1","name":"生菜","farmerId":"F1"}`)))
+	assert.NoError(t, stub.commit(contract.SetProductStorageRange(ctx, "P1", 0, 8)))
+	assert.NoError(t, stub.commit(contract.AddLogisticsRecord(ctx, `{"id":"L1","productId":"P1","location":"仓库","status":"CREATED","operatorId":"C1"}`)))
+
+	start := time.Now().Add(-10 * time.Hour).UTC()
+	dump := fmt.Sprintf(`[{"loggerId":"logger1","time":"%s","temperature":4},{"loggerId":"logger1","time":"%s","temperature":12},{"loggerId":"logger1","time":"%s","temperature":5}]`,
+		start.Format(time.RFC3339), start.Add(time.Hour).Format(time.RFC3339), start.Add(3*time.Hour).Format(time.RFC3339))
+	assert.NoError(t, stub.commit(contract.AddColdChainReadings(ctx, "L1", dump)))
+	assert.Equal(t, []string{"ColdChainExcursion"}, stub.events)
+
+	record, err := contract.QueryLogisticsRecord(ctx, "L1")
+	assert.NoError(t, err)
+	assert.Len(t, record.TemperatureReadings, 3)
+	excursions := record.Excursions
+	assert.Len(t, excursions, 1)
+
+	// 重新提交同一份导出数据，已保存的读数不重复计入
+	assert.NoError(t, stub.commit(contract.AddColdChainReadings(ctx, "L1", dump)))
+	record, err = contract.QueryLogisticsRecord(ctx, "L1")
+	assert.NoError(t, err)
+	assert.Len(t, record.TemperatureReadings, 3)
+	assert.Equal(t, excursions, record.Excursions)
+	assert.Equal(t, []string{"ColdChainExcursion"}, stub.events)
+
+	// 其他记录仪同一时间的读数照常保存
+	readings := fmt.Sprintf(`[{"loggerId":"logger2","time":"%s","temperature":4}]`, start.Format(time.RFC3339))
+	assert.NoError(t, stub.commit(contract.AddColdChainReadings(ctx, "L1", readings)))
+	record, err = contract.QueryLogisticsRecord(ctx, "L1")
+	assert.NoError(t, err)
+	assert.Len(t, record.TemperatureReadings, 4)
+}
+
+func TestLogisticsHistoryAppendOnly(t *testing.T) {
+	ctx, stub := newMemoryContext()
+	contract := new(AgriTrace)
+
+	assert.NoError(t, stub.commit(contract.CreateProduct(ctx, `{"id":"P1","name":"番茄","farmerId":"F1"}`)))
+
+	// 调用方提交的历史节点被忽略
+	assert.NoError(t, stub.commit(contract.AddLogisticsRecord(ctx, `{"id":"L1","productId":"P1","location":"农场","status":"CREATED","operatorId":"C1","history":[{"sequence":1,"location":"伪造","status":"DELIVERED"}]}`)))
+	record, err := contract.QueryLogisticsRecord(ctx, "L1")
+	assert.NoError(t, err)
+	assert.Empty(t, record.History)
+
+	// 坐标超出范围时拒绝更新
+	assert.Error(t, stub.commit(contract.UpdateLogisticsRecord(ctx, "L1", "PICKED_UP", "农场", "已揽收", "91", "0")))
+	assert.Error(t, stub.commit(contract.UpdateLogisticsRecord(ctx, "L1", "PICKED_UP", "农场", "已揽收", "NaN", "0")))
+	assert.Error(t, stub.commit(contract.UpdateLogisticsRecord(ctx, "L1", "PICKED_UP", "农场", "已揽收", "30.5", "")))
+	assert.NoError(t, stub.commit(contract.UpdateLogisticsRecord(ctx, "L1", "PICKED_UP", "农场", "已揽收", "30.5", "114.3")))
+	record, err = contract.QueryLogisticsRecord(ctx, "L1")
+	assert.NoError(t, err)
+	assert.Len(t, record.History, 2)
+	assert.Equal(t, 30.5, record.Latitude)
+	assert.Equal(t, 114.3, record.Longitude)
+	assert.Equal(t, 30.5, record.History[1].Latitude)
+	assert.Equal(t, 114.3, record.History[1].Longitude)
+	assert.False(t, record.History[0].Located)
+	assert.True(t, record.History[1].Located)
+
+	// 已存在的记录不能被重新创建覆盖
+	assert.Error(t, stub.commit(contract.AddLogisticsRecord(ctx, `{"id":"L1","productId":"P1","location":"别处","status":"CREATED","operatorId":"C2"}`)))
+	record, err = contract.QueryLogisticsRecord(ctx, "L1")
+	assert.NoError(t, err)
+	assert.Equal(t, "PICKED_UP", record.Status)
+	assert.Equal(t, []string{"CREATED", "PICKED_UP"}, []string{record.History[0].Status, record.History[1].Status})
+
+	// 与产品等其他记录ID冲突同样被拒绝
+	assert.Error(t, stub.commit(contract.AddLogisticsRecord(ctx, `{"id":"P1","productId":"P1","location":"农场","status":"CREATED","operatorId":"C1"}`)))
+
+	// 坐标 0, 0 是有效坐标，与未上报坐标区分保存
+	assert.NoError(t, stub.commit(contract.UpdateLogisticsRecord(ctx, "L1", "IN_TRANSIT", "几内亚湾", "途中", "0", "0")))
+	assert.NoError(t, stub.commit(contract.UpdateLogisticsRecord(ctx, "L1", "AT_HUB", "中转站", "到达中转站", "", "")))
+	record, err = contract.QueryLogisticsRecord(ctx, "L1")
+	assert.NoError(t, err)
+	assert.True(t, record.History[2].Located)
+	assert.False(t, record.History[3].Located)
+	assert.False(t, record.Located)
+	var stored struct {
+		Latitude *float64                     `json:"latitude"`
+		History  []map[string]json.RawMessage `json:"history"`
+	}
+	assert.NoError(t, json.Unmarshal(stub.state["L1"], &stored))
+	assert.Nil(t, stored.Latitude)
+	assert.Equal(t, json.RawMessage("0"), stored.History[2]["latitude"])
+	assert.NotContains(t, stored.History[3], "latitude")
+}
+
+func TestSetHarvestQuantity(t *testing.T) {
+	ctx, stub := newMemoryContext()
+	contract := new(AgriTrace)
+
+	// 记录收获数量之前已收获的批次没有持有记录，无法发运
+	stub.state["P1"] = []byte(`{"id":"P1","name":"番茄","farmerId":"F1","status":"HARVESTED","harvestDate":"2024-06-01"}`)
+	shipment := `{"id":"S1","origin":"农场","destination":"仓库","carrierId":"C1","shipperId":"F1","receiverId":"D1","items":[{"productId":"P1","quantity":30}]}`
+	assert.ErrorContains(t, stub.commit(contract.CreateShipment(ctx, shipment)), "可用数量不足")
+
+	// 补录须走 SetHarvestQuantity，不能以生产记录直接提交
+	assert.Error(t, stub.commit(contract.AddProductionRecord(ctx, `{"id":"PR2","productId":"P1","type":"HARVEST_QUANTITY","quantity":80}`)))
+	assert.Error(t, stub.commit(contract.SetHarvestQuantity(ctx, `{"id":"PR2","productId":"P1","operatorId":"F1"}`)))
+	assert.NoError(t, stub.commit(contract.SetHarvestQuantity(ctx, `{"id":"PR2","productId":"P1","operatorId":"F1","quantity":80,"description":"按出库单补录"}`)))
+
+	product, err := contract.QueryProduct(ctx, "P1")
+	assert.NoError(t, err)
+	assert.Equal(t, 80, product.HarvestQuantity)
+	held, err := contract.heldQuantity(ctx, product, "F1")
+	assert.NoError(t, err)
+	assert.Equal(t, 80, held)
+
+	records, err := contract.QueryProductionRecords(ctx, "P1")
+	assert.NoError(t, err)
+	if assert.Len(t, records, 1) {
+		assert.Equal(t, "HARVEST_QUANTITY", records[0].Type)
+		assert.Equal(t, "2024-06-01", records[0].Date)
+	}
+
+	// 每个批次只能补录一次，已按数量收获的批次和未收获的批次不能补录
+	assert.ErrorContains(t, stub.commit(contract.SetHarvestQuantity(ctx, `{"id":"PR3","productId":"P1","operatorId":"F1","quantity":20}`)), "不能补录")
+	assert.NoError(t, stub.commit(contract.CreateProduct(ctx, `{"id":"P2","name":"番茄","farmerId":"F1"}`)))
+	assert.ErrorContains(t, stub.commit(contract.SetHarvestQuantity(ctx, `{"id":"PR3","productId":"P2","operatorId":"F1","quantity":20}`)), "尚未收获")
+
+	assert.NoError(t, stub.commit(contract.CreateShipment(ctx, shipment)))
+}
+
+func TestLotTransferHoldings(t *testing.T) {
+	ctx, stub := newMemoryContext()
+	contract := new(AgriTrace)
+
+	assert.NoError(t, stub.commit(contract.CreateProduct(ctx, `{"id":"P1","name":"番茄","farmerId":"F1","harvestQuantity":1000}`)))
+	product, err := contract.QueryProduct(ctx, "P1")
+	assert.NoError(t, err)
+	held := func(holderID string) int {
+		quantity, err := contract.heldQuantity(ctx, product, holderID)
+		assert.NoError(t, err)
+		return quantity
+	}
+
+	// 收获前农户没有可移交的数量
+	assert.Equal(t, 0, held("F1"))
+	assert.Error(t, stub.commit(contract.InitiateTransfer(ctx, `{"id":"T0","senderId":"F1","receiverId":"D1","items":[{"productId":"P1","quantity":10}]}`)))
+
+	assert.Error(t, stub.commit(contract.AddProductionRecord(ctx, `{"id":"PR1","productId":"P1","type":"HARVESTING","date":"2024-06-01"}`)))
+	assert.NoError(t, stub.commit(contract.AddProductionRecord(ctx, `{"id":"PR1","productId":"P1","type":"HARVESTING","date":"2024-06-01","quantity":100}`)))
+	product, err = contract.QueryProduct(ctx, "P1")
+	assert.NoError(t, err)
+	assert.Equal(t, 100, product.HarvestQuantity)
+	assert.Equal(t, 100, held("F1"))
+
+	// 超过收获数量的移交被拒绝
+	assert.Error(t, stub.commit(contract.InitiateTransfer(ctx, `{"id":"T1","senderId":"F1","receiverId":"D1","items":[{"productId":"P1","quantity":150}]}`)))
+
+	// 拒收后保管权不变
+	assert.NoError(t, stub.commit(contract.InitiateTransfer(ctx, `{"id":"T1","senderId":"F1","receiverId":"D1","items":[{"productId":"P1","quantity":60}]}`)))
+	assert.Error(t, stub.commit(contract.RejectTransfer(ctx, "TRANSFER_T1", "D2", "非接收方")))
+	assert.NoError(t, stub.commit(contract.RejectTransfer(ctx, "TRANSFER_T1", "D1", "包装破损")))
+	assert.Equal(t, 100, held("F1"))
+	assert.Equal(t, 0, held("D1"))
+	assert.Error(t, stub.commit(contract.AcceptTransfer(ctx, "TRANSFER_T1", "D1", "")))
+
+	// 全部接收
+	assert.NoError(t, stub.commit(contract.InitiateTransfer(ctx, `{"id":"T2","senderId":"F1","receiverId":"D1","items":[{"productId":"P1","quantity":60}]}`)))
+	assert.NoError(t, stub.commit(contract.AcceptTransfer(ctx, "TRANSFER_T2", "D1", "")))
+	assert.Equal(t, 40, held("F1"))
+	assert.Equal(t, 60, held("D1"))
+
+	// 部分接收：移交方扣减移交数量，接收方只增加实收数量
+	assert.NoError(t, stub.commit(contract.InitiateTransfer(ctx, `{"id":"T3","senderId":"D1","receiverId":"D2","items":[{"productId":"P1","quantity":60}]}`)))
+	assert.Error(t, stub.commit(contract.AcceptTransfer(ctx, "TRANSFER_T3", "D2", `[{"productId":"P1","acceptedQuantity":70}]`)))
+	assert.NoError(t, stub.commit(contract.AcceptTransfer(ctx, "TRANSFER_T3", "D2", `[{"productId":"P1","acceptedQuantity":55,"discrepancy":"短少5箱"}]`)))
+	assert.Equal(t, 0, held("D1"))
+	assert.Equal(t, 55, held("D2"))
+
+	transfer, err := contract.QueryTransfer(ctx, "TRANSFER_T3")
+	assert.NoError(t, err)
+	assert.Equal(t, "ACCEPTED", transfer.Status)
+	assert.Equal(t, 55, transfer.Items[0].AcceptedQuantity)
+
+	// 农户剩余数量不足时不能继续移交
+	assert.Error(t, stub.commit(contract.InitiateTransfer(ctx, `{"id":"T4","senderId":"F1","receiverId":"D2","items":[{"productId":"P1","quantity":50}]}`)))
+}
+
+func TestAddLogisticsRecordStartsCreated(t *testing.T) {
+	ctx, stub := newMemoryContext()
+	contract := new(AgriTrace)
+
+	assert.NoError(t, stub.commit(contract.CreateProduct(ctx, `{"id":"P1","name":"番茄","farmerId":"F1"}`)))
+	assert.NoError(t, stub.commit(contract.AddProductionRecord(ctx, `{"id":"PR1","productId":"P1","type":"HARVESTING","date":"2024-06-01","quantity":100}`)))
+
+	// 新建即送达会跳过运输流程直接发起交接，必须拒绝
+	for _, status := range []string{"DELIVERED", "REJECTED", "LOST", "IN_TRANSIT"} {
+		err := stub.commit(contract.AddLogisticsRecord(ctx, fmt.Sprintf(`{"id":"L1","productId":"P1","location":"农场","status":"%s","operatorId":"C1","receiverId":"D1","quantity":10}`, status)))
+		assert.Error(t, err, status)
+	}
+	_, err := contract.QueryTransfer(ctx, "TRANSFER_L1")
+	assert.Error(t, err)
+
+	// 未指定状态时按 CREATED 创建，送达后才向收货方发起交接
+	assert.NoError(t, stub.commit(contract.AddLogisticsRecord(ctx, `{"id":"L1","productId":"P1","location":"农场","operatorId":"C1","receiverId":"D1","quantity":10}`)))
+	record, err := contract.QueryLogisticsRecord(ctx, "L1")
+	assert.NoError(t, err)
+	assert.Equal(t, "CREATED", record.Status)
+
+	for _, status := range []string{"PICKED_UP", "IN_TRANSIT", "OUT_FOR_DELIVERY", "DELIVERED"} {
+		assert.NoError(t, stub.commit(contract.UpdateLogisticsRecord(ctx, "L1", status, "途中", status, "", "")))
+	}
+	transfer, err := contract.QueryTransfer(ctx, "TRANSFER_L1")
+	assert.NoError(t, err)
+	assert.Equal(t, "PENDING", transfer.Status)
+	assert.Equal(t, "F1", transfer.SenderID)
+}
+
+func TestLogisticsDeliveryFromShipper(t *testing.T) {
+	ctx, stub := newMemoryContext()
+	contract := new(AgriTrace)
+
+	assert.NoError(t, stub.commit(contract.CreateProduct(ctx, `{"id":"P1","name":"番茄","farmerId":"F1"}`)))
+	assert.NoError(t, stub.commit(contract.AddProductionRecord(ctx, `{"id":"PR1","productId":"P1","type":"HARVESTING","date":"2024-06-01","quantity":100}`)))
+	assert.NoError(t, stub.commit(contract.InitiateTransfer(ctx, `{"id":"T1","senderId":"F1","receiverId":"D1","items":[{"productId":"P1","quantity":100}]}`)))
+	assert.NoError(t, stub.commit(contract.AcceptTransfer(ctx, "TRANSFER_T1", "D1", "")))
+	deliver := func(recordID string) {
+		for _, status := range []string{"PICKED_UP", "IN_TRANSIT", "OUT_FOR_DELIVERY", "DELIVERED"} {
+			assert.NoError(t, stub.commit(contract.UpdateLogisticsRecord(ctx, recordID, status, "途中", status, "", "")))
+		}
+	}
+
+	// 农户已移交的批次由实际发货方向收货方移交
+	assert.NoError(t, stub.commit(contract.AddLogisticsRecord(ctx, `{"id":"L1","productId":"P1","location":"分销中心","operatorId":"C1","shipperId":"D1","receiverId":"D2","quantity":40}`)))
+	deliver("L1")
+	transfer, err := contract.QueryTransfer(ctx, "TRANSFER_L1")
+	assert.NoError(t, err)
+	assert.Equal(t, "D1", transfer.SenderID)
+	assert.NoError(t, stub.commit(contract.AcceptTransfer(ctx, "TRANSFER_L1", "D2", "")))
+
+	product, err := contract.QueryProduct(ctx, "P1")
+	assert.NoError(t, err)
+	held, err := contract.heldQuantity(ctx, product, "D2")
+	assert.NoError(t, err)
+	assert.Equal(t, 40, held)
+
+	// 未指定发货方的新记录和未记录发货方的旧记录由产品所属农户发货
+	assert.NoError(t, stub.commit(contract.AddLogisticsRecord(ctx, `{"id":"L2","productId":"P1","location":"农场","operatorId":"C1"}`)))
+	record, err := contract.QueryLogisticsRecord(ctx, "L2")
+	assert.NoError(t, err)
+	assert.Equal(t, "F1", record.ShipperID)
+
+	stub.state["L3"] = []byte(`{"id":"L3","productId":"P1","location":"农场","status":"CREATED","operatorId":"C1","receiverId":"D2","quantity":10}`)
+	for _, status := range []string{"PICKED_UP", "IN_TRANSIT", "OUT_FOR_DELIVERY"} {
+		assert.NoError(t, stub.commit(contract.UpdateLogisticsRecord(ctx, "L3", status, "途中", status, "", "")))
+	}
+	// 农户已无可移交的数量
+	assert.ErrorContains(t, stub.commit(contract.UpdateLogisticsRecord(ctx, "L3", "DELIVERED", "门店", "送达", "", "")), "F1")
+}
+
+func TestMassBalanceCountsEachUnitOnce(t *testing.T) {
+	shipments := []*Shipment{
+		{ID: "SHIPMENT_1", Status: "DELIVERED", Items: []ShipmentItem{{ProductID: "P1", Quantity: 50}}},
+		{ID: "SHIPMENT_2", Status: "DELIVERED", Items: []ShipmentItem{{ProductID: "P1", Quantity: 40}}},
+		{ID: "SHIPMENT_3", Status: "REJECTED", Items: []ShipmentItem{{ProductID: "P1", Quantity: 25}}},
+		{ID: "SHIPMENT_4", Status: "REJECTED", Items: []ShipmentItem{{ProductID: "P1", Quantity: 20}}},
+		{ID: "SHIPMENT_5", Status: "LOST", Items: []ShipmentItem{{ProductID: "P1", Quantity: 30}}},
+	}
+	transfers := []*LotTransfer{
+		{ID: "TRANSFER_SHIPMENT_1", ShipmentID: "SHIPMENT_1", Status: "ACCEPTED", Items: []TransferItem{{ProductID: "P1", Quantity: 50, AcceptedQuantity: 50}}},
+		{ID: "TRANSFER_SHIPMENT_2", ShipmentID: "SHIPMENT_2", Status: "PENDING", Items: []TransferItem{{ProductID: "P1", Quantity: 40}}},
+	}
+	claims := []*ShipmentClaim{
+		// 已收货货物的损坏从实收转为损失
+		{ID: "CLAIM_1", ShipmentID: "SHIPMENT_1", Type: "DAMAGE", Items: []ClaimItem{{ProductID: "P1", Quantity: 5}}, Status: "SETTLED", Outcome: "COMPENSATED"},
+		// 待收货确认的货物变质从待收货转为损失
+		{ID: "CLAIM_2", ShipmentID: "SHIPMENT_2", Type: "SPOILAGE", Items: []ClaimItem{{ProductID: "P1", Quantity: 10}}, Status: "ACCEPTED"},
+		// 未结案的索赔不计损失
+		{ID: "CLAIM_3", ShipmentID: "SHIPMENT_3", Type: "DAMAGE", Items: []ClaimItem{{ProductID: "P1", Quantity: 5}}, Status: "FILED"},
+		{ID: "CLAIM_4", ShipmentID: "SHIPMENT_3", Type: "DAMAGE", Items: []ClaimItem{{ProductID: "P1", Quantity: 5}}, Status: "DISPUTED"},
+		// 拒收货物的损坏从拒收转为损失
+		{ID: "CLAIM_5", ShipmentID: "SHIPMENT_4", Type: "DAMAGE", Items: []ClaimItem{{ProductID: "P1", Quantity: 8}}, Status: "SETTLED", Outcome: "PARTIAL"},
+		// 丢失运输单部分获赔
+		{ID: "CLAIM_6", ShipmentID: "SHIPMENT_5", Type: "SHORTAGE", Items: []ClaimItem{{ProductID: "P1", Quantity: 20}}, Status: "SETTLED", Outcome: "COMPENSATED"},
+	}
+
+	balance := massBalance("P1", shipments, transfers, claims)
+	assert.Equal(t, 165, balance.Shipped)
+	assert.Equal(t, 45, balance.Received)
+	assert.Equal(t, 30, balance.PendingReceipt)
+	assert.Equal(t, 37, balance.Rejected)
+	assert.Equal(t, 43, balance.Lost)
+	assert.Equal(t, 10, balance.Unaccounted)
+	assert.Equal(t, balance.Shipped, balance.InTransit+balance.PendingReceipt+balance.Received+balance.Rejected+balance.Lost+balance.Unaccounted)
+
+	assert.False(t, claimCountsAsLoss(&ShipmentClaim{Status: "FILED"}))
+	assert.False(t, claimCountsAsLoss(&ShipmentClaim{Status: "DISPUTED"}))
+	assert.False(t, claimCountsAsLoss(&ShipmentClaim{Status: "SETTLED", Outcome: "DENIED"}))
+	assert.True(t, claimCountsAsLoss(&ShipmentClaim{Status: "ACCEPTED"}))
+	assert.True(t, claimCountsAsLoss(&ShipmentClaim{Status: "SETTLED", Outcome: "PARTIAL"}))
+}
+
+func TestCreateShipmentCommitsQuantity(t *testing.T) {
+	ctx, stub := newMemoryContext()
+	contract := new(AgriTrace)
+
+	assert.NoError(t, stub.commit(contract.CreateProduct(ctx, `{"id":"P1","name":"番茄","farmerId":"F1"}`)))
+	assert.NoError(t, stub.commit(contract.AddProductionRecord(ctx, `{"id":"PR1","productId":"P1","type":"HARVESTING","date":"2024-06-01","quantity":100}`)))
+
+	createShipment := func(id string, quantity int) error {
+		return stub.commit(contract.CreateShipment(ctx, fmt.Sprintf(`{"id":"%s","origin":"农场","destination":"仓库","carrierId":"C1","shipperId":"F1","receiverId":"D1","items":[{"productId":"P1","quantity":%d}]}`, id, quantity)))
+	}
+	advance := func(shipmentID string, statuses ...string) {
+		for _, status := range statuses {
+			assert.NoError(t, stub.commit(contract.AddShipmentCheckpoint(ctx, shipmentID, fmt.Sprintf(`{"location":"途中","status":"%s"}`, status))))
+		}
+	}
+
+	// 未结束运输单占用的数量不能再次发运或交接
+	assert.NoError(t, createShipment("S1", 60))
+	assert.ErrorContains(t, createShipment("S2", 50), "可用数量不足")
+	assert.NoError(t, createShipment("S3", 40))
+	assert.Error(t, stub.commit(contract.InitiateTransfer(ctx, `{"id":"T1","senderId":"F1","receiverId":"D1","items":[{"productId":"P1","quantity":1}]}`)))
+
+	// 运输单丢失后释放占用
+	advance("SHIPMENT_S1", "LOST")
+	assert.NoError(t, createShipment("S2", 50))
+
+	// 送达后由交接单接续占用，收货方确认后扣减持有数量
+	advance("SHIPMENT_S3", "PICKED_UP", "IN_TRANSIT", "OUT_FOR_DELIVERY", "DELIVERED")
+	assert.ErrorContains(t, createShipment("S4", 20), "可用数量不足")
+	assert.NoError(t, stub.commit(contract.AcceptTransfer(ctx, "TRANSFER_SHIPMENT_S3", "D1", "")))
+	assert.ErrorContains(t, createShipment("S4", 20), "可用数量不足")
+	assert.NoError(t, createShipment("S4", 10))
+}
+
+func TestShipmentClaimWorkflow(t *testing.T) {
+	ctx, stub := newMemoryContext()
+	contract := new(AgriTrace)
+
+	assert.NoError(t, stub.commit(contract.CreateProduct(ctx, `{"id":"P1","name":"番茄","farmerId":"F1"}`)))
+	assert.NoError(t, stub.commit(contract.AddProductionRecord(ctx, `{"id":"PR1","productId":"P1","type":"HARVESTING","date":"2024-06-01","quantity":100}`)))
+	assert.NoError(t, stub.commit(contract.CreateShipment(ctx, `{"id":"S1","origin":"农场","destination":"仓库","carrierId":"C1","shipperId":"F1","receiverId":"D1","items":[{"productId":"P1","quantity":50}]}`)))
+
+	evidence := fmt.Sprintf("%x", sha256.Sum256([]byte("照片")))
+	fileClaim := func(id string, quantity int) error {
+		return stub.commit(contract.FileClaim(ctx, fmt.Sprintf(`{"id":"%s","shipmentId":"SHIPMENT_S1","claimantId":"D1","type":"SHORTAGE","items":[{"productId":"P1","quantity":%d}],"evidenceHashes":["%s"]}`, id, quantity, evidence)))
+	}
+
+	// 运输单结束前不能索赔
+	assert.ErrorContains(t, fileClaim("X1", 30), "尚未结束")
+	for _, status := range []string{"PICKED_UP", "IN_TRANSIT", "OUT_FOR_DELIVERY", "DELIVERED"} {
+		assert.NoError(t, stub.commit(contract.AddShipmentCheckpoint(ctx, "SHIPMENT_S1", fmt.Sprintf(`{"location":"途中","status":"%s"}`, status))))
+	}
+
+	// 未结案的索赔同样占用可索赔数量
+	assert.NoError(t, fileClaim("X1", 30))
+	assert.ErrorContains(t, fileClaim("X2", 25), "累计索赔数量")
+
+	// 承运方提出异议后驳回，被驳回的索赔不再占用
+	assert.Error(t, stub.commit(contract.RespondToClaim(ctx, "CLAIM_X1", "C2", false, "非承运方")))
+	assert.NoError(t, stub.commit(contract.RespondToClaim(ctx, "CLAIM_X1", "C1", false, "交接时数量无误")))
+	assert.Error(t, stub.commit(contract.SettleClaim(ctx, "CLAIM_X1", "DENIED", 5, "")))
+	assert.NoError(t, stub.commit(contract.SettleClaim(ctx, "CLAIM_X1", "DENIED", 0, "证据不足")))
+	assert.NoError(t, fileClaim("X2", 45))
+	assert.ErrorContains(t, fileClaim("X3", 10), "累计索赔数量")
+
+	// 承运方认可后赔付结案，已结案的索赔不能再次答复
+	assert.Error(t, stub.commit(contract.SettleClaim(ctx, "CLAIM_X2", "COMPENSATED", 800, "")))
+	assert.NoError(t, stub.commit(contract.RespondToClaim(ctx, "CLAIM_X2", "C1", true, "确认短少")))
+	assert.Error(t, stub.commit(contract.SettleClaim(ctx, "CLAIM_X2", "COMPENSATED", 0, "")))
+	assert.NoError(t, stub.commit(contract.SettleClaim(ctx, "CLAIM_X2", "COMPENSATED", 800, "按合同赔付")))
+	assert.Error(t, stub.commit(contract.RespondToClaim(ctx, "CLAIM_X2", "C1", true, "再次答复")))
+
+	claim, err := contract.QueryClaim(ctx, "CLAIM_X2")
+	assert.NoError(t, err)
+	assert.Equal(t, "SETTLED", claim.Status)
+	assert.Equal(t, 800.0, claim.SettledAmount)
+
+	// 只有获赔的索赔计入损失
+	balance, err := contract.QueryMassBalance(ctx, "P1")
+	assert.NoError(t, err)
+	assert.Equal(t, 50, balance.Shipped)
+	assert.Equal(t, 45, balance.Lost)
+	assert.Equal(t, 5, balance.PendingReceipt)
+}
+
+func TestWarehouseTransfers(t *testing.T) {
+	ctx, stub := newMemoryContext()
+	contract := new(AgriTrace)
+
+	assert.NoError(t, stub.commit(contract.CreateProduct(ctx, `{"id":"P1","name":"番茄","farmerId":"F1"}`)))
+	assert.NoError(t, stub.commit(contract.AddProductionRecord(ctx, `{"id":"PR1","productId":"P1","type":"HARVESTING","date":"2024-06-01","quantity":100}`)))
+	assert.NoError(t, stub.commit(contract.RegisterWarehouse(ctx, `{"id":"W1","name":"冷库","type":"COLD_STORE","operatorId":"O1","minTemperature":0,"maxTemperature":4,"minHumidity":80,"maxHumidity":95}`)))
+	transfer := func(id string, senderID string, receiverID string, quantity int) error {
+		err := stub.commit(contract.InitiateTransfer(ctx, fmt.Sprintf(`{"id":"%s","senderId":"%s","receiverId":"%s","items":[{"productId":"P1","quantity":%d}]}`, id, senderID, receiverID, quantity)))
+		if err != nil {
+			return err
+		}
+		return stub.commit(contract.AcceptTransfer(ctx, "TRANSFER_"+id, receiverID, ""))
+	}
+
+	// 未登记的仓库不能接收批次
+	assert.ErrorContains(t, transfer("T0", "F1", "WAREHOUSE_W2", 10), "仓库不存在")
+
+	assert.NoError(t, transfer("T1", "F1", "WAREHOUSE_W1", 60))
+	assert.NoError(t, transfer("T2", "WAREHOUSE_W1", "D1", 60))
+	assert.NoError(t, transfer("T3", "F1", "WAREHOUSE_W1", 20))
+
+	movement := func(id string) *WarehouseMovement {
+		var movement WarehouseMovement
+		assert.NoError(t, json.Unmarshal(stub.state[id], &movement))
+		return &movement
+	}
+	inbound := movement("WHMOVE_T1_P1_INBOUND")
+	assert.Equal(t, "WAREHOUSE_W1", inbound.WarehouseID)
+	assert.Equal(t, 60, inbound.Quantity)
+	assert.Equal(t, 60, inbound.Balance)
+	assert.Equal(t, "TRANSFER_T1", inbound.TransferID)
+	outbound := movement("WHMOVE_T2_P1_OUTBOUND")
+	assert.Equal(t, "OUTBOUND", outbound.Direction)
+	assert.Equal(t, 60, outbound.Quantity)
+	assert.Equal(t, 0, outbound.Balance)
+	assert.Equal(t, 20, movement("WHMOVE_T3_P1_INBOUND").Balance)
+
+	// 追溯信息中按在库数量清零划分停留记录
+	traceJSON, err := contract.QueryProductTrace(ctx, "P1")
+	assert.NoError(t, err)
+	var trace struct {
+		WarehouseStays []*WarehouseStay `json:"warehouseStays"`
+	}
+	assert.NoError(t, json.Unmarshal([]byte(traceJSON), &trace))
+	if assert.Len(t, trace.WarehouseStays, 2) {
+		assert.Equal(t, 60, trace.WarehouseStays[0].InQuantity)
+		assert.Equal(t, 60, trace.WarehouseStays[0].OutQuantity)
+		assert.False(t, trace.WarehouseStays[0].InStorage)
+		assert.Equal(t, 20, trace.WarehouseStays[1].InQuantity)
+		assert.True(t, trace.WarehouseStays[1].InStorage)
+	}
+}
+
+func TestReplenishmentShipment(t *testing.T) {
+	ctx, stub := newMemoryContext()
+	contract := new(AgriTrace)
+
+	assert.NoError(t, stub.commit(contract.CreateProduct(ctx, `{"id":"P1","name":"番茄","farmerId":"F1"}`)))
+	assert.NoError(t, stub.commit(contract.AddProductionRecord(ctx, `{"id":"PR1","productId":"P1","type":"HARVESTING","date":"2024-06-01","quantity":200}`)))
+	assert.NoError(t, stub.commit(contract.RequestReplenishment(ctx, `{"id":"R1","retailerId":"RETAILER_R1","supplierId":"F1","productId":"P1","quantity":50}`)))
+	assert.NoError(t, stub.commit(contract.RespondReplenishment(ctx, "REPLENISH_R1", "F1", true, "")))
+
+	createShipment := func(id string) {
+		assert.NoError(t, stub.commit(contract.CreateShipment(ctx, fmt.Sprintf(`{"id":"%s","origin":"农场","destination":"门店","carrierId":"C1","shipperId":"F1","receiverId":"RETAILER_R1","items":[{"productId":"P1","quantity":50}]}`, id))))
+	}
+	advance := func(shipmentID string, statuses ...string) {
+		for _, status := range statuses {
+			assert.NoError(t, stub.commit(contract.AddShipmentCheckpoint(ctx, shipmentID, fmt.Sprintf(`{"location":"途中","status":"%s"}`, status))))
+		}
+	}
+	request := func(id string) *ReplenishmentRequest {
+		request, err := contract.QueryReplenishment(ctx, id)
+		assert.NoError(t, err)
+		return request
+	}
+
+	// 交接被拒收后补货申请退回已确认，可重新发货
+	createShipment("S1")
+	assert.NoError(t, stub.commit(contract.ShipReplenishment(ctx, "REPLENISH_R1", "SHIPMENT_S1")))
+	advance("SHIPMENT_S1", "PICKED_UP", "IN_TRANSIT", "OUT_FOR_DELIVERY", "DELIVERED")
+	assert.NoError(t, stub.commit(contract.RejectTransfer(ctx, "TRANSFER_SHIPMENT_S1", "RETAILER_R1", "质量不符")))
+	assert.Equal(t, "ACKNOWLEDGED", request("REPLENISH_R1").Status)
+	assert.Empty(t, request("REPLENISH_R1").ShipmentID)
+
+	// 已送达的运输单不能再关联
+	assert.Error(t, stub.commit(contract.ShipReplenishment(ctx, "REPLENISH_R1", "SHIPMENT_S1")))
+
+	// 运输单丢失时同样退回
+	createShipment("S2")
+	advance("SHIPMENT_S2", "PICKED_UP", "IN_TRANSIT")
+	assert.NoError(t, stub.commit(contract.ShipReplenishment(ctx, "REPLENISH_R1", "SHIPMENT_S2")))
+	advance("SHIPMENT_S2", "LOST")
+	assert.Equal(t, "ACKNOWLEDGED", request("REPLENISH_R1").Status)
+
+	// 交接被接收后按实收数量完成
+	createShipment("S3")
+	assert.NoError(t, stub.commit(contract.ShipReplenishment(ctx, "REPLENISH_R1", "SHIPMENT_S3")))
+	assert.Equal(t, "SHIPPED", request("REPLENISH_R1").Status)
+	advance("SHIPMENT_S3", "PICKED_UP", "IN_TRANSIT", "OUT_FOR_DELIVERY", "DELIVERED")
+	assert.NoError(t, stub.commit(contract.AcceptTransfer(ctx, "TRANSFER_SHIPMENT_S3", "RETAILER_R1", `[{"productId":"P1","acceptedQuantity":45}]`)))
+	assert.Equal(t, "FULFILLED", request("REPLENISH_R1").Status)
+	assert.Equal(t, 45, request("REPLENISH_R1").FulfilledQuantity)
+
+	// 同一产品分多行交接时累计实收数量
+	assert.NoError(t, stub.commit(contract.RequestReplenishment(ctx, `{"id":"R2","retailerId":"RETAILER_R1","supplierId":"F1","productId":"P1","quantity":30}`)))
+	assert.NoError(t, stub.commit(contract.RespondReplenishment(ctx, "REPLENISH_R2", "F1", true, "")))
+	createShipment("S4")
+	assert.NoError(t, stub.commit(contract.ShipReplenishment(ctx, "REPLENISH_R2", "SHIPMENT_S4")))
+	assert.NoError(t, stub.commit(contract.fulfillReplenishments(ctx, &LotTransfer{ShipmentID: "SHIPMENT_S4", Items: []TransferItem{
+		{ProductID: "P1", AcceptedQuantity: 20},
+		{ProductID: "P1", AcceptedQuantity: 10},
+	}})))
+	assert.Equal(t, 30, request("REPLENISH_R2").FulfilledQuantity)
+}
+
+func TestTransferStock(t *testing.T) {
+	ctx, stub := newMemoryContext()
+	contract := new(AgriTrace)
+
+	assert.NoError(t, stub.commit(contract.CreateProduct(ctx, `{"id":"P1","name":"番茄","farmerId":"F1"}`)))
+	assert.NoError(t, stub.commit(contract.CreateProduct(ctx, `{"id":"S2_P1","name":"黄瓜","farmerId":"F1"}`)))
+	assert.NoError(t, stub.commit(contract.RegisterRetailer(ctx, `{"id":"R1","name":"生鲜超市"}`)))
+	assert.NoError(t, stub.commit(contract.AddRetailerStore(ctx, "RETAILER_R1", `{"id":"S1","name":"一号店"}`)))
+	assert.NoError(t, stub.commit(contract.AddRetailerStore(ctx, "RETAILER_R1", `{"id":"S2","name":"二号店"}`)))
+	assert.NoError(t, stub.commit(contract.AddRetailInventory(ctx, `{"retailerId":"RETAILER_R1","storeId":"S1","productId":"P1","lotId":"L1","quantity":20,"expiryDate":"2099-01-01T00:00:00Z"}`)))
+	assert.NoError(t, stub.commit(contract.ReserveStock(ctx, `{"id":"RS1","retailerId":"RETAILER_R1","storeId":"S1","productId":"P1","lotId":"L1","consumerId":"C1","quantity":5}`)))
+
+	// 已被预留的库存不能调出
+	assert.Error(t, stub.commit(contract.TransferStock(ctx, `{"id":"X1","retailerId":"RETAILER_R1","fromStoreId":"S1","toStoreId":"S2","productId":"P1","lotId":"L1","quantity":16}`)))
+
+	assert.NoError(t, stub.commit(contract.TransferStock(ctx, `{"id":"X1","retailerId":"RETAILER_R1","fromStoreId":"S1","toStoreId":"S2","productId":"P1","lotId":"L1","quantity":10}`)))
+	source, err := contract.QueryInventory(ctx, "INV_R1_S1_P1_L1")
+	assert.NoError(t, err)
+	assert.Equal(t, 10, source.Quantity)
+	target, err := contract.QueryInventory(ctx, "INV_R1_S2_P1_L1")
+	assert.NoError(t, err)
+	assert.Equal(t, 10, target.Quantity)
+	assert.Equal(t, "S2", target.StoreID)
+	assert.Equal(t, "L1", target.LotID)
+	assert.Equal(t, source.ExpiryDate, target.ExpiryDate)
+
+	// 再次调入同一门店时累加到已有库存
+	assert.NoError(t, stub.commit(contract.TransferStock(ctx, `{"id":"X2","retailerId":"RETAILER_R1","fromStoreId":"S1","toStoreId":"S2","productId":"P1","lotId":"L1","quantity":5}`)))
+	target, err = contract.QueryInventory(ctx, "INV_R1_S2_P1_L1")
+	assert.NoError(t, err)
+	assert.Equal(t, 15, target.Quantity)
+
+	// 本部产品 S2_P1 的库存与二号店产品 P1 的默认库存ID相同，不能覆盖
+	assert.NoError(t, stub.commit(contract.AddRetailInventory(ctx, `{"retailerId":"RETAILER_R1","productId":"S2_P1","quantity":8}`)))
+	assert.NoError(t, stub.commit(contract.AddRetailInventory(ctx, `{"retailerId":"RETAILER_R1","productId":"P1","quantity":6}`)))
+	assert.Error(t, stub.commit(contract.TransferStock(ctx, `{"id":"X3","retailerId":"RETAILER_R1","toStoreId":"S2","productId":"P1","quantity":3}`)))
+	occupied, err := contract.QueryInventory(ctx, "INV_R1_S2_P1")
+	assert.NoError(t, err)
+	assert.Equal(t, "S2_P1", occupied.ProductID)
+	assert.Equal(t, 8, occupied.Quantity)
+	headquarters, err := contract.QueryInventory(ctx, "INV_R1_P1")
+	assert.NoError(t, err)
+	assert.Equal(t, 6, headquarters.Quantity)
+
+	// 交接收货新建库存时同样检查ID占用
+	ctx, stub = newMemoryContext()
+	assert.NoError(t, stub.commit(contract.CreateProduct(ctx, `{"id":"P1","name":"番茄","farmerId":"F1"}`)))
+	assert.NoError(t, stub.commit(contract.CreateProduct(ctx, `{"id":"S2_P1","name":"黄瓜","farmerId":"F1"}`)))
+	assert.NoError(t, stub.commit(contract.AddProductionRecord(ctx, `{"id":"PR1","productId":"S2_P1","type":"HARVESTING","date":"2024-06-01","quantity":10}`)))
+	assert.NoError(t, stub.commit(contract.RegisterRetailer(ctx, `{"id":"R1","name":"生鲜超市"}`)))
+	assert.NoError(t, stub.commit(contract.AddRetailerStore(ctx, "RETAILER_R1", `{"id":"S2","name":"二号店"}`)))
+	assert.NoError(t, stub.commit(contract.AddRetailInventory(ctx, `{"retailerId":"RETAILER_R1","storeId":"S2","productId":"P1","quantity":4}`)))
+	assert.NoError(t, stub.commit(contract.InitiateTransfer(ctx, `{"id":"T1","senderId":"F1","receiverId":"RETAILER_R1","items":[{"productId":"S2_P1","quantity":10}]}`)))
+	assert.Error(t, stub.commit(contract.AcceptTransfer(ctx, "TRANSFER_T1", "RETAILER_R1", "")))
+	occupied, err = contract.QueryInventory(ctx, "INV_R1_S2_P1")
+	assert.NoError(t, err)
+	assert.Equal(t, "P1", occupied.ProductID)
+	assert.Equal(t, 4, occupied.Quantity)
+}
+
+func TestRetailerDeliveryReceipt(t *testing.T) {
+	ctx, stub := newMemoryContext()
+	contract := new(AgriTrace)
+
+	assert.NoError(t, stub.commit(contract.CreateProduct(ctx, `{"id":"P1","name":"番茄","farmerId":"F1"}`)))
+	assert.NoError(t, stub.commit(contract.AddProductionRecord(ctx, `{"id":"PR1","productId":"P1","type":"HARVESTING","date":"2024-06-01","quantity":100}`)))
+	assert.NoError(t, stub.commit(contract.SetProductExpiry(ctx, "P1", "2099-06-01")))
+	assert.NoError(t, stub.commit(contract.RegisterRetailer(ctx, `{"id":"R1","name":"生鲜超市"}`)))
+	assert.NoError(t, stub.commit(contract.AddRetailerStore(ctx, "RETAILER_R1", `{"id":"S1","name":"一号店"}`)))
+	assert.NoError(t, stub.commit(contract.AddRetailerStore(ctx, "RETAILER_R1", `{"id":"S2","name":"二号店"}`)))
+
+	// 收货门店须为收货零售商的门店
+	assert.Error(t, stub.commit(contract.AddLogisticsRecord(ctx, `{"id":"L0","productId":"P1","location":"农场","operatorId":"C1","receiverId":"D1","storeId":"S1","quantity":30}`)))
+	assert.Error(t, stub.commit(contract.AddLogisticsRecord(ctx, `{"id":"L0","productId":"P1","location":"农场","operatorId":"C1","receiverId":"RETAILER_R1","storeId":"S9","quantity":30}`)))
+
+	// 物流记录送达并确认后入库到指定门店和批次号，库存变动关联物流记录
+	assert.NoError(t, stub.commit(contract.AddLogisticsRecord(ctx, `{"id":"L1","productId":"P1","location":"农场","operatorId":"C1","receiverId":"RETAILER_R1","storeId":"S1","lotId":"LOT1","quantity":30}`)))
+	for _, status := range []string{"PICKED_UP", "IN_TRANSIT", "OUT_FOR_DELIVERY", "DELIVERED"} {
+		assert.NoError(t, stub.commit(contract.UpdateLogisticsRecord(ctx, "L1", status, "途中", status, "", "")))
+	}
+	assert.NoError(t, stub.commit(contract.AcceptTransfer(ctx, "TRANSFER_L1", "RETAILER_R1", "")))
+
+	inventory, err := contract.QueryInventory(ctx, "INV_R1_S1_P1_LOT1")
+	assert.NoError(t, err)
+	assert.Equal(t, 30, inventory.Quantity)
+	movements, err := contract.QueryStockMovements(ctx, "INV_R1_S1_P1_LOT1")
+	assert.NoError(t, err)
+	if assert.Len(t, movements, 1) {
+		assert.Equal(t, "RECEIPT", movements[0].Type)
+		assert.Equal(t, "L1", movements[0].ShipmentID)
+		assert.Equal(t, "TRANSFER_L1", movements[0].TransferID)
+	}
+	assert.NoError(t, stub.commit(contract.SetInventoryExpiry(ctx, "INV_R1_S1_P1_LOT1", "2098-01-01")))
+
+	// 运输单送达时同样按门店和批次号入库，沿用批次到期时间
+	assert.NoError(t, stub.commit(contract.CreateShipment(ctx, `{"id":"S1","origin":"农场","destination":"二号店","carrierId":"C1","shipperId":"F1","receiverId":"RETAILER_R1","storeId":"S2","items":[{"productId":"P1","quantity":20,"lotId":"LOT2"}]}`)))
+	for _, status := range []string{"PICKED_UP", "IN_TRANSIT", "OUT_FOR_DELIVERY", "DELIVERED"} {
+		assert.NoError(t, stub.commit(contract.AddShipmentCheckpoint(ctx, "SHIPMENT_S1", fmt.Sprintf(`{"location":"途中","status":"%s"}`, status))))
+	}
+	assert.NoError(t, stub.commit(contract.AcceptTransfer(ctx, "TRANSFER_SHIPMENT_S1", "RETAILER_R1", "")))
+	inventory, err = contract.QueryInventory(ctx, "INV_R1_S2_P1_LOT2")
+	assert.NoError(t, err)
+	assert.Equal(t, 20, inventory.Quantity)
+	product, err := contract.QueryProduct(ctx, "P1")
+	assert.NoError(t, err)
+	assert.Equal(t, product.ExpiryDate, inventory.ExpiryDate)
+	movements, err = contract.QueryStockMovements(ctx, "INV_R1_S2_P1_LOT2")
+	assert.NoError(t, err)
+	if assert.Len(t, movements, 1) {
+		assert.Equal(t, "SHIPMENT_S1", movements[0].ShipmentID)
+	}
+
+	// 零售商移交时在各门店、批次号的库存中先到期先出扣减
+	assert.NoError(t, stub.commit(contract.InitiateTransfer(ctx, `{"id":"T1","senderId":"RETAILER_R1","receiverId":"D1","items":[{"productId":"P1","quantity":40}]}`)))
+	assert.NoError(t, stub.commit(contract.AcceptTransfer(ctx, "TRANSFER_T1", "D1", "")))
+	inventory, err = contract.QueryInventory(ctx, "INV_R1_S1_P1_LOT1")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, inventory.Quantity)
+	inventory, err = contract.QueryInventory(ctx, "INV_R1_S2_P1_LOT2")
+	assert.NoError(t, err)
+	assert.Equal(t, 10, inventory.Quantity)
+	movements, err = contract.QueryStockMovements(ctx, "INV_R1_S2_P1_LOT2")
+	assert.NoError(t, err)
+	if assert.Len(t, movements, 2) {
+		assert.Equal(t, "TRANSFER_OUT", movements[1].Type)
+		assert.Equal(t, -10, movements[1].Quantity)
+	}
+}
+
+func TestRetailInventoryLotsAndSales(t *testing.T) {
+	ctx, stub := newMemoryContext()
+	contract := new(AgriTrace)
+
+	assert.NoError(t, stub.commit(contract.CreateProduct(ctx, `{"id":"P1","name":"番茄","farmerId":"F1"}`)))
+	assert.NoError(t, stub.commit(contract.RegisterRetailer(ctx, `{"id":"R1","name":"生鲜超市"}`)))
+	assert.NoError(t, stub.commit(contract.AddRetailInventory(ctx, `{"retailerId":"RETAILER_R1","productId":"P1","lotId":"L1","quantity":10,"expiryDate":"2099-01-01T00:00:00Z"}`)))
+
+	// 同一批次号登记不同到期时间的货物被拒绝，相同到期时间或未指定时累加
+	assert.Error(t, stub.commit(contract.AddRetailInventory(ctx, `{"retailerId":"RETAILER_R1","productId":"P1","lotId":"L1","quantity":5,"expiryDate":"2099-06-01T00:00:00Z"}`)))
+	assert.NoError(t, stub.commit(contract.AddRetailInventory(ctx, `{"retailerId":"RETAILER_R1","productId":"P1","lotId":"L1","quantity":5,"expiryDate":"2099-01-01T00:00:00Z"}`)))
+	assert.NoError(t, stub.commit(contract.AddRetailInventory(ctx, `{"retailerId":"RETAILER_R1","productId":"P1","lotId":"L1","quantity":5}`)))
+	assert.NoError(t, stub.commit(contract.AddRetailInventory(ctx, `{"retailerId":"RETAILER_R1","productId":"P1","lotId":"L2","quantity":10,"expiryDate":"2099-06-01T00:00:00Z"}`)))
+	lot1, err := contract.QueryInventory(ctx, "INV_R1_P1_L1")
+	assert.NoError(t, err)
+	assert.Equal(t, 20, lot1.Quantity)
+
+	// 先到期的批次中被预留的数量不参与先到期先出
+	assert.NoError(t, stub.commit(contract.ReserveStock(ctx, `{"id":"RS1","retailerId":"RETAILER_R1","productId":"P1","lotId":"L1","consumerId":"C1","quantity":15}`)))
+	assert.NoError(t, stub.commit(contract.AddSalesRecord(ctx, `{"id":"S1","productId":"P1","retailerId":"RETAILER_R1","quantity":8,"unitPrice":2}`)))
+	lot1, err = contract.QueryInventory(ctx, "INV_R1_P1_L1")
+	assert.NoError(t, err)
+	assert.Equal(t, 15, lot1.Quantity)
+	lot2, err := contract.QueryInventory(ctx, "INV_R1_P1_L2")
+	assert.NoError(t, err)
+	assert.Equal(t, 7, lot2.Quantity)
+
+	assert.Error(t, stub.commit(contract.AddSalesRecord(ctx, `{"id":"S2","productId":"P1","retailerId":"RETAILER_R1","quantity":8,"unitPrice":2}`)))
+}
+
+func TestQualityCertificateLifecycle(t *testing.T) {
+	ctx, stub := newMemoryContext()
+	contract := new(AgriTrace)
+
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	assert.NoError(t, stub.commit(contract.CreateProduct(ctx, `{"id":"P1","farmerId":"F1"}`)))
+	assert.NoError(t, stub.commit(contract.RegisterInspector(ctx, fmt.Sprintf(`{"id":"I1","publicKey":%q}`, base64.StdEncoding.EncodeToString(public)))))
+	registerLabSample(t, ctx, stub, "S1", "P1")
+
+	assert.NoError(t, stub.commit(contract.AddQualityRecord(ctx, `{"id":"Q1","productId":"P1","stage":"HARVESTING","testType":"农残","result":"未检出","isQualified":true,"inspectorId":"I1","sampleId":"SAMPLE_S1"}`)))
+	assert.NoError(t, stub.commit(contract.AddQualityRecord(ctx, `{"id":"Q2","productId":"P1","stage":"GROWING","testType":"重金属","result":"合格","isQualified":true,"inspectorId":"I1","sampleId":"SAMPLE_S1"}`)))
+
+	// 已存在的检测记录不能被覆盖
+	assert.Error(t, stub.commit(contract.AddQualityRecord(ctx, `{"id":"Q1","productId":"P1","stage":"HARVESTING","testType":"农残","result":"超标","isQualified":false,"inspectorId":"I1","sampleId":"SAMPLE_S1"}`)))
+	record, err := contract.QueryQualityRecord(ctx, "Q1")
+	assert.NoError(t, err)
+	assert.True(t, record.IsQualified)
+
+	hash, err := contract.QueryCertificateHash(ctx, "P1")
+	assert.NoError(t, err)
+	signature := base64.StdEncoding.EncodeToString(ed25519.Sign(private, []byte(hash)))
+
+	// 签名与哈希不符时拒绝签发
+	forged := base64.StdEncoding.EncodeToString(ed25519.Sign(private, []byte("other")))
+	assert.Error(t, stub.commit(contract.IssueQualityCertificate(ctx, fmt.Sprintf(`{"id":"C1","productId":"P1","inspectorId":"I1","signature":%q}`, forged))))
+
+	assert.NoError(t, stub.commit(contract.IssueQualityCertificate(ctx, fmt.Sprintf(`{"id":"C1","productId":"P1","inspectorId":"I1","signature":%q}`, signature))))
+	certificate, err := contract.QueryQualityCertificate(ctx, "CERT_C1")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"Q1", "Q2"}, certificate.RecordIDs)
+
+	verification, err := contract.VerifyCertificate(ctx, "CERT_C1")
+	assert.NoError(t, err)
+	assert.True(t, verification.Valid)
+	assert.Empty(t, verification.Issues)
+
+	// 同一检测项目有了新的检测记录后，证书标记为已被取代
+	assert.NoError(t, stub.commit(contract.AddQualityRecord(ctx, `{"id":"Q3","productId":"P1","stage":"HARVESTING","testType":"农残","result":"未检出","isQualified":true,"inspectorId":"I1","sampleId":"SAMPLE_S1"}`)))
+	verification, err = contract.VerifyCertificate(ctx, "CERT_C1")
+	assert.NoError(t, err)
+	assert.False(t, verification.Valid)
+	assert.True(t, verification.Superseded)
+	assert.True(t, verification.SignatureValid)
+	assert.True(t, verification.HashValid)
+}
+
+func TestQualityHoldStopsSales(t *testing.T) {
+	ctx, stub := newMemoryContext()
+	contract := new(AgriTrace)
+
+	assert.NoError(t, stub.commit(contract.CreateProduct(ctx, `{"id":"P1","name":"番茄","farmerId":"F1"}`)))
+	assert.NoError(t, stub.commit(contract.RegisterInspector(ctx, `{"id":"I1"}`)))
+	assert.NoError(t, stub.commit(contract.RegisterConsumer(ctx, `{"id":"C1","name":"张三"}`)))
+	assert.NoError(t, stub.commit(contract.RegisterRetailer(ctx, `{"id":"R1","name":"生鲜超市"}`)))
+	assert.NoError(t, stub.commit(contract.AddRetailInventory(ctx, `{"retailerId":"RETAILER_R1","productId":"P1","quantity":20}`)))
+	assert.NoError(t, stub.commit(contract.ReserveStock(ctx, `{"id":"RS1","retailerId":"RETAILER_R1","productId":"P1","consumerId":"CONSUMER_C1","quantity":2}`)))
+	registerLabSample(t, ctx, stub, "S1", "P1")
+
+	// 检测不合格后冻结产品，销售、购买、预留及预留成交均被拒绝
+	assert.NoError(t, stub.commit(contract.AddQualityRecord(ctx, `{"id":"Q1","productId":"P1","stage":"HARVESTING","testType":"农残","isQualified":false,"inspectorId":"I1","sampleId":"SAMPLE_S1"}`)))
+	assert.Error(t, stub.commit(contract.AddSalesRecord(ctx, `{"id":"S1","productId":"P1","retailerId":"RETAILER_R1","quantity":1,"unitPrice":2}`)))
+	assert.Error(t, stub.commit(contract.AddConsumerPurchase(ctx, `{"id":"B1","productId":"P1","consumerId":"CONSUMER_C1","retailerId":"RETAILER_R1","quantity":1,"unitPrice":2}`)))
+	assert.Error(t, stub.commit(contract.ReserveStock(ctx, `{"id":"RS2","retailerId":"RETAILER_R1","productId":"P1","consumerId":"CONSUMER_C1","quantity":1}`)))
+	assert.Error(t, stub.commit(contract.ConfirmReservation(ctx, "RESERVE_RS1", `{"id":"B2","unitPrice":2}`)))
+	inventory, err := contract.QueryInventory(ctx, "INV_R1_P1")
+	assert.NoError(t, err)
+	assert.Equal(t, 20, inventory.Quantity)
+
+	// 复检合格解除冻结后恢复销售
+	assert.NoError(t, stub.commit(contract.AddQualityRecord(ctx, `{"id":"Q2","productId":"P1","stage":"HARVESTING","testType":"农残","isQualified":true,"inspectorId":"I1","sampleId":"SAMPLE_S1"}`)))
+	assert.NoError(t, stub.commit(contract.AddSalesRecord(ctx, `{"id":"S1","productId":"P1","retailerId":"RETAILER_R1","quantity":1,"unitPrice":2}`)))
+	assert.NoError(t, stub.commit(contract.ConfirmReservation(ctx, "RESERVE_RS1", `{"id":"B2","unitPrice":2}`)))
+	inventory, err = contract.QueryInventory(ctx, "INV_R1_P1")
+	assert.NoError(t, err)
+	assert.Equal(t, 17, inventory.Quantity)
+}
@@ -1,9 +1,7 @@
 import React from 'react';
-import { Modal, Form, Input, Select, message } from 'antd';
+import { Modal, Form, Input, message } from 'antd';
 import { Product, LogisticsRecord } from '../../types';
 
-const { Option } = Select;
-
 interface Props {
     visible: boolean;
     product: Product;
@@ -22,9 +20,11 @@ const AddLogisticsRecordModal: React.FC<Props> = ({
     const handleSubmit = async () => {
         try {
             const values = await form.validateFields();
+            // 新建物流记录从"已创建"开始，后续状态通过更新物流记录流转
             const recordData = {
                 productId: product.id,
-                ...values
+                ...values,
+                status: 'CREATED' as const
             };
             await onSubmit(recordData);
             form.resetFields();
@@ -44,9 +44,6 @@ const AddLogisticsRecordModal: React.FC<Props> = ({
             <Form
                 form={form}
                 layout="vertical"
-                initialValues={{
-                    status: 'IN_TRANSIT'
-                }}
             >
                 <Form.Item
                     name="location"
@@ -56,15 +53,8 @@ const AddLogisticsRecordModal: React.FC<Props> = ({
                     <Input placeholder="请输入当前位置" />
                 </Form.Item>
 
-                <Form.Item
-                    name="status"
-                    label="物流状态"
-                    rules={[{ required: true, message: '请选择物流状态' }]}
-                >
-                    <Select>
-                        <Option value="IN_TRANSIT">运输中</Option>
-                        <Option value="DELIVERED">已送达</Option>
-                    </Select>
+                <Form.Item label="物流状态">
+                    <Input value="已创建" disabled />
                 </Form.Item>
 
                 <Form.Item
@@ -9,6 +9,28 @@ import { v4 as uuidv4 } from 'uuid';
 
 const { TabPane } = Tabs;
 
+const statusLabels: Record<LogisticsRecord['status'], string> = {
+    CREATED: '已创建',
+    PICKED_UP: '已揽收',
+    IN_TRANSIT: '运输中',
+    AT_HUB: '中转中',
+    OUT_FOR_DELIVERY: '派送中',
+    DELIVERED: '已送达',
+    REJECTED: '已拒收',
+    LOST: '已丢失',
+};
+
+const statusColors: Record<LogisticsRecord['status'], string> = {
+    CREATED: 'default',
+    PICKED_UP: 'processing',
+    IN_TRANSIT: 'processing',
+    AT_HUB: 'processing',
+    OUT_FOR_DELIVERY: 'processing',
+    DELIVERED: 'success',
+    REJECTED: 'error',
+    LOST: 'error',
+};
+
 const LogisticsManagement: React.FC = () => {
     const [pendingProducts, setPendingProducts] = useState<Product[]>([]);
     const [logisticsHistory, setLogisticsHistory] = useState<LogisticsRecord[]>([]);
@@ -116,8 +138,8 @@ const LogisticsManagement: React.FC = () => {
             dataIndex: 'status',
             key: 'status',
             render: (status: LogisticsRecord['status']) => (
-                <Tag color={status === 'IN_TRANSIT' ? 'processing' : 'success'}>
-                    {status === 'IN_TRANSIT' ? '运输中' : '已送达'}
+                <Tag color={statusColors[status]}>
+                    {statusLabels[status]}
                 </Tag>
             ),
         },
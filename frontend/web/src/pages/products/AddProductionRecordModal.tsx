@@ -1,5 +1,5 @@
 import React from 'react';
-import { Modal, Form, Input, DatePicker, Select } from 'antd';
+import { Modal, Form, Input, InputNumber, DatePicker, Select } from 'antd';
 import { v4 as uuidv4 } from 'uuid';
 import { ProductionRecord } from '../../types';
 
@@ -65,6 +65,26 @@ const AddProductionRecordModal: React.FC<AddProductionRecordModalProps> = ({ vis
                     </Select>
                 </Form.Item>
 
+                <Form.Item
+                    noStyle
+                    shouldUpdate={(prev, next) => prev.type !== next.type}
+                >
+                    {({ getFieldValue }) => getFieldValue('type') === 'HARVESTING' && (
+                        <Form.Item
+                            name="quantity"
+                            label="收获数量"
+                            rules={[{ required: true, message: '请输入收获数量' }]}
+                        >
+                            <InputNumber
+                                min={1}
+                                precision={0}
+                                style={{ width: '100%' }}
+                                placeholder="请输入收获数量"
+                            />
+                        </Form.Item>
+                    )}
+                </Form.Item>
+
                 <Form.Item
                     name="date"
                     label="操作日期"
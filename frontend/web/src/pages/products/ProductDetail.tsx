@@ -34,13 +34,14 @@ const { TabPane } = Tabs;
 const productionTypeMap: Record<ProductionRecord['type'], string> = {
     'PLANTING': '播种',
     'FERTILIZING': '施肥',
-    'HARVESTING': '收获'
+    'HARVESTING': '收获',
+    'HARVEST_QUANTITY': '补录收获数量'
 };
 
 interface ChartDataPoint {
     time: string;
-    temperature: number;
-    humidity: number;
+    temperature?: number;
+    humidity?: number;
 }
 
 const ProductDetail: React.FC = () => {
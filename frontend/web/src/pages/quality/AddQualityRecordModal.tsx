@@ -62,6 +62,14 @@ const AddQualityRecordModal: React.FC<Props> = ({
                     </Select>
                 </Form.Item>
 
+                <Form.Item
+                    name="sampleId"
+                    label="样品编号"
+                    rules={[{ required: true, message: '请输入已由实验室接收的样品编号' }]}
+                >
+                    <Input placeholder="请输入样品编号，样品须已完成保管交接并由实验室接收" />
+                </Form.Item>
+
                 <Form.Item
                     name="testType"
                     label="检测类型"
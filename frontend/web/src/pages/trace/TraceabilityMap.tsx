@@ -279,7 +279,10 @@ const TraceabilityMap: React.FC = () => {
           {hasEnvironment && environment.map((record: any, index: number) => (
             <Timeline.Item key={`env-${index}`} color="cyan">
               <Text strong>{record.recordTime || record.createdAt}</Text> - 环境记录：
-              温度: {record.temperature}°C, 湿度: {record.humidity}%
+              {[
+                record.temperature !== undefined ? `温度: ${record.temperature}°C` : null,
+                record.humidity !== undefined ? `湿度: ${record.humidity}%` : null
+              ].filter(Boolean).join(', ') || '无温湿度读数'}
             </Timeline.Item>
           ))}
           
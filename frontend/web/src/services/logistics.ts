@@ -8,7 +8,7 @@ export const logisticsService = {
     },
 
     // 更新物流记录
-    updateLogisticsRecord: async (recordId: string, data: Pick<LogisticsRecord, 'status' | 'location' | 'description'>): Promise<LogisticsRecord> => {
+    updateLogisticsRecord: async (recordId: string, data: Pick<LogisticsRecord, 'status' | 'location' | 'description' | 'latitude' | 'longitude'>): Promise<LogisticsRecord> => {
         return apiService.put<LogisticsRecord>(`/logistics/${recordId}`, data);
     },
 
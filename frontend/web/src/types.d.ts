@@ -18,6 +18,7 @@ export interface Product {
     location: string;
     createdAt: string;
     updatedAt: string;
+    harvestQuantity?: number;
 }
 
 export interface Farm {
@@ -50,18 +51,19 @@ export interface TraceabilityRecord {
 export interface ProductionRecord {
     id: string;
     productId: string;
-    type: 'PLANTING' | 'FERTILIZING' | 'HARVESTING';
+    type: 'PLANTING' | 'FERTILIZING' | 'HARVESTING' | 'HARVEST_QUANTITY';
     date: string;
     description: string;
     operatorId: string;
     createdAt: string;
+    quantity?: number;
 }
 
 export interface EnvironmentRecord {
     id: string;
     productId: string;
-    temperature: number;
-    humidity: number;
+    temperature?: number; // 记录未采集温度时不返回
+    humidity?: number; // 记录未采集湿度时不返回
     recordTime: string;
     operatorId: string;
 }
@@ -77,6 +79,7 @@ export interface QualityRecord {
     isQualified: boolean;
     inspectorId: string;
     recordTime: string;
+    sampleId: string;
 }
 
 export interface User {
@@ -95,10 +98,12 @@ export interface LogisticsRecord {
     id: string;
     productId: string;
     location: string;
-    status: 'IN_TRANSIT' | 'DELIVERED';
+    status: 'CREATED' | 'PICKED_UP' | 'IN_TRANSIT' | 'AT_HUB' | 'OUT_FOR_DELIVERY' | 'DELIVERED' | 'REJECTED' | 'LOST';
     description: string;
     operatorId: string;
     recordTime: string;
+    latitude?: number;
+    longitude?: number;
 }
 
 export interface RetailInventory {